@@ -0,0 +1,355 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Options are the parameters of the algorithms which take any.
+type Options struct {
+	// Iterations of PageRank, defaulting to 20.
+	Iterations int `json:"iterations,omitempty"`
+
+	// Damping factor of PageRank, defaulting to 0.85.
+	Damping float64 `json:"damping,omitempty"`
+}
+
+// Algorithm computes a value for every node of a snapshot, calling progress with the fraction of the work done. The
+// longer running algorithms stop early once the context is done, leaving the values incomplete.
+type Algorithm func(ctx context.Context, s *Snapshot, opts Options, progress func(float64)) []interface{}
+
+// algorithms are the algorithms which can be run by name.
+var algorithms = map[string]Algorithm{
+	"pagerank": func(ctx context.Context, s *Snapshot, opts Options, progress func(float64)) []interface{} {
+		return floats(PageRank(ctx, s, opts.Iterations, opts.Damping, progress))
+	},
+	"wcc": func(ctx context.Context, s *Snapshot, opts Options, progress func(float64)) []interface{} {
+		return ints(WeakComponents(s))
+	},
+	"scc": func(ctx context.Context, s *Snapshot, opts Options, progress func(float64)) []interface{} {
+		return ints(StrongComponents(s))
+	},
+	"degree": func(ctx context.Context, s *Snapshot, opts Options, progress func(float64)) []interface{} {
+		return floats(Degree(s))
+	},
+	"betweenness": func(ctx context.Context, s *Snapshot, opts Options, progress func(float64)) []interface{} {
+		return floats(Betweenness(ctx, s, progress))
+	},
+	"triangles": func(ctx context.Context, s *Snapshot, opts Options, progress func(float64)) []interface{} {
+		return ints(Triangles(s))
+	},
+}
+
+// Lookup returns the algorithm with the name, one of pagerank, wcc, scc, degree, betweenness or triangles.
+func Lookup(name string) (Algorithm, error) {
+	a, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %s", name)
+	}
+	return a, nil
+}
+
+// Names returns the names of the algorithms.
+func Names() []string {
+	names := []string{}
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PageRank returns the PageRank of each node, the ranks sum to 1. The rank of nodes without outgoing edges is
+// shared between every node. The iterations stop once the context is done.
+func PageRank(ctx context.Context, s *Snapshot, iterations int, damping float64, progress func(float64)) []float64 {
+	if iterations <= 0 {
+		iterations = 20
+	}
+	if damping <= 0 {
+		damping = 0.85
+	}
+
+	n := s.Len()
+	rank := make([]float64, n)
+	for i := range rank {
+		rank[i] = 1 / float64(n)
+	}
+
+	for it := 0; it < iterations && ctx.Err() == nil; it++ {
+		next := make([]float64, n)
+		dangling := 0.0
+		for i, out := range s.Out {
+			if len(out) == 0 {
+				dangling += rank[i]
+				continue
+			}
+
+			share := rank[i] / float64(len(out))
+			for _, j := range out {
+				next[j] += damping * share
+			}
+		}
+
+		for i := range next {
+			next[i] += (1-damping)/float64(n) + damping*dangling/float64(n)
+		}
+		rank = next
+
+		if progress != nil {
+			progress(float64(it+1) / float64(iterations))
+		}
+	}
+	return rank
+}
+
+// WeakComponents returns the weakly connected component of each node, ignoring the direction of edges. Components
+// are numbered from 0 in the order of their first node.
+func WeakComponents(s *Snapshot) []int {
+	parent := make([]int, s.Len())
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(i int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+
+	for i, out := range s.Out {
+		for _, j := range out {
+			a, b := find(i), find(j)
+			if a < b {
+				parent[b] = a
+			} else if b < a {
+				parent[a] = b
+			}
+		}
+	}
+
+	roots := make([]int, s.Len())
+	for i := range roots {
+		roots[i] = find(i)
+	}
+	return number(roots)
+}
+
+// StrongComponents returns the strongly connected component of each node, where every node of a component can reach
+// every other. Components are numbered from 0 in the order of their first node.
+func StrongComponents(s *Snapshot) []int {
+	n := s.Len()
+	index := make([]int, n)
+	low := make([]int, n)
+	onStack := make([]bool, n)
+	comp := make([]int, n)
+	for i := range index {
+		index[i] = -1
+	}
+
+	// tarjan's algorithm run with an explicit stack of nodes and the position in their edges.
+	type frame struct{ node, edge int }
+
+	next, count := 0, 0
+	stack := []int{}
+	for root := 0; root < n; root++ {
+		if index[root] >= 0 {
+			continue
+		}
+
+		calls := []frame{{node: root}}
+		index[root], low[root] = next, next
+		next++
+		stack = append(stack, root)
+		onStack[root] = true
+
+		for len(calls) > 0 {
+			f := &calls[len(calls)-1]
+			v := f.node
+
+			if f.edge < len(s.Out[v]) {
+				w := s.Out[v][f.edge]
+				f.edge++
+
+				if index[w] < 0 {
+					index[w], low[w] = next, next
+					next++
+					stack = append(stack, w)
+					onStack[w] = true
+					calls = append(calls, frame{node: w})
+				} else if onStack[w] && index[w] < low[v] {
+					low[v] = index[w]
+				}
+				continue
+			}
+
+			calls = calls[:len(calls)-1]
+			if len(calls) > 0 {
+				u := calls[len(calls)-1].node
+				if low[v] < low[u] {
+					low[u] = low[v]
+				}
+			}
+
+			if low[v] == index[v] {
+				for {
+					w := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					onStack[w] = false
+					comp[w] = count
+					if w == v {
+						break
+					}
+				}
+				count++
+			}
+		}
+	}
+	return number(comp)
+}
+
+// number renumbers the labels from 0 in the order they first appear.
+func number(labels []int) []int {
+	ids := map[int]int{}
+	res := make([]int, len(labels))
+	for i, l := range labels {
+		id, ok := ids[l]
+		if !ok {
+			id = len(ids)
+			ids[l] = id
+		}
+		res[i] = id
+	}
+	return res
+}
+
+// Degree returns the degree centrality of each node, the number of edges into and out of the node divided by the
+// number of other nodes.
+func Degree(s *Snapshot) []float64 {
+	res := make([]float64, s.Len())
+	if s.Len() < 2 {
+		return res
+	}
+
+	for i := range res {
+		res[i] = float64(len(s.Out[i])+len(s.In[i])) / float64(s.Len()-1)
+	}
+	return res
+}
+
+// Betweenness returns the betweenness centrality of each node, the fraction of the shortest paths between other
+// nodes passing through the node, following edges in their direction. It uses Brandes' algorithm which takes time
+// proportional to the number of nodes times the number of edges. The sources stop once the context is done.
+func Betweenness(ctx context.Context, s *Snapshot, progress func(float64)) []float64 {
+	n := s.Len()
+	res := make([]float64, n)
+
+	sigma := make([]float64, n)
+	dist := make([]int, n)
+	delta := make([]float64, n)
+	preds := make([][]int, n)
+
+	for src := 0; src < n && ctx.Err() == nil; src++ {
+		for i := 0; i < n; i++ {
+			sigma[i], dist[i], delta[i], preds[i] = 0, -1, 0, preds[i][:0]
+		}
+		sigma[src], dist[src] = 1, 0
+
+		order := []int{}
+		queue := []int{src}
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			order = append(order, v)
+
+			for _, w := range s.Out[v] {
+				if dist[w] < 0 {
+					dist[w] = dist[v] + 1
+					queue = append(queue, w)
+				}
+
+				if dist[w] == dist[v]+1 {
+					sigma[w] += sigma[v]
+					preds[w] = append(preds[w], v)
+				}
+			}
+		}
+
+		for i := len(order) - 1; i >= 0; i-- {
+			w := order[i]
+			for _, v := range preds[w] {
+				delta[v] += sigma[v] / sigma[w] * (1 + delta[w])
+			}
+
+			if w != src {
+				res[w] += delta[w]
+			}
+		}
+
+		if progress != nil {
+			progress(float64(src+1) / float64(n))
+		}
+	}
+
+	if n > 2 {
+		for i := range res {
+			res[i] /= float64((n - 1) * (n - 2))
+		}
+	}
+	return res
+}
+
+// Triangles returns the number of triangles each node is part of, ignoring the direction of edges.
+func Triangles(s *Snapshot) []int {
+	n := s.Len()
+	adj := make([]map[int]bool, n)
+	for i := range adj {
+		adj[i] = map[int]bool{}
+	}
+
+	for i, out := range s.Out {
+		for _, j := range out {
+			if i != j {
+				adj[i][j] = true
+				adj[j][i] = true
+			}
+		}
+	}
+
+	res := make([]int, n)
+	for u := 0; u < n; u++ {
+		for v := range adj[u] {
+			if v <= u {
+				continue
+			}
+
+			for w := range adj[v] {
+				if w > v && adj[u][w] {
+					res[u]++
+					res[v]++
+					res[w]++
+				}
+			}
+		}
+	}
+	return res
+}
+
+func floats(vals []float64) []interface{} {
+	res := make([]interface{}, len(vals))
+	for i, v := range vals {
+		res[i] = v
+	}
+	return res
+}
+
+func ints(vals []int) []interface{} {
+	res := make([]interface{}, len(vals))
+	for i, v := range vals {
+		res[i] = v
+	}
+	return res
+}
@@ -0,0 +1,113 @@
+package analytics
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// snapshot returns a snapshot of the nodes a, b, c... with the edges given as pairs of node names.
+func snapshot(nodes int, edges ...string) *Snapshot {
+	keys := []string{}
+	for i := 0; i < nodes; i++ {
+		keys = append(keys, "n_"+string(rune('a'+i)))
+	}
+
+	s := newSnapshot(keys)
+	for _, e := range edges {
+		s.addEdge("n_"+e[:1], "n_"+e[1:])
+	}
+	return s
+}
+
+func TestPageRank(t *testing.T) {
+	// b and c both link to a, a links to b.
+	s := snapshot(3, "ba", "ca", "ab")
+	rank := PageRank(context.Background(), s, 50, 0.85, nil)
+
+	sum := 0.0
+	for _, r := range rank {
+		sum += r
+	}
+
+	if math.Abs(sum-1) > 1e-9 {
+		t.Fatalf("expected ranks to sum to 1, got %v", sum)
+	}
+
+	if !(rank[0] > rank[1] && rank[1] > rank[2]) {
+		t.Fatalf("expected a > b > c, got %v", rank)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	// a <-> b -> c, d -> e
+	s := snapshot(5, "ab", "ba", "bc", "de")
+
+	if got := WeakComponents(s); !reflect.DeepEqual(got, []int{0, 0, 0, 1, 1}) {
+		t.Fatalf("unexpected weak components %v", got)
+	}
+
+	if got := StrongComponents(s); !reflect.DeepEqual(got, []int{0, 0, 1, 2, 3}) {
+		t.Fatalf("unexpected strong components %v", got)
+	}
+}
+
+func TestDegree(t *testing.T) {
+	s := snapshot(3, "ab", "ac")
+	if got := Degree(s); !reflect.DeepEqual(got, []float64{1, 0.5, 0.5}) {
+		t.Fatalf("unexpected degrees %v", got)
+	}
+}
+
+func TestBetweenness(t *testing.T) {
+	// every path from a to c and d passes through b.
+	s := snapshot(4, "ab", "bc", "bd")
+	got := Betweenness(context.Background(), s, nil)
+
+	// b is on the paths a-c and a-d out of the 3 * 2 ordered pairs of other nodes.
+	if got[1] != 2.0/6 || got[0] != 0 || got[2] != 0 || got[3] != 0 {
+		t.Fatalf("unexpected betweenness %v", got)
+	}
+}
+
+func TestTriangles(t *testing.T) {
+	// a triangle a b c with d hanging off c, duplicate and reverse edges are ignored.
+	s := snapshot(4, "ab", "bc", "ca", "ac", "cd", "dd")
+	if got := Triangles(s); !reflect.DeepEqual(got, []int{1, 1, 1, 0}) {
+		t.Fatalf("unexpected triangles %v", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, name := range Names() {
+		a, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vals := a(context.Background(), snapshot(2, "ab"), Options{}, nil); len(vals) != 2 {
+			t.Fatalf("%s: expected 2 values, got %v", name, vals)
+		}
+	}
+
+	if _, err := Lookup("unknown"); err == nil {
+		t.Fatal("expected an error for an unknown algorithm")
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	progress := func(float64) { calls++ }
+
+	s := snapshot(4, "ab", "bc", "bd")
+	PageRank(ctx, s, 50, 0.85, progress)
+	Betweenness(ctx, s, progress)
+
+	if calls != 0 {
+		t.Fatalf("expected cancelled algorithms to stop, got %d steps", calls)
+	}
+}
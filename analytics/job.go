@@ -0,0 +1,302 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/graph"
+	"github.com/coldog/go-graph/objects"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// writeBatch is the number of nodes written back in each batch.
+const writeBatch = 500
+
+// States of a job.
+const (
+	Pending   = "pending"
+	Running   = "running"
+	Done      = "done"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+// Spec describes a job running an algorithm over a subgraph.
+type Spec struct {
+	Algorithm string `json:"algorithm"`
+	Selection
+	Options
+
+	// Property is the node body property the results are written to. Without a property the results are kept with
+	// the job instead.
+	Property string `json:"property,omitempty"`
+}
+
+// Result is the value computed for a node.
+type Result struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// Job runs an algorithm, loading the subgraph, computing the results and then writing them back. Phase is the part
+// of the job running and Progress the fraction of the phase done. Loading only counts the keys scanned.
+type Job struct {
+	ID       string    `json:"id"`
+	Spec     Spec      `json:"spec"`
+	State    string    `json:"state"`
+	Phase    string    `json:"phase,omitempty"`
+	Progress float64   `json:"progress"`
+	Scanned  int       `json:"scanned"`
+	Nodes    int       `json:"nodes"`
+	Edges    int       `json:"edges"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	algorithm Algorithm
+	results   []Result
+	cancel    context.CancelFunc
+	lock      *sync.Mutex
+}
+
+// NewJob returns a pending job for the spec.
+func NewJob(spec Spec) (*Job, error) {
+	a, err := Lookup(spec.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Iterations < 0 || spec.Damping < 0 || spec.Damping >= 1 {
+		return nil, fmt.Errorf("iterations must be positive and damping between 0 and 1")
+	}
+
+	return &Job{
+		ID:        objects.GenId(),
+		Spec:      spec,
+		State:     Pending,
+		algorithm: a,
+		lock:      &sync.Mutex{},
+	}, nil
+}
+
+// Status returns a copy of the job as it is now.
+func (j *Job) Status() Job {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return *j
+}
+
+// Results returns the results of a job which finished without writing them back.
+func (j *Job) Results() []Result {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.results
+}
+
+// Cancel stops the job if it is running. A job computing its results stops once the computation is done.
+func (j *Job) Cancel() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.cancel != nil {
+		j.cancel()
+	}
+}
+
+func (j *Job) update(f func(j *Job)) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f(j)
+}
+
+func (j *Job) phase(name string) {
+	j.update(func(j *Job) {
+		j.Phase = name
+		j.Progress = 0
+	})
+}
+
+func (j *Job) progress(p float64) {
+	j.update(func(j *Job) { j.Progress = p })
+}
+
+// Run runs the job against the graph until it finishes or the context is cancelled.
+func (j *Job) Run(ctx context.Context, g *graph.Graph) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	j.update(func(j *Job) {
+		j.State = Running
+		j.Started = time.Now()
+		j.cancel = cancel
+	})
+
+	err := j.run(ctx, g)
+	j.update(func(j *Job) {
+		j.Finished = time.Now()
+		j.cancel = nil
+
+		if err == nil {
+			j.State = Done
+		} else if ctx.Err() == context.Canceled {
+			j.State = Cancelled
+			j.Error = err.Error()
+		} else {
+			j.State = Failed
+			j.Error = err.Error()
+		}
+	})
+
+	if err != nil {
+		log.Printf("[INFO] analytics: job %s running %s failed: %v", j.ID, j.Spec.Algorithm, err)
+		return err
+	}
+
+	log.Printf("[INFO] analytics: job %s running %s over %d nodes took %v", j.ID, j.Spec.Algorithm, j.Nodes, j.Finished.Sub(j.Started))
+	return nil
+}
+
+func (j *Job) run(ctx context.Context, g *graph.Graph) error {
+	j.phase("load")
+	snap, err := Load(ctx, g.Store(), j.Spec.Selection, func(scanned int) {
+		j.update(func(j *Job) { j.Scanned = scanned })
+	})
+	if err != nil {
+		return err
+	}
+
+	j.update(func(j *Job) {
+		j.Nodes = snap.Len()
+		j.Edges = snap.Edges()
+	})
+
+	j.phase("compute")
+	vals := j.algorithm(ctx, snap, j.Spec.Options, j.progress)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if j.Spec.Property == "" {
+		results := make([]Result, len(vals))
+		for i, v := range vals {
+			results[i] = Result{Key: snap.Keys[i], Value: v}
+		}
+
+		j.update(func(j *Job) {
+			j.results = results
+			j.Progress = 1
+		})
+		return nil
+	}
+
+	j.phase("write")
+	return write(ctx, g, snap.Keys, vals, j.Spec.Property, j.progress)
+}
+
+// write sets the property of each node to its value. Nodes deleted since the snapshot was loaded are skipped.
+func write(ctx context.Context, g *graph.Graph, keys []string, vals []interface{}, prop string, progress func(float64)) error {
+	for start := 0; start < len(keys); start += writeBatch {
+		end := start + writeBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		b := g.Begin(ctx)
+		for i := start; i < end; i++ {
+			o, err := g.Store().Get(ctx, keys[i])
+			if err != nil {
+				return err
+			} else if o == nil {
+				continue
+			}
+
+			n := o.Node()
+			if n.Body == nil {
+				n.Body = map[string]interface{}{}
+			}
+			n.Body[prop] = vals[i]
+
+			if err := b.PutNode(n); err != nil {
+				return err
+			}
+		}
+
+		if err := b.Commit(); err != nil {
+			return err
+		}
+		progress(float64(end) / float64(len(keys)))
+	}
+	return g.Flush(ctx)
+}
+
+// Jobs runs jobs in the background, keeping them until they are removed.
+type Jobs struct {
+	g    *graph.Graph
+	jobs map[string]*Job
+	lock *sync.Mutex
+}
+
+// NewJobs returns an empty set of jobs running against the graph.
+func NewJobs(g *graph.Graph) *Jobs {
+	return &Jobs{g: g, jobs: map[string]*Job{}, lock: &sync.Mutex{}}
+}
+
+// Start starts a job for the spec in the background.
+func (js *Jobs) Start(spec Spec) (*Job, error) {
+	j, err := NewJob(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// the job can be cancelled as soon as it is returned, before it starts running.
+	ctx, cancel := context.WithCancel(context.Background())
+	j.update(func(j *Job) {
+		j.cancel = cancel
+	})
+
+	js.lock.Lock()
+	js.jobs[j.ID] = j
+	js.lock.Unlock()
+
+	go func() {
+		defer cancel()
+		j.Run(ctx, js.g)
+	}()
+	return j, nil
+}
+
+// Get returns the job with the id or nil.
+func (js *Jobs) Get(id string) *Job {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	return js.jobs[id]
+}
+
+// List returns every job, most recently started first.
+func (js *Jobs) List() []*Job {
+	js.lock.Lock()
+	list := []*Job{}
+	for _, j := range js.jobs {
+		list = append(list, j)
+	}
+	js.lock.Unlock()
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Status().Started.After(list[b].Status().Started)
+	})
+	return list
+}
+
+// Remove cancels the job if it is running and forgets it.
+func (js *Jobs) Remove(id string) *Job {
+	js.lock.Lock()
+	j := js.jobs[id]
+	delete(js.jobs, id)
+	js.lock.Unlock()
+
+	if j != nil {
+		j.Cancel()
+	}
+	return j
+}
@@ -0,0 +1,148 @@
+// Package analytics runs whole graph algorithms, such as PageRank and connected components, over a snapshot of the
+// nodes and edges of a store.
+package analytics
+
+import (
+	"context"
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
+	"sort"
+)
+
+// scanAll is used as the count for prefix scans which must not be truncated.
+const scanAll = 1<<31 - 1
+
+// Selection picks the subgraph an algorithm runs over. Empty lists select every node or edge type. Edges are only
+// included when both of their nodes are.
+type Selection struct {
+	NodeTypes []string `json:"node_types,omitempty"`
+	EdgeTypes []string `json:"edge_types,omitempty"`
+}
+
+// Snapshot is an in memory copy of the structure of a graph, without the bodies of the nodes and edges. Nodes are
+// numbered in key order and edges are held as adjacency lists in both directions.
+type Snapshot struct {
+	Keys []string
+	Out  [][]int
+	In   [][]int
+
+	index map[string]int
+}
+
+// Len returns the number of nodes.
+func (s *Snapshot) Len() int {
+	return len(s.Keys)
+}
+
+// Edges returns the number of edges.
+func (s *Snapshot) Edges() int {
+	n := 0
+	for _, out := range s.Out {
+		n += len(out)
+	}
+	return n
+}
+
+// newSnapshot returns a snapshot of the nodes with no edges.
+func newSnapshot(keys []string) *Snapshot {
+	sort.Strings(keys)
+
+	s := &Snapshot{
+		Keys:  keys,
+		Out:   make([][]int, len(keys)),
+		In:    make([][]int, len(keys)),
+		index: make(map[string]int, len(keys)),
+	}
+	for i, key := range keys {
+		s.index[key] = i
+	}
+	return s
+}
+
+// addEdge adds an edge between two nodes of the snapshot, returning false if either node is not in the snapshot.
+func (s *Snapshot) addEdge(source, target string) bool {
+	src, ok := s.index[source]
+	if !ok {
+		return false
+	}
+
+	dst, ok := s.index[target]
+	if !ok {
+		return false
+	}
+
+	s.Out[src] = append(s.Out[src], dst)
+	s.In[dst] = append(s.In[dst], src)
+	return true
+}
+
+// Load reads the selected nodes and edges from the store. Without node types the node keys are found by scanning
+// around the keys of edges, indexes and changes, with node types only the keys of those types are scanned. Progress
+// is called with the number of keys scanned so far.
+func Load(ctx context.Context, s store.Store, sel Selection, progress func(scanned int)) (*Snapshot, error) {
+	if progress == nil {
+		progress = func(int) {}
+	}
+
+	scanned := 0
+	scan := func(start, end string, each func(o *objects.Object)) error {
+		res, errc := s.Range(ctx, start, end, scanAll)
+		for o := range res {
+			each(o)
+
+			scanned++
+			if scanned%1000 == 0 {
+				progress(scanned)
+			}
+		}
+		return <-errc
+	}
+
+	// the keys starting 1 to 4 are edges, index entries and changes, node keys sort before and after them.
+	ranges := [][2]string{{"", objects.ForwardEdgeKey}, {after(objects.ChangeKey), ""}}
+	if len(sel.NodeTypes) > 0 {
+		ranges = [][2]string{}
+		for _, typ := range sel.NodeTypes {
+			prefix := typ + objects.NodeSep
+			ranges = append(ranges, [2]string{prefix, after(prefix)})
+		}
+	}
+
+	keys := []string{}
+	for _, r := range ranges {
+		err := scan(r[0], r[1], func(o *objects.Object) {
+			if o.IsNode() {
+				keys = append(keys, o.Key)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	snap := newSnapshot(keys)
+
+	types := map[string]bool{}
+	for _, typ := range sel.EdgeTypes {
+		types[typ] = true
+	}
+
+	err := scan(objects.ForwardEdgeKey, after(objects.ForwardEdgeKey), func(o *objects.Object) {
+		e := o.Edge()
+		if len(types) > 0 && !types[e.Type] {
+			return
+		}
+		snap.addEdge(e.Source, e.Target)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	progress(scanned)
+	return snap, nil
+}
+
+// after returns the first key after every key starting with the prefix, the end of a range scan over the prefix.
+func after(prefix string) string {
+	return prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+}
@@ -33,5 +33,10 @@ process.stdin.on('data', function (arg) {
         } catch (e) {
             console.warn('error processing input:', e)
         }
+    } else {
+        g.query(arg, function (err, res) {
+            console.log(err || res);
+            process.stdout.write("> ");
+        });
     }
 });
@@ -43,6 +43,62 @@ module.exports = function (request) {
             });
         }
 
+        batch(operations, cb) {
+            request({
+                method: 'POST',
+                url: this.endpoint+'/v1/batch',
+                json: {operations: operations}
+            }, function (err, _, res) {
+                cb && cb(err, res)
+            });
+        }
+
+        // query runs a query written in the text query language, eg: 'user(id: "1") -follows-> user'.
+        query(src, cb) {
+            request({
+                method: 'POST',
+                url: this.endpoint+'/v1/query',
+                body: src
+            }, function (err, _, res) {
+                cb && cb(err, res && JSON.parse(res))
+            });
+        }
+
+        // storeQuery stores a text query with $parameters under the name, params maps each parameter to its type.
+        storeQuery(name, src, params, cb) {
+            request({
+                method: 'PUT',
+                url: this.endpoint+'/v1/queries/'+name,
+                json: {query: src, params: params}
+            }, function (err, _, res) {
+                cb && cb(err, res)
+            });
+        }
+
+        // runQuery runs the query stored under the name with the values of its parameters.
+        runQuery(name, params, cb) {
+            request({
+                method: 'POST',
+                url: this.endpoint+'/v1/queries/'+name+'/run',
+                json: params
+            }, function (err, _, res) {
+                cb && cb(err, res)
+            });
+        }
+
+        // changes returns the changes to the graph after the sequence number since, waiting up to wait, eg: '30s',
+        // for the next change when there are none yet.
+        changes(since, wait, cb) {
+            request({
+                method: 'GET',
+                url: this.endpoint+'/v1/changes',
+                qs: {since: since, wait: wait},
+                json: true
+            }, function (err, _, res) {
+                cb && cb(err, res)
+            });
+        }
+
         traverse(t, cb) {
             request({
                 method: 'POST',
@@ -60,7 +116,7 @@ module.exports = function (request) {
         constructor() {
             this.limit = 2000;
             this.next = null;
-            this.filters = null;
+            this.filters = [];
             this.type = null;
             this.id = null;
         }
@@ -74,12 +130,28 @@ module.exports = function (request) {
             if (attr === 'id') {
                 this.id = val
             } else {
-                console.warn('attr ' + attr + ' is not supported.')
+                this.filters.push(attr + ' == ' + JSON.stringify(val));
             }
 
             return this;
         }
 
+        hasNot(attr) {
+            this.filters.push('not ' + attr + ' exists');
+            return this;
+        }
+
+        hasIn(attr) {
+            let values = Array.prototype.slice.call(arguments, 1);
+            this.filters.push(attr + ' in ' + JSON.stringify(values));
+            return this;
+        }
+
+        hasRange(attr, min, max) {
+            this.filters.push(attr + ' >= ' + JSON.stringify(min) + ' and ' + attr + ' < ' + JSON.stringify(max));
+            return this;
+        }
+
         out() {
             let args = Array.prototype.slice.call(arguments);
             return this.rel(0, null, 1000, args);
@@ -92,7 +164,7 @@ module.exports = function (request) {
 
         both() {
             let args = Array.prototype.slice.call(arguments);
-            return this.rel(1, null, 1000, args);
+            return this.rel(2, null, 1000, args);
         }
 
         outLimit(limit) {
@@ -107,7 +179,7 @@ module.exports = function (request) {
 
         bothLimit(limit) {
             let args = Array.prototype.slice.call(arguments);
-            return this.rel(1, null, args[0], args.slice(1));
+            return this.rel(2, null, args[0], args.slice(1));
         }
 
         outFilter(filter) {
@@ -122,11 +194,128 @@ module.exports = function (request) {
 
         bothFilter(filter) {
             let args = Array.prototype.slice.call(arguments);
-            return this.rel(1, args[0], null, args.slice(1));
+            return this.rel(2, args[0], null, args.slice(1));
+        }
+
+        // outExcept, inExcept and bothExcept follow the edges of any type except the ones given.
+        outExcept() {
+            let args = Array.prototype.slice.call(arguments);
+            return this.relExcept(0, args);
+        }
+
+        inExcept() {
+            let args = Array.prototype.slice.call(arguments);
+            return this.relExcept(1, args);
+        }
+
+        bothExcept() {
+            let args = Array.prototype.slice.call(arguments);
+            return this.relExcept(2, args);
+        }
+
+        relExcept(dir, relTypes) {
+            let target = this.rel(dir, null, 1000, []);
+            this.next.except_types = relTypes;
+            return target;
+        }
+
+        // outE, inE and bothE return the edges followed, call otherV on the result to continue to the nodes.
+        outE() {
+            let args = Array.prototype.slice.call(arguments);
+            return this.relEdges(0, args);
+        }
+
+        inE() {
+            let args = Array.prototype.slice.call(arguments);
+            return this.relEdges(1, args);
+        }
+
+        bothE() {
+            let args = Array.prototype.slice.call(arguments);
+            return this.relEdges(2, args);
+        }
+
+        relEdges(dir, relTypes) {
+            let target = this.rel(dir, null, 1000, relTypes);
+            this.next.edges = true;
+            return target;
+        }
+
+        otherV() {
+            this.next = {
+                target: new Traversal(),
+                other: true
+            };
+            return this.next.target;
+        }
+
+        // optionalWith attaches what the sub traversal finds from each node to the node as its matches.
+        optionalWith(sub) {
+            this.optional = (this.optional || []).concat([sub]);
+            return this;
+        }
+
+        coalesce() {
+            this.next = {
+                target: new Traversal(),
+                limit: 2000,
+                coalesce: Array.prototype.slice.call(arguments)
+            };
+            return this.next.target;
         }
 
         groupBy(x) {
-            this.filters.push('groupBy('+x+')');
+            this.group_by = x;
+            return this;
+        }
+
+        where(expr) {
+            this.filters.push(expr);
+            return this;
+        }
+
+        labelAs(label) {
+            this.as = label;
+            return this;
+        }
+
+        // selectLabels must be called on the root of the traversal.
+        selectLabels() {
+            this.select = Array.prototype.slice.call(arguments);
+            return this;
+        }
+
+        // orderBy and page must be called on the root of the traversal.
+        orderBy(by, desc) {
+            this.order = (this.order || []).concat([{by: by, desc: !!desc}]);
+            return this;
+        }
+
+        page(size, cursor) {
+            this.page_size = size;
+            this.cursor = cursor;
+            return this;
+        }
+
+        // aggregateBy must be called on the root of the traversal, eg: aggregateBy('group', 'n', {op: 'sum', property: 'likes'}).
+        aggregateBy(op, property, by) {
+            this.aggregate = {op: op, property: property, by: by};
+            return this;
+        }
+
+        // unionWith, intersectWith and exceptWith must be called on the root of the traversal.
+        unionWith(other) {
+            this.union = (this.union || []).concat([other]);
+            return this;
+        }
+
+        intersectWith(other) {
+            this.intersect = (this.intersect || []).concat([other]);
+            return this;
+        }
+
+        exceptWith(other) {
+            this.except = (this.except || []).concat([other]);
             return this;
         }
 
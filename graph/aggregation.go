@@ -0,0 +1,310 @@
+package graph
+
+import (
+	"context"
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
+)
+
+// Aggregation reduces the results of a traversal to a single value. Op is one of:
+//
+//	count           the number of results
+//	count_distinct  the number of distinct values of the property, or of distinct results without a property
+//	sum, mean       the sum or mean of the numeric values of the property
+//	min, max        the smallest or largest value of the property, in the order used by Order
+//	group           a map from the Json encoding of each value of the property to the aggregate By of the results
+//	                with the value, the number of results when By is not set
+//
+// The "id" property is the node ID. Results without the property are skipped, except by count and group which
+// groups them under "null". Group keys keep values of different types apart, the string "1" is keyed "\"1\"" and
+// the number 1 is keyed "1".
+type Aggregation struct {
+	Op       string       `json:"op"`
+	Property string       `json:"property,omitempty"`
+	By       *Aggregation `json:"by,omitempty"`
+}
+
+func (a *Aggregation) String() string {
+	s := a.Op
+	if a.Property != "" {
+		s += " " + a.Property
+	}
+	if a.By != nil {
+		s += " by " + a.By.String()
+	}
+	return s
+}
+
+// compile checks the aggregation is valid.
+func (a *Aggregation) compile() error {
+	if a.By != nil && a.Op != "group" {
+		return invalidf("only group aggregations can aggregate by another aggregation")
+	}
+
+	switch a.Op {
+	case "count", "count_distinct":
+	case "sum", "mean", "min", "max", "group":
+		if a.Property == "" {
+			return invalidf("aggregation %s must have a property", a.Op)
+		}
+	default:
+		return invalidf("unknown aggregation %s", a.Op)
+	}
+
+	if a.By != nil {
+		if a.By.Op == "group" {
+			return invalidf("group aggregations cannot be nested")
+		}
+		return a.By.compile()
+	}
+	return nil
+}
+
+// needsBody returns true when the aggregation reads a property of the body.
+func (a *Aggregation) needsBody() bool {
+	return (a.Property != "" && a.Property != "id") || (a.By != nil && a.By.needsBody())
+}
+
+// Sum aggregates the traversal to the sum of the property, see Aggregation. Aggregations apply to the whole
+// traversal and are run with Graph.Aggregate. With paths a node reached along several paths counts once per path.
+func (t *Traversal) Sum(property string) *Traversal {
+	return t.aggregateBy(&Aggregation{Op: "sum", Property: property})
+}
+
+// Min aggregates the traversal to the smallest value of the property.
+func (t *Traversal) Min(property string) *Traversal {
+	return t.aggregateBy(&Aggregation{Op: "min", Property: property})
+}
+
+// Max aggregates the traversal to the largest value of the property.
+func (t *Traversal) Max(property string) *Traversal {
+	return t.aggregateBy(&Aggregation{Op: "max", Property: property})
+}
+
+// Mean aggregates the traversal to the mean of the property.
+func (t *Traversal) Mean(property string) *Traversal {
+	return t.aggregateBy(&Aggregation{Op: "mean", Property: property})
+}
+
+// CountDistinct aggregates the traversal to the number of distinct values of the property, or of distinct results
+// when the property is empty.
+func (t *Traversal) CountDistinct(property string) *Traversal {
+	return t.aggregateBy(&Aggregation{Op: "count_distinct", Property: property})
+}
+
+// GroupCount aggregates the traversal to the number of results with each value of the property.
+func (t *Traversal) GroupCount(property string) *Traversal {
+	return t.aggregateBy(&Aggregation{Op: "group", Property: property})
+}
+
+// Group aggregates the traversal to a map from each value of the property to the results with the value, which are
+// counted unless By sets another aggregation.
+func (t *Traversal) Group(property string) *Traversal {
+	return t.aggregateBy(&Aggregation{Op: "group", Property: property})
+}
+
+// By sets the aggregation of each group of a Group, eg: Group("type").By("sum", "likes"). An invalid aggregation, or
+// By without a Group, is kept so running the traversal returns the error.
+func (t *Traversal) By(op, property string) *Traversal {
+	var root *Traversal
+	if t.root == nil {
+		root = t
+	} else {
+		root = t.root
+	}
+
+	if root.Aggregation == nil {
+		root.Aggregation = &Aggregation{}
+	}
+	root.Aggregation.By = &Aggregation{Op: op, Property: property}
+	return t
+}
+
+// aggregateBy sets the aggregation of the traversal, it is checked when the traversal is run.
+func (t *Traversal) aggregateBy(a *Aggregation) *Traversal {
+	if t.root == nil {
+		t.Aggregation = a
+	} else {
+		t.root.Aggregation = a
+	}
+	return t
+}
+
+// Result runs an aggregated traversal returning the aggregate, see Graph.Aggregate.
+func (t *Traversal) Result(ctx context.Context) (interface{}, error) {
+	var root *Traversal
+	if t.root == nil {
+		root = t
+	} else {
+		root = t.root
+	}
+	return t.G.Aggregate(ctx, root)
+}
+
+// Aggregate runs a traversal with an aggregation returning the aggregate. Counts are returned as an int, sums and
+// means as a float64, min and max as the value found and groups as a map[string]interface{}. Min, max and mean
+// are nil when no result has a value.
+func (g *Graph) Aggregate(ctx context.Context, t *Traversal) (interface{}, error) {
+	if t.Aggregation == nil {
+		return nil, invalidf("traversal has no aggregation")
+	}
+
+	_, p, err := g.run(ctx, t, false)
+	if err != nil {
+		return nil, err
+	}
+	return p.value, nil
+}
+
+// planAggregation adds the step reducing the results when the traversal has an aggregation.
+func planAggregation(p *Pipeline, g *Graph, t *Traversal) error {
+	if t.Aggregation == nil {
+		return nil
+	}
+
+	a := t.Aggregation
+	if err := a.compile(); err != nil {
+		return err
+	}
+
+	p.add(&StepInfo{Step: "aggregate", Filters: []string{a.String()}}, func(st *StepStats) Step {
+		return reduce(p, st, g.store, a)
+	})
+	return nil
+}
+
+// reduce returns the step aggregating every result, the aggregate is set on the pipeline and no results are sent
+// on.
+func reduce(p *Pipeline, st *StepStats, s store.Store, a *Aggregation) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+
+			total := newReducer(a)
+			groups := map[string]*reducer{}
+			for o := range in {
+				if a.needsBody() && o.Val == nil {
+					obj, err := p.get(st, s, o.Key)
+					if err != nil {
+						p.Fail(err)
+						continue
+					}
+
+					if obj != nil {
+						o.Val = obj.Val
+					}
+				}
+
+				if a.Op != "group" {
+					total.add(o)
+					continue
+				}
+
+				v, _ := property(o, a.Property)
+				key := literal(v)
+
+				r, ok := groups[key]
+				if !ok {
+					r = newReducer(a.By)
+					groups[key] = r
+				}
+				r.add(o)
+			}
+
+			if a.Op != "group" {
+				p.value = total.value()
+				return
+			}
+
+			res := map[string]interface{}{}
+			for key, r := range groups {
+				res[key] = r.value()
+			}
+			p.value = res
+		}()
+		return out
+	}
+}
+
+// property returns the value of a property of a result, "id" is the node ID.
+func property(o *objects.Object, prop string) (interface{}, bool) {
+	if prop == "id" && o.IsNode() {
+		return o.Node().ID, true
+	}
+	return lookup(o.Val, prop)
+}
+
+// reducer computes an aggregation other than group over the results added to it.
+type reducer struct {
+	agg      *Aggregation
+	count    int
+	sum      float64
+	nums     int
+	best     interface{}
+	distinct map[string]bool
+}
+
+// newReducer returns a reducer for the aggregation, counting the results when the aggregation is nil.
+func newReducer(a *Aggregation) *reducer {
+	if a == nil {
+		a = &Aggregation{Op: "count"}
+	}
+	return &reducer{agg: a, distinct: map[string]bool{}}
+}
+
+func (r *reducer) add(o *objects.Object) {
+	r.count++
+	if r.agg.Op == "count" {
+		return
+	}
+
+	if r.agg.Op == "count_distinct" && r.agg.Property == "" {
+		key := o.Key
+		if o.Path != nil {
+			key = o.PathKey()
+		}
+		r.distinct[key] = true
+		return
+	}
+
+	v, ok := property(o, r.agg.Property)
+	if !ok || v == nil {
+		return
+	}
+
+	switch r.agg.Op {
+	case "count_distinct":
+		r.distinct[literal(v)] = true
+	case "sum", "mean":
+		if f, ok := toFloat(v); ok {
+			r.sum += f
+			r.nums++
+		}
+	case "min":
+		if r.best == nil || compareAny(v, r.best) < 0 {
+			r.best = v
+		}
+	case "max":
+		if r.best == nil || compareAny(v, r.best) > 0 {
+			r.best = v
+		}
+	}
+}
+
+func (r *reducer) value() interface{} {
+	switch r.agg.Op {
+	case "count":
+		return r.count
+	case "count_distinct":
+		return len(r.distinct)
+	case "sum":
+		return r.sum
+	case "mean":
+		if r.nums == 0 {
+			return nil
+		}
+		return r.sum / float64(r.nums)
+	}
+	return r.best
+}
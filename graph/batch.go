@@ -0,0 +1,393 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
+	"sort"
+	"strings"
+)
+
+// Batch collects writes to the graph which are committed together. Index entries, unique constraints and the edges
+// of deleted nodes are all written as part of the same batch. Whether the commit is atomic depends on the store, see
+// store.Store.Begin.
+type Batch struct {
+	ctx     context.Context
+	g       *Graph
+	txn     store.Batch
+	pending map[string]*objects.Object
+	deleted map[string]bool
+	nodes   []string
+	changes []*Change
+}
+
+// Begin starts a new batch of writes. Reads made while building the batch and the commit use the context.
+func (g *Graph) Begin(ctx context.Context) *Batch {
+	return &Batch{
+		ctx:     ctx,
+		g:       g,
+		txn:     g.store.Begin(),
+		pending: map[string]*objects.Object{},
+		deleted: map[string]bool{},
+	}
+}
+
+func (b *Batch) put(objs ...*objects.Object) {
+	for _, o := range objs {
+		b.pending[o.Key] = o
+		delete(b.deleted, o.Key)
+	}
+	b.txn.Put(objs...)
+}
+
+func (b *Batch) del(objs ...*objects.Object) {
+	for _, o := range objs {
+		b.deleted[o.Key] = true
+		delete(b.pending, o.Key)
+	}
+	b.txn.Del(objs...)
+}
+
+// get returns an object as it will be once the batch is committed.
+func (b *Batch) get(key string) (*objects.Object, error) {
+	if b.deleted[key] {
+		return nil, nil
+	}
+
+	if o, ok := b.pending[key]; ok {
+		return o, nil
+	}
+
+	return b.g.store.Get(b.ctx, key)
+}
+
+func (b *Batch) PutNode(n *objects.Node) error {
+	if n.Type == "" {
+		return fmt.Errorf("node must have a type")
+	} else if n.ID == "" {
+		return fmt.Errorf("node must have an id")
+	} else if objects.Reserved(n.Type) {
+		return fmt.Errorf("node type %s starts with a reserved key prefix (1-4)", n.Type)
+	}
+
+	b.track("node", n.ResourceID(), n.Key(), n.Body, false)
+
+	b.put(&objects.Object{Key: n.Key(), Val: n.Body})
+	b.nodes = append(b.nodes, n.Key())
+	return nil
+}
+
+func (b *Batch) PutEdge(e *objects.Edge) error {
+	if e.Type == "" {
+		return fmt.Errorf("edge must have a type")
+	} else if e.Source == "" || e.Target == "" {
+		return fmt.Errorf("edge is invalid, source or target is null %s", e.ResourceID())
+	} else if objects.Reserved(e.Type) || objects.Reserved(e.Source) || objects.Reserved(e.Target) {
+		return fmt.Errorf("edge %s has a type or node type starting with a reserved key prefix (1-4)", e.ResourceID())
+	}
+
+	b.track("edge", e.ResourceID(), e.ForwardKey(), e.Body, false)
+
+	b.put(
+		&objects.Object{Key: e.ForwardKey(), Val: e.Body},
+		&objects.Object{Key: e.ReverseKey(), Val: e.Body},
+	)
+	return nil
+}
+
+// DelNode deletes the node, handling the edges of the node according to the mode.
+func (b *Batch) DelNode(n *objects.Node, mode DeleteMode) error {
+	edges, err := b.edgesOf(n, mode == Restrict)
+	if err != nil {
+		return err
+	}
+
+	if mode == Restrict && len(edges) > 0 {
+		return &HasEdgesError{Key: n.Key(), Edge: edges[0].ResourceID()}
+	}
+
+	del := []*objects.Object{{Key: n.Key()}}
+	b.nodes = append(b.nodes, n.Key())
+
+	b.track("node", n.ResourceID(), n.Key(), nil, true)
+
+	for _, e := range edges {
+		b.track("edge", e.ResourceID(), e.ForwardKey(), nil, true)
+		del = append(del, &objects.Object{Key: e.ForwardKey()}, &objects.Object{Key: e.ReverseKey()})
+	}
+
+	b.del(del...)
+	return nil
+}
+
+// edgesOf returns the edges into and out of a node as they will be once the batch is committed: the edges in the
+// store which the batch does not delete and the edges the batch puts. When first is set at least the first edge
+// found is returned. An edge from the node to itself is returned once.
+func (b *Batch) edgesOf(n *objects.Node, first bool) ([]*objects.Edge, error) {
+	// the first edge in the store may be deleted by the batch, hiding the edges after it.
+	stored, err := b.g.edgesOf(b.ctx, n, first && len(b.deleted) == 0)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for key := range b.pending {
+		if strings.HasPrefix(key, concat(objects.ForwardEdgeKey, n.Key(), objects.PathSep)) ||
+			strings.HasPrefix(key, concat(objects.ReverseEdgeKey, n.Key(), objects.PathSep)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	edges := []*objects.Edge{}
+	seen := map[string]bool{}
+	for _, e := range stored {
+		if !b.deleted[e.ForwardKey()] && !seen[e.ForwardKey()] {
+			seen[e.ForwardKey()] = true
+			edges = append(edges, e)
+		}
+	}
+
+	for _, key := range keys {
+		e := b.pending[key].Edge()
+		if !seen[e.ForwardKey()] {
+			seen[e.ForwardKey()] = true
+			edges = append(edges, e)
+		}
+	}
+	return edges, nil
+}
+
+func (b *Batch) DelEdge(e *objects.Edge) error {
+	b.track("edge", e.ResourceID(), e.ForwardKey(), nil, true)
+
+	b.del(
+		&objects.Object{Key: e.ForwardKey()},
+		&objects.Object{Key: e.ReverseKey()},
+	)
+	return nil
+}
+
+func (b *Batch) PutByResourceID(resourceID string, body map[string]interface{}) (*objects.Object, error) {
+	spl := strings.Split(resourceID, ":")
+	if len(spl) <= 1 {
+		return nil, fmt.Errorf("failed to parse %s", resourceID)
+	}
+
+	if spl[0] == "node" {
+		// Node resourceID: node:<type>_<id>
+		s := strings.Split(spl[1], objects.NodeSep)
+
+		var id string
+		if len(s) > 1 {
+			id = s[1]
+		} else if body["id"] != nil {
+			if asserted, ok := body["id"].(string); ok {
+				id = asserted
+			}
+		}
+
+		if id == "" {
+			id = objects.GenId()
+		}
+
+		n := &objects.Node{
+			Type: s[0],
+			ID:   id,
+			Body: body,
+		}
+		return n.Object(), b.PutNode(n)
+
+	} else if spl[0] == "edge" {
+		// Edge resourceID: edge:<type>.<source>.<target>
+		s := strings.Split(spl[1], ".")
+		if len(s) < 3 {
+			return nil, fmt.Errorf("failed to parse %s", resourceID)
+		}
+
+		e := &objects.Edge{
+			Source: s[1],
+			Target: s[2],
+			Type:   s[0],
+			Body:   body,
+		}
+
+		return e.Object(), b.PutEdge(e)
+	}
+
+	return nil, fmt.Errorf("failed to parse %s", resourceID)
+}
+
+func (b *Batch) DelByResourceID(resourceID string, mode DeleteMode) (*objects.Object, error) {
+	key, err := resourceKey(resourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := b.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if o == nil {
+		return nil, fmt.Errorf("%s not found", resourceID)
+	}
+
+	if o.IsNode() {
+		return o, b.DelNode(o.Node(), mode)
+	}
+	return o, b.DelEdge(o.Edge())
+}
+
+// Commit adds the index entries of the nodes written, checks their unique indexes and applies the batch, along with
+// its changes when the graph tracks changes.
+//
+// Commits writing indexed nodes are serialised, so the index entries are worked out from the bodies in the store
+// and the unique check cannot interleave with another write. This only holds within the process: indexes are only
+// kept consistent, and unique, while a single process writes the indexed node types.
+func (b *Batch) Commit() error {
+	if keys := b.indexed(); len(keys) > 0 {
+		b.g.unique.Lock()
+		defer b.g.unique.Unlock()
+
+		if err := b.index(keys); err != nil {
+			return err
+		}
+
+		if err := b.checkUnique(keys); err != nil {
+			return err
+		}
+	}
+
+	if f := b.g.tracking(); f != nil && len(b.changes) > 0 {
+		return f.commit(b)
+	}
+	return b.txn.Commit(b.ctx)
+}
+
+// indexed returns the keys of the nodes written by the batch whose types are indexed, each once.
+func (b *Batch) indexed() []string {
+	b.g.lock.RLock()
+	defer b.g.lock.RUnlock()
+
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, key := range b.nodes {
+		n := (&objects.Object{Key: key}).Node()
+		if !seen[key] && len(b.g.indexes[n.Type]) > 0 {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// index adds the index entries to put and delete for the nodes, from their bodies in the store to their bodies once
+// the batch is committed.
+func (b *Batch) index(keys []string) error {
+	for _, key := range keys {
+		old, err := b.g.store.Get(b.ctx, key)
+		if err != nil {
+			return err
+		}
+
+		n := (&objects.Object{Key: key}).Node()
+		if o := b.pending[key]; o != nil {
+			n.Body = o.Val
+		}
+
+		var body map[string]interface{}
+		if old != nil {
+			body = old.Val
+		}
+
+		put, del := b.g.indexDiff(n, body)
+		if len(put) > 0 {
+			b.put(put...)
+		}
+		if len(del) > 0 {
+			b.del(del...)
+		}
+	}
+	return nil
+}
+
+// checkUnique returns a *ConflictError if a node in the batch holds the value of a unique property which is held
+// by another node, either already in the store or in the batch.
+func (b *Batch) checkUnique(keys []string) error {
+	held := map[string]string{}
+	for _, key := range keys {
+		n := (&objects.Object{Key: key}).Node()
+		if !b.g.hasUnique(n.Type) {
+			continue
+		}
+
+		o, err := b.get(n.Key())
+		if err != nil {
+			return err
+		}
+
+		if o == nil || o.Val == nil {
+			continue
+		}
+
+		b.g.lock.RLock()
+		idxs := b.g.indexes[n.Type]
+		b.g.lock.RUnlock()
+
+		for _, idx := range idxs {
+			if !idx.Unique {
+				continue
+			}
+
+			val, ok := lookup(o.Val, idx.Property)
+			if !ok {
+				continue
+			}
+
+			prefix := idx.valuePrefix(val)
+			if holder := held[prefix]; holder != "" && holder != n.Key() {
+				return &ConflictError{Index: idx.String(), Value: val, Key: n.Key(), Existing: holder}
+			}
+			held[prefix] = n.Key()
+
+			entries, errc := b.g.store.Prefix(b.ctx, prefix, 2)
+
+			var conflict *ConflictError
+			for e := range entries {
+				existing := idx.nodeKey(e)
+				if existing == n.Key() || b.deleted[e.Key] || conflict != nil {
+					continue
+				}
+				conflict = &ConflictError{Index: idx.String(), Value: val, Key: n.Key(), Existing: existing}
+			}
+
+			if err := <-errc; err != nil {
+				return err
+			}
+
+			if conflict != nil {
+				return conflict
+			}
+		}
+	}
+	return nil
+}
+
+// resourceKey returns the store key of a resource ID.
+func resourceKey(resourceID string) (string, error) {
+	spl := strings.Split(resourceID, ":")
+	if len(spl) > 1 && spl[0] == "node" {
+		// Node resourceID: node:<type>_<id>
+		return spl[1], nil
+	} else if len(spl) > 1 && spl[0] == "edge" {
+		// Edge resourceID: edge:<type>.<source>.<target>
+		s := strings.Split(spl[1], ".")
+		if len(s) >= 3 {
+			return concat(objects.ForwardEdgeKey, s[1], objects.PathSep, s[0], objects.PathSep, s[2]), nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to parse %s", resourceID)
+}
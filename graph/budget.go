@@ -0,0 +1,139 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"strings"
+	"time"
+)
+
+// Budget limits the resources a single traversal may use. A zero value for a limit means the limit is not set.
+//
+// Timeout limits the wall clock time of the traversal, MaxScanned the total number of keys read from the store and
+// MaxFrontier the number of distinct nodes reached at any step of the traversal.
+type Budget struct {
+	Timeout     time.Duration `json:"-"`
+	MaxScanned  int64         `json:"max_scanned,omitempty"`
+	MaxFrontier int64         `json:"max_frontier,omitempty"`
+}
+
+// budgetJSON is the wire format of a budget, the timeout is written as a duration string, eg: "1.5s".
+type budgetJSON struct {
+	Timeout     string `json:"timeout,omitempty"`
+	MaxScanned  int64  `json:"max_scanned,omitempty"`
+	MaxFrontier int64  `json:"max_frontier,omitempty"`
+}
+
+func (b Budget) MarshalJSON() ([]byte, error) {
+	v := budgetJSON{MaxScanned: b.MaxScanned, MaxFrontier: b.MaxFrontier}
+	if b.Timeout > 0 {
+		v.Timeout = b.Timeout.String()
+	}
+	return json.Marshal(v)
+}
+
+func (b *Budget) UnmarshalJSON(data []byte) error {
+	v := budgetJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	b.Timeout = 0
+	if v.Timeout != "" {
+		d, err := time.ParseDuration(v.Timeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse budget timeout %s", v.Timeout)
+		}
+		b.Timeout = d
+	}
+
+	b.MaxScanned = v.MaxScanned
+	b.MaxFrontier = v.MaxFrontier
+	return nil
+}
+
+// Cap returns the budget with every limit lowered to the limit in max. Limits which are not set take the limit in
+// max.
+func (b Budget) Cap(max Budget) Budget {
+	return Budget{
+		Timeout:     time.Duration(capLimit(int64(b.Timeout), int64(max.Timeout))),
+		MaxScanned:  capLimit(b.MaxScanned, max.MaxScanned),
+		MaxFrontier: capLimit(b.MaxFrontier, max.MaxFrontier),
+	}
+}
+
+func capLimit(v, max int64) int64 {
+	if max > 0 && (v <= 0 || v > max) {
+		return max
+	}
+	return v
+}
+
+// BudgetError is returned when a traversal exceeds one of the limits of its budget.
+type BudgetError struct {
+	Limit string `json:"limit"`
+	Max   string `json:"max"`
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("budget exceeded: %s limit of %s", e.Limit, e.Max)
+}
+
+// frontier returns a step counting the distinct nodes at a step of the traversal against the budget.
+func frontier(p *Pipeline) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		max := p.budget.MaxFrontier
+		if max <= 0 {
+			return in
+		}
+
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+			// with paths a node reached along several paths is sent once per path but counts once.
+			seen := map[string]bool{}
+			for o := range in {
+				seen[o.Key] = true
+				if int64(len(seen)) > max {
+					p.Fail(&BudgetError{Limit: "frontier", Max: fmt.Sprint(max)})
+					continue
+				}
+
+				out <- o
+			}
+		}()
+		return out
+	}
+}
+
+// frontierFrom returns a step counting the distinct nodes the edges followed by the hop were followed from against
+// the budget, the frontier of a level whose nodes are never loaded.
+func frontierFrom(p *Pipeline, tp *TraversalPath) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		max := p.budget.MaxFrontier
+		if max <= 0 {
+			return in
+		}
+
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+			seen := map[string]bool{}
+			for o := range in {
+				// edge keys start with the key of the node they are followed from, see edgePrefixes.
+				if i := strings.Index(o.Key, objects.PathSep); i > 0 && o.IsEdge() && follows(tp, o.Edge()) {
+					seen[o.Key[1:i]] = true
+				}
+
+				if int64(len(seen)) > max {
+					p.Fail(&BudgetError{Limit: "frontier", Max: fmt.Sprint(max)})
+					continue
+				}
+
+				out <- o
+			}
+		}()
+		return out
+	}
+}
@@ -0,0 +1,51 @@
+package graph
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBudget_Cap(t *testing.T) {
+	max := Budget{Timeout: time.Second, MaxScanned: 100}
+
+	cases := []struct {
+		in, exp Budget
+	}{
+		{Budget{}, Budget{Timeout: time.Second, MaxScanned: 100}},
+		{Budget{Timeout: time.Minute, MaxScanned: 10}, Budget{Timeout: time.Second, MaxScanned: 10}},
+		{Budget{MaxFrontier: 5}, Budget{Timeout: time.Second, MaxScanned: 100, MaxFrontier: 5}},
+	}
+
+	for _, c := range cases {
+		if got := c.in.Cap(max); got != c.exp {
+			t.Errorf("%+v capped: expected %+v got %+v", c.in, c.exp, got)
+		}
+	}
+}
+
+func TestBudget_JSON(t *testing.T) {
+	b := Budget{Timeout: 1500 * time.Millisecond, MaxFrontier: 10}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != `{"timeout":"1.5s","max_frontier":10}` {
+		t.Fatalf("unexpected json %s", data)
+	}
+
+	got := Budget{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got != b {
+		t.Fatalf("expected %+v got %+v", b, got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"timeout": "soon"}`), &got); err == nil {
+		t.Fatal("expected an error parsing the timeout")
+	}
+}
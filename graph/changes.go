@@ -0,0 +1,274 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"log"
+	"sync"
+	"time"
+)
+
+// changesPage is the number of changes read from the store at a time by a subscription.
+const changesPage = 1000
+
+// Change is an event of the change feed of the graph, see TrackChanges. Changes are numbered by Seq in the order
+// they were committed, starting at 1, and each change of a batch has the time of the commit. Op is "create",
+// "update" or "delete" and Type is "node" or "edge". Old is the body before the write and New the body after it.
+type Change struct {
+	Seq        int64                  `json:"seq"`
+	Op         string                 `json:"op"`
+	Type       string                 `json:"type"`
+	ResourceID string                 `json:"resource_id"`
+	Old        map[string]interface{} `json:"old,omitempty"`
+	New        map[string]interface{} `json:"new,omitempty"`
+	Time       time.Time              `json:"time"`
+
+	key string
+	del bool
+}
+
+// changeFeed numbers the changes of committed batches and wakes those waiting for new changes.
+type changeFeed struct {
+	lock   *sync.Mutex
+	seq    int64
+	notify chan struct{}
+}
+
+// TrackChanges starts the change feed of the graph. Every put or delete of a node or edge committed afterwards adds a
+// Change to the feed, deleting a node also adds a change for each of its edges. The changes are written to the store
+// with the batch, under keys starting with 4, so numbering carries on from the last change after a restart.
+//
+// Tracking changes reads the old body of everything written and serialises the commits of batches. Sequence numbers
+// are handed out by the graph, so only a single process may write to a store whose changes are tracked. The feed is
+// only complete with a store committing batches atomically, such as bolt: a Bigtable commit which fails part way may
+// leave some of its changes written, so consumers can find gaps in the sequence numbers.
+func (g *Graph) TrackChanges(ctx context.Context) error {
+	head, err := g.store.Get(ctx, objects.ChangeKey)
+	if err != nil {
+		return err
+	}
+
+	var seq float64
+	if head != nil {
+		seq, _ = toFloat(head.Val["seq"])
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.changes == nil {
+		g.changes = &changeFeed{lock: &sync.Mutex{}, seq: int64(seq), notify: make(chan struct{})}
+		log.Printf("[INFO] graph: tracking changes from %d", int64(seq))
+	}
+	return nil
+}
+
+// tracking returns the change feed of the graph, or nil when the graph does not track changes.
+func (g *Graph) tracking() *changeFeed {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.changes
+}
+
+// Changes returns up to count changes after the sequence number since, in order.
+func (g *Graph) Changes(ctx context.Context, since int64, count int) ([]*Change, error) {
+	res, errc := g.store.Range(ctx, changeKey(since+1), after(objects.ChangeKey), count)
+
+	list := []*Change{}
+	var derr error
+	for o := range res {
+		c := &Change{}
+		if err := fromBody(o.Val, c); err != nil && derr == nil {
+			derr = fmt.Errorf("change %s: %v", o.Key, err)
+		}
+		list = append(list, c)
+	}
+
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	if derr != nil {
+		return nil, derr
+	}
+	return list, nil
+}
+
+// Poll returns up to count changes after the sequence number since like Changes, waiting for the next commit when
+// there are none yet. No changes are returned once the context is done.
+func (g *Graph) Poll(ctx context.Context, since int64, count int) ([]*Change, error) {
+	for {
+		f := g.tracking()
+		if f == nil {
+			return nil, fmt.Errorf("the graph does not track changes")
+		}
+
+		notify := f.wait()
+
+		list, err := g.Changes(ctx, since, count)
+		if ctx.Err() != nil {
+			return []*Change{}, nil
+		}
+
+		if err != nil || len(list) > 0 {
+			return list, err
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return []*Change{}, nil
+		}
+	}
+}
+
+// Subscribe sends the changes after the sequence number since in order, first those kept in the store and then each
+// new change once it is committed. Both channels are closed once the context is cancelled, or after sending the
+// error when reading the changes fails.
+func (g *Graph) Subscribe(ctx context.Context, since int64) (<-chan *Change, <-chan error) {
+	out := make(chan *Change)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+
+		for {
+			list, err := g.Poll(ctx, since, changesPage)
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			for _, c := range list {
+				select {
+				case out <- c:
+					since = c.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return out, errc
+}
+
+// wait returns a channel which is closed once the next batch with changes is committed.
+func (f *changeFeed) wait() <-chan struct{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.notify
+}
+
+// commit numbers the changes of the batch and commits them along with the batch. Commits are serialised so the
+// changes are numbered in the order they are committed, and the old bodies are read under the lock so no other
+// commit writes them in between. Deleting what does not exist is not a change.
+func (f *changeFeed) commit(b *Batch) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// the bodies as they are before each change, starting from the store and following the writes of the batch.
+	bodies := map[string]*objects.Object{}
+
+	seq := f.seq
+	now := time.Now().UTC()
+	for _, c := range b.changes {
+		old, ok := bodies[c.key]
+		if !ok {
+			o, err := b.g.store.Get(b.ctx, c.key)
+			if err != nil {
+				return err
+			}
+			old = o
+		}
+
+		bodies[c.key] = nil
+		if !c.del {
+			bodies[c.key] = &objects.Object{Key: c.key, Val: c.New}
+		}
+
+		switch {
+		case c.del && old == nil:
+			continue
+		case c.del:
+			c.Op = "delete"
+			c.Old = old.Val
+		case old == nil:
+			c.Op = "create"
+		default:
+			c.Op = "update"
+			c.Old = old.Val
+		}
+
+		seq++
+		c.Seq = seq
+		c.Time = now
+
+		val, err := toBody(c)
+		if err != nil {
+			return err
+		}
+		b.txn.Put(&objects.Object{Key: changeKey(seq), Val: val})
+	}
+	if seq == f.seq {
+		return b.txn.Commit(b.ctx)
+	}
+	b.txn.Put(&objects.Object{Key: objects.ChangeKey, Val: map[string]interface{}{"seq": seq}})
+
+	if err := b.txn.Commit(b.ctx); err != nil {
+		return err
+	}
+
+	f.seq = seq
+	close(f.notify)
+	f.notify = make(chan struct{})
+	return nil
+}
+
+// track records the change made by writing the body under the key, or deleting it, when the graph tracks changes.
+// The change is completed with the old body when the batch is committed.
+func (b *Batch) track(typ, resourceID, key string, body map[string]interface{}, del bool) {
+	if b.g.tracking() == nil {
+		return
+	}
+
+	c := &Change{Type: typ, ResourceID: resourceID, key: key, del: del}
+	if !del {
+		c.New = body
+	}
+	b.changes = append(b.changes, c)
+}
+
+// changeKey returns the key of the change with the sequence number, padded so changes sort in order.
+func changeKey(seq int64) string {
+	return fmt.Sprintf("%s%020d", objects.ChangeKey, seq)
+}
+
+// toBody returns the value as a body to store, by way of its JSON encoding.
+func toBody(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// fromBody decodes a body written by toBody into v.
+func fromBody(body map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
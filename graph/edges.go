@@ -0,0 +1,55 @@
+package graph
+
+import (
+	"github.com/coldog/go-graph/objects"
+)
+
+// OutE follows the outgoing edges of the types like Out but returns the edges with their bodies rather than the
+// nodes they lead to. Where, Has and the other filters of the returned step apply to the edge bodies, use OtherV to
+// continue to the nodes at the other end of the edges:
+//
+//	g.Traversal().Is("user").Has("id", "1").OutE("likes").Where("at > 1500000000").OtherV()
+func (t *Traversal) OutE(relTypes ...string) *Traversal {
+	return t.edges(objects.Out, relTypes)
+}
+
+// InE follows the incoming edges of the types returning the edges, see OutE.
+func (t *Traversal) InE(relTypes ...string) *Traversal {
+	return t.edges(objects.In, relTypes)
+}
+
+// BothE follows the edges of the types in both directions returning the edges, see OutE. An edge between two nodes
+// at this step is returned once from each end.
+func (t *Traversal) BothE(relTypes ...string) *Traversal {
+	return t.edges(objects.Both, relTypes)
+}
+
+func (t *Traversal) edges(dir objects.Direction, relTypes []string) *Traversal {
+	next := t.rel(dir, nil, relTypes)
+	t.Next.Edges = true
+	next.via = t.Next
+	return next
+}
+
+// OtherV continues from the edges at this step to the node at the other end of each edge, the target of an edge
+// followed out and the source of an edge followed in.
+func (t *Traversal) OtherV() *Traversal {
+	if t.via == nil || !t.via.Edges {
+		panic("other v must follow out e, in e or both e")
+	}
+
+	t.Next = &TraversalPath{
+		Target: &Traversal{LimitBy: 2000, G: t.G, root: t.top()},
+		Other:  true,
+	}
+	return t.Next.Target
+}
+
+// returnsEdges returns true when the last step of the traversal holds edges.
+func (t *Traversal) returnsEdges() bool {
+	edges := false
+	for l := t; l.Next != nil; l = l.Next.Target {
+		edges = l.Next.Edges
+	}
+	return edges
+}
@@ -1,159 +1,179 @@
 package graph
 
 import (
+	"context"
 	"fmt"
 	"github.com/coldog/go-graph/objects"
 	"github.com/coldog/go-graph/store"
 	"log"
-	"strings"
+	"sync"
 	"time"
 )
 
 func New(s store.Store) *Graph {
 	g := &Graph{
-		pipe:  &Pipeline{},
-		store: s,
+		store:   s,
+		indexes: map[string][]*Index{},
+		lock:    &sync.RWMutex{},
+		unique:  &sync.Mutex{},
 	}
 	return g
 }
 
 type Graph struct {
-	pipe  *Pipeline
-	store store.Store
-	T     *Traversal
+	store   store.Store
+	T       *Traversal
+	indexes map[string][]*Index
+	lock    *sync.RWMutex
+	unique  *sync.Mutex
+	budget  Budget
+	changes *changeFeed
 }
 
-func (g *Graph) PutByResourceID(resourceID string, body map[string]interface{}) (*objects.Object, error) {
-	spl := strings.Split(resourceID, ":")
-	if len(spl) <= 1 {
-		return nil, fmt.Errorf("failed to parse %s", resourceID)
-	}
-
-	if spl[0] == "node" {
-		// Node resourceID: node:<type>_<id>
-		s := strings.Split(spl[1], objects.NodeSep)
+// Store returns the store the graph is kept in.
+func (g *Graph) Store() store.Store {
+	return g.store
+}
 
-		var id string
-		if len(s) > 1 {
-			id = s[1]
-		} else if body["id"] != nil {
-			if asserted, ok := body["id"].(string); ok {
-				id = asserted
-			}
-		}
+// SetBudget sets the maximum budget of every traversal run on the graph. Traversals may ask for a lower budget.
+func (g *Graph) SetBudget(max Budget) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.budget = max
+}
 
-		if id == "" {
-			id = objects.GenId()
-		}
+func (g *Graph) PutByResourceID(ctx context.Context, resourceID string, body map[string]interface{}) (*objects.Object, error) {
+	b := g.Begin(ctx)
+	o, err := b.PutByResourceID(resourceID, body)
+	if err != nil {
+		return nil, err
+	}
+	return o, b.Commit()
+}
 
-		n := &objects.Node{
-			Type: s[0],
-			ID:   id,
-			Body: body,
-		}
-		return n.Object(), g.PutNode(n)
+func (g *Graph) GetByResourceID(ctx context.Context, resourceID string) (*objects.Object, error) {
+	key, err := resourceKey(resourceID)
+	if err != nil {
+		return nil, err
+	}
+	return g.store.Get(ctx, key)
+}
 
-	} else if spl[0] == "edge" {
-		// Edge resourceID: edge:<type>.<source>.<target>
-		s := strings.Split(spl[1], ".")
-		if len(s) < 3 {
-			return nil, fmt.Errorf("failed to parse %s", resourceID)
-		}
+// DeleteMode controls what happens to the edges of a node when it is deleted.
+type DeleteMode int
 
-		e := &objects.Edge{
-			Source: s[1],
-			Target: s[2],
-			Type:   s[0],
-			Body:   body,
-		}
+const (
+	// Cascade deletes every edge into or out of the node along with the node.
+	Cascade DeleteMode = iota
 
-		return e.Object(), g.PutEdge(e)
-	}
+	// Restrict refuses to delete a node which still has edges, returning a *HasEdgesError.
+	Restrict
+)
 
-	return nil, fmt.Errorf("failed to parse %s", resourceID)
+// HasEdgesError is returned when deleting a node which still has edges with the Restrict mode.
+type HasEdgesError struct {
+	Key  string `json:"key"`
+	Edge string `json:"edge"`
 }
 
-func (g *Graph) GetByResourceID(resourceID string) (*objects.Object, error) {
-	spl := strings.Split(resourceID, ":")
-	if spl[0] == "node" {
-		// Node resourceID: node:<type>_<id>
-		return g.store.Get(spl[1])
-	} else if spl[0] == "edge" {
-		// Edge resourceID: edge:<type>.<source>.<target>
-		s := strings.Split(spl[1], ".")
-		return g.store.Get(concat(objects.ForwardEdgeKey, s[1], objects.PathSep, s[0], objects.PathSep, s[2]))
-	}
-
-	return nil, fmt.Errorf("failed to parse %s", resourceID)
+func (e *HasEdgesError) Error() string {
+	return fmt.Sprintf("node %s still has edges, eg: %s", e.Key, e.Edge)
 }
 
-func (g *Graph) DelByResourceID(resourceID string) (*objects.Object, error) {
-	o, err := g.GetByResourceID(resourceID)
+func (g *Graph) DelByResourceID(ctx context.Context, resourceID string, mode DeleteMode) (*objects.Object, error) {
+	b := g.Begin(ctx)
+	o, err := b.DelByResourceID(resourceID, mode)
 	if err != nil {
 		return nil, err
 	}
-
-	return o, g.store.Del(o)
+	return o, b.Commit()
 }
 
-func (g *Graph) GetBody(key string) (map[string]interface{}, error) {
-	o, err := g.store.Get(key)
-	if err != nil {
+// GetBody returns the body stored under the key, or nil if there is no object stored under the key.
+func (g *Graph) GetBody(ctx context.Context, key string) (map[string]interface{}, error) {
+	o, err := g.store.Get(ctx, key)
+	if err != nil || o == nil {
 		return nil, err
 	}
 
 	return o.Val, nil
 }
 
-func (g *Graph) CreateNode(t string, body map[string]interface{}) (*objects.Node, error) {
+func (g *Graph) CreateNode(ctx context.Context, t string, body map[string]interface{}) (*objects.Node, error) {
 	n := objects.NewNode(t)
 	n.Body = body
-	err := g.PutNode(n)
+	err := g.PutNode(ctx, n)
 	return n, err
 }
 
-func (g *Graph) CreateEdge(t, source, target string, body map[string]interface{}) (*objects.Edge, error) {
+func (g *Graph) CreateEdge(ctx context.Context, t, source, target string, body map[string]interface{}) (*objects.Edge, error) {
 	e := objects.NewEdge(t, source, target)
 	e.Body = body
-	err := g.PutEdge(e)
+	err := g.PutEdge(ctx, e)
 	return e, err
 }
 
-func (g *Graph) PutNode(n *objects.Node) error {
-	if n.Type == "" {
-		return fmt.Errorf("node must have a type")
-	} else if n.ID == "" {
-		return fmt.Errorf("node must have an id")
+func (g *Graph) PutNode(ctx context.Context, n *objects.Node) error {
+	b := g.Begin(ctx)
+	if err := b.PutNode(n); err != nil {
+		return err
 	}
-
-	return g.store.Put(&objects.Object{
-		Key: n.Key(),
-		Val: n.Body,
-	})
+	return b.Commit()
 }
 
-func (g *Graph) PutEdge(e *objects.Edge) error {
-	if e.Type == "" {
-		return fmt.Errorf("edge must have a type")
-	} else if e.Source == "" || e.Target == "" {
-		return fmt.Errorf("edge is invalid, source or target is null %s", e.ResourceID())
+func (g *Graph) PutEdge(ctx context.Context, e *objects.Edge) error {
+	b := g.Begin(ctx)
+	if err := b.PutEdge(e); err != nil {
+		return err
 	}
+	return b.Commit()
+}
 
-	return g.store.Put(
-		&objects.Object{e.ForwardKey(), e.Body},
-		&objects.Object{e.ReverseKey(), e.Body},
-	)
+// DelNode deletes the node along with all of the edges into or out of it.
+func (g *Graph) DelNode(ctx context.Context, n *objects.Node) error {
+	return g.DelNodeMode(ctx, n, Cascade)
 }
 
-func (g *Graph) DelNode(n *objects.Node) error {
-	return g.store.Del(&objects.Object{n.Key(), nil})
+// DelNodeMode deletes the node, handling the edges of the node according to the mode.
+func (g *Graph) DelNodeMode(ctx context.Context, n *objects.Node, mode DeleteMode) error {
+	b := g.Begin(ctx)
+	if err := b.DelNode(n, mode); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// edgesOf returns the edges into and out of a node. When first is set only the first edge found is returned.
+func (g *Graph) edgesOf(ctx context.Context, n *objects.Node, first bool) ([]*objects.Edge, error) {
+	count := scanAll
+	if first {
+		count = 1
+	}
+
+	edges := []*objects.Edge{}
+	for _, prefix := range []string{objects.ForwardEdgeKey, objects.ReverseEdgeKey} {
+		res, errc := g.store.Prefix(ctx, concat(prefix, n.Key(), objects.PathSep), count)
+		for o := range res {
+			edges = append(edges, o.Edge())
+		}
+
+		if err := <-errc; err != nil {
+			return nil, err
+		}
+
+		if first && len(edges) > 0 {
+			break
+		}
+	}
+	return edges, nil
 }
 
-func (g *Graph) DelEdge(e *objects.Edge) error {
-	return g.store.Del(
-		&objects.Object{e.ForwardKey(), nil},
-		&objects.Object{e.ReverseKey(), nil},
-	)
+func (g *Graph) DelEdge(ctx context.Context, e *objects.Edge) error {
+	b := g.Begin(ctx)
+	if err := b.DelEdge(e); err != nil {
+		return err
+	}
+	return b.Commit()
 }
 
 func (g *Graph) Traversal() *Traversal {
@@ -163,15 +183,103 @@ func (g *Graph) Traversal() *Traversal {
 	}
 }
 
-func (g *Graph) Flush() {
-	g.store.Flush()
+func (g *Graph) Flush(ctx context.Context) error {
+	return g.store.Flush(ctx)
+}
+
+// Run runs the traversal, returning the objects found. The traversal stops early returning an error when the
+// context is cancelled or the store fails.
+//
+// The traversal is limited by the budget of the traversal capped by the budget of the graph, a *BudgetError is
+// returned when a limit is exceeded.
+func (g *Graph) Run(ctx context.Context, t *Traversal) ([]*objects.Object, error) {
+	res, _, err := g.run(ctx, t, false)
+	return res, err
+}
+
+// Explain returns the steps which would run the traversal without running it.
+func (g *Graph) Explain(t *Traversal) ([]*StepInfo, error) {
+	p := newPipeline(context.Background(), g.budgetFor(t))
+	p.paths = pathsFor(t)
+	defer p.cancel()
+
+	if err := plan(p, g, t); err != nil {
+		return nil, err
+	}
+	return p.Explain(), nil
+}
+
+// Profile runs the traversal like Run, also returning the counters of every step. The profile is returned when the
+// traversal fails as long as the traversal could be planned.
+func (g *Graph) Profile(ctx context.Context, t *Traversal) ([]*objects.Object, []*StepProfile, error) {
+	res, p, err := g.run(ctx, t, true)
+	if p == nil {
+		return nil, nil, err
+	}
+	return res, p.Profile(), err
 }
 
-func (g *Graph) Run(t *Traversal) []*objects.Object {
+// budgetFor returns the budget of a traversal capped by the budget of the graph.
+func (g *Graph) budgetFor(t *Traversal) Budget {
+	g.lock.RLock()
+	budget := g.budget
+	g.lock.RUnlock()
+
+	if t.Budget != nil {
+		budget = t.Budget.Cap(budget)
+	}
+	return budget
+}
+
+func (g *Graph) run(ctx context.Context, t *Traversal, profile bool) ([]*objects.Object, *Pipeline, error) {
+	res := []*objects.Object{}
+	p, err := g.each(ctx, t, profile, func(o *objects.Object) error {
+		res = append(res, o)
+		return nil
+	})
+	if err != nil {
+		return nil, p, err
+	}
+	return res, p, nil
+}
+
+// each runs the traversal calling f with each result, returning the pipeline once it has finished. The pipeline is
+// nil when the traversal could not be planned.
+func (g *Graph) each(ctx context.Context, t *Traversal, profile bool, f func(o *objects.Object) error) (*Pipeline, error) {
+	budget := g.budgetFor(t)
+
+	parent := ctx
+	if budget.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget.Timeout)
+		defer cancel()
+	}
+
 	t1 := time.Now()
-	p := &Pipeline{}
-	res := traverse(p, g.store, t)
+	p := newPipeline(ctx, budget)
+	p.profile = profile
+	p.paths = pathsFor(t)
+
+	if err := plan(p, g, t); err != nil {
+		p.cancel()
+		return nil, err
+	}
+
+	count := 0
+	err := p.Each(func(o *objects.Object) error {
+		count++
+		return f(o)
+	})
 	t2 := time.Now()
-	log.Printf("[INFO] graph: traversal with %d steps took %v returning %d nodes", len(p.steps), t2.Sub(t1), len(res))
-	return res
+	if err == context.DeadlineExceeded && parent.Err() == nil {
+		err = &BudgetError{Limit: "timeout", Max: budget.Timeout.String()}
+	}
+
+	if err != nil {
+		log.Printf("[INFO] graph: traversal with %d steps failed after %v: %v", len(p.steps), t2.Sub(t1), err)
+		return p, err
+	}
+
+	log.Printf("[INFO] graph: traversal with %d steps took %v returning %d nodes", len(p.steps), t2.Sub(t1), count)
+	return p, nil
 }
@@ -0,0 +1,292 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"log"
+	"strings"
+)
+
+// scanAll is used as the count for prefix scans which must not be truncated.
+const scanAll = 1<<31 - 1
+
+// Index is a secondary index on a property of the nodes of a type. Index entries are stored as keys in the same
+// store as the graph under the reserved index prefix:
+//
+//	3<type>/<property>/<json value>/<node key>
+//
+// Only scalar values are indexed.
+type Index struct {
+	NodeType string `json:"type"`
+	Property string `json:"property"`
+	Unique   bool   `json:"unique"`
+}
+
+// ConflictError is returned when a write would give a node the same value for a uniquely indexed property as
+// another node.
+type ConflictError struct {
+	Index    string      `json:"index"`
+	Value    interface{} `json:"value"`
+	Key      string      `json:"key"`
+	Existing string      `json:"existing"`
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("unique index %s: %s already holds %s, cannot write %s", e.Index, e.Existing, literal(e.Value), e.Key)
+}
+
+// ParseIndex parses an index declaration in the form <type>.<property>, eg: "user.email".
+func ParseIndex(spec string) (*Index, error) {
+	spl := strings.SplitN(spec, ".", 2)
+	if len(spl) != 2 || spl[0] == "" || spl[1] == "" {
+		return nil, fmt.Errorf("failed to parse index %s", spec)
+	}
+
+	return &Index{NodeType: spl[0], Property: spl[1]}, nil
+}
+
+func (i *Index) String() string {
+	return i.NodeType + "." + i.Property
+}
+
+// marker returns the key recording that the entries of the index were built, which sorts just before its entries.
+func (i *Index) marker() string {
+	return concat(objects.IndexKey, i.NodeType, objects.PathSep, i.Property)
+}
+
+func (i *Index) prefix() string {
+	return concat(objects.IndexKey, i.NodeType, objects.PathSep, i.Property, objects.PathSep)
+}
+
+func (i *Index) valuePrefix(value interface{}) string {
+	return concat(i.prefix(), literal(value), objects.PathSep)
+}
+
+// entries returns the index entries for a node body.
+func (i *Index) entries(key string, body map[string]interface{}) []*objects.Object {
+	val, ok := lookup(body, i.Property)
+	if !ok {
+		return nil
+	}
+
+	switch val.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil
+	}
+
+	return []*objects.Object{{Key: concat(i.valuePrefix(val), key)}}
+}
+
+// nodeKey returns the key of the node an index entry points to.
+func (i *Index) nodeKey(entry *objects.Object) string {
+	return entry.Key[strings.LastIndex(entry.Key, objects.PathSep)+1:]
+}
+
+// lookup returns the values an indexed predicate is restricted to. A predicate is only used when it is an equality
+// or in check on the indexed property and is required to hold, ie: it is not nested under an or / not.
+func (i *Index) lookup(preds []Predicate) ([]interface{}, bool) {
+	for _, pred := range preds {
+		switch e := pred.(type) {
+		case *andExpr:
+			if vals, ok := i.lookup([]Predicate{e.left, e.right}); ok {
+				return vals, true
+			}
+
+		case *compareExpr:
+			if e.field == i.Property && e.op == "==" {
+				return []interface{}{e.value}, true
+			}
+
+		case *inExpr:
+			if e.field == i.Property {
+				return e.values, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// CreateIndex declares a secondary index on a property of a node type, eg: CreateIndex("user", "email"). The first
+// time the index is declared on a store its entries are built from the nodes currently in the store, and the store
+// records that they were built so declaring the index again after a restart does not scan the nodes. Once created
+// the index is kept up to date by PutNode and DelNode and is used by traversals filtering the root nodes on the
+// property. Every process writing to the store must declare the index, otherwise use RebuildIndex.
+func (g *Graph) CreateIndex(ctx context.Context, nodeType, property string) error {
+	return g.createIndex(ctx, &Index{NodeType: nodeType, Property: property})
+}
+
+// CreateUniqueIndex declares an index like CreateIndex which additionally only allows a single node of the type to
+// hold a value of the property. Writing a node which conflicts with another returns a *ConflictError. Uniqueness is
+// only enforced between the writes of a single process, see Batch.Commit.
+func (g *Graph) CreateUniqueIndex(ctx context.Context, nodeType, property string) error {
+	return g.createIndex(ctx, &Index{NodeType: nodeType, Property: property, Unique: true})
+}
+
+func (g *Graph) createIndex(ctx context.Context, idx *Index) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, existing := range g.indexes[idx.NodeType] {
+		if existing.Property == idx.Property {
+			if existing.Unique != idx.Unique {
+				return fmt.Errorf("index %s already exists with a different uniqueness", idx)
+			}
+			return nil
+		}
+	}
+
+	built, err := g.store.Get(ctx, idx.marker())
+	if err != nil {
+		return err
+	}
+
+	if built == nil || built.Val["unique"] != idx.Unique {
+		if err := g.build(ctx, idx); err != nil {
+			return err
+		}
+	}
+
+	g.indexes[idx.NodeType] = append(g.indexes[idx.NodeType], idx)
+	return nil
+}
+
+// RebuildIndex rebuilds the entries of a declared index from the nodes currently in the store, for when the nodes
+// were written by a process which did not declare the index. Writes wait for the rebuild to finish.
+func (g *Graph) RebuildIndex(ctx context.Context, nodeType, property string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, idx := range g.indexes[nodeType] {
+		if idx.Property == property {
+			return g.build(ctx, idx)
+		}
+	}
+	return fmt.Errorf("no index %s.%s", nodeType, property)
+}
+
+// build replaces the entries of the index with those of the nodes in the store and records that the index was
+// built. A unique index is not built when nodes hold the same value.
+func (g *Graph) build(ctx context.Context, idx *Index) error {
+	log.Printf("[INFO] graph: building index %s", idx)
+
+	stale, errc := g.store.Prefix(ctx, idx.prefix(), scanAll)
+
+	// the marker is deleted with the stale entries, so a build which fails part way is built again.
+	del := []*objects.Object{{Key: idx.marker()}}
+	for entry := range stale {
+		del = append(del, entry)
+	}
+
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	nodes, errc := g.store.Prefix(ctx, concat(idx.NodeType, objects.NodeSep), scanAll)
+
+	var conflict *ConflictError
+	put := []*objects.Object{}
+	held := map[string]string{}
+	for n := range nodes {
+		for _, entry := range idx.entries(n.Key, n.Val) {
+			prefix := entry.Key[:strings.LastIndex(entry.Key, objects.PathSep)]
+			if idx.Unique && held[prefix] != "" && conflict == nil {
+				val, _ := lookup(n.Val, idx.Property)
+				conflict = &ConflictError{Index: idx.String(), Value: val, Key: n.Key, Existing: held[prefix]}
+			}
+
+			held[prefix] = n.Key
+			put = append(put, entry)
+		}
+	}
+
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	if conflict != nil {
+		return conflict
+	}
+
+	if err := g.store.Del(ctx, del...); err != nil {
+		return err
+	}
+
+	put = append(put, &objects.Object{Key: idx.marker(), Val: map[string]interface{}{"unique": idx.Unique}})
+	return g.store.Put(ctx, put...)
+}
+
+// Indexes returns the indexes declared on the graph.
+func (g *Graph) Indexes() []*Index {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	list := []*Index{}
+	for _, idxs := range g.indexes {
+		list = append(list, idxs...)
+	}
+	return list
+}
+
+// indexFor returns the index and values to look up for a root traversal when there is a usable index.
+func (g *Graph) indexFor(t *Traversal) (*Index, []interface{}) {
+	if t.NodeType == "" || t.ID != "" {
+		return nil, nil
+	}
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	for _, idx := range g.indexes[t.NodeType] {
+		if vals, ok := idx.lookup(t.predicates); ok {
+			return idx, vals
+		}
+	}
+	return nil, nil
+}
+
+// indexDiff returns the index entries to add and remove when a node body changes from old to new.
+func (g *Graph) indexDiff(n *objects.Node, old map[string]interface{}) (put, del []*objects.Object) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	for _, idx := range g.indexes[n.Type] {
+		prev := idx.entries(n.Key(), old)
+		next := idx.entries(n.Key(), n.Body)
+
+		for _, e := range prev {
+			if !containsKey(next, e.Key) {
+				del = append(del, e)
+			}
+		}
+
+		for _, e := range next {
+			if !containsKey(prev, e.Key) {
+				put = append(put, e)
+			}
+		}
+	}
+	return
+}
+
+// hasUnique returns true if the node type has unique indexes.
+func (g *Graph) hasUnique(nodeType string) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	for _, idx := range g.indexes[nodeType] {
+		if idx.Unique {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKey(objs []*objects.Object, key string) bool {
+	for _, o := range objs {
+		if o.Key == key {
+			return true
+		}
+	}
+	return false
+}
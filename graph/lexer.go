@@ -0,0 +1,248 @@
+package graph
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SyntaxError is returned when an expression cannot be parsed. Line and Column are 1 based.
+type SyntaxError struct {
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Msg    string `json:"message"`
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokError
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokColon
+	tokPipe
+	tokBang
+	tokDash
+	tokArrow
+	tokLArrow
+	tokParam
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+	line int
+	col  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokError:
+		return t.val
+	}
+	return fmt.Sprintf("%q", t.val)
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, line: 1, col: 1}
+}
+
+func (l *lexer) peek() rune {
+	if l.pos >= len(l.src) {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return r
+}
+
+// at returns the byte n bytes ahead of the lexer or 0 past the end of the input.
+func (l *lexer) at(n int) byte {
+	if l.pos+n >= len(l.src) {
+		return 0
+	}
+	return l.src[l.pos+n]
+}
+
+func (l *lexer) digitAt(n int) bool {
+	c := l.at(n)
+	return c >= '0' && c <= '9' || c == '.'
+}
+
+func (l *lexer) advance() rune {
+	r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+	l.pos += size
+	if r == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	return r
+}
+
+func (l *lexer) next() token {
+	for unicode.IsSpace(l.peek()) {
+		l.advance()
+	}
+
+	tok := token{pos: l.pos, line: l.line, col: l.col}
+	r := l.peek()
+
+	switch {
+	case r == -1:
+		tok.kind = tokEOF
+		return tok
+
+	case r == '(':
+		tok.kind = tokLParen
+	case r == ')':
+		tok.kind = tokRParen
+	case r == '[':
+		tok.kind = tokLBracket
+	case r == ']':
+		tok.kind = tokRBracket
+	case r == ',':
+		tok.kind = tokComma
+
+	case r == ':':
+		tok.kind = tokColon
+	case r == '|':
+		tok.kind = tokPipe
+
+	case r == '"':
+		return l.lexString(tok)
+
+	case r == '-' && !l.digitAt(1):
+		l.advance()
+		tok.kind = tokDash
+		if l.peek() == '>' {
+			l.advance()
+			tok.kind = tokArrow
+		}
+		tok.val = l.src[tok.pos:l.pos]
+		return tok
+
+	case r == '<' && l.at(1) == '-' && !l.digitAt(2):
+		l.advance()
+		l.advance()
+		tok.kind = tokLArrow
+		tok.val = l.src[tok.pos:l.pos]
+		return tok
+
+	case r == '!' && l.at(1) != '=':
+		tok.kind = tokBang
+
+	case r == '-' || unicode.IsDigit(r):
+		return l.lexNumber(tok)
+
+	case r == '=' || r == '!' || r == '<' || r == '>':
+		l.advance()
+		if l.peek() == '=' {
+			l.advance()
+		} else if r == '=' || r == '!' {
+			tok.kind = tokError
+			tok.val = fmt.Sprintf("unexpected character %q", r)
+			return tok
+		}
+		tok.kind = tokOp
+		tok.val = l.src[tok.pos:l.pos]
+		return tok
+
+	case r == '$':
+		l.advance()
+		for isIdentRune(l.peek()) || unicode.IsDigit(l.peek()) {
+			l.advance()
+		}
+		tok.kind = tokParam
+		tok.val = l.src[tok.pos:l.pos]
+		return tok
+
+	case isIdentRune(r):
+		for isIdentRune(l.peek()) || unicode.IsDigit(l.peek()) || l.peek() == '.' {
+			l.advance()
+		}
+		tok.kind = tokIdent
+		tok.val = l.src[tok.pos:l.pos]
+		return tok
+
+	default:
+		tok.kind = tokError
+		tok.val = fmt.Sprintf("unexpected character %q", r)
+		return tok
+	}
+
+	l.advance()
+	tok.val = l.src[tok.pos:l.pos]
+	return tok
+}
+
+func (l *lexer) lexString(tok token) token {
+	l.advance()
+	for {
+		switch l.peek() {
+		case -1, '\n':
+			tok.kind = tokError
+			tok.val = "unterminated string"
+			return tok
+		case '\\':
+			l.advance()
+			l.advance()
+		case '"':
+			l.advance()
+			tok.kind = tokString
+			tok.val = l.src[tok.pos:l.pos]
+			return tok
+		default:
+			l.advance()
+		}
+	}
+}
+
+func (l *lexer) lexNumber(tok token) token {
+	if l.peek() == '-' {
+		l.advance()
+	}
+
+	for {
+		r := l.peek()
+		if unicode.IsDigit(r) || r == '.' || r == 'e' || r == 'E' || r == '+' {
+			l.advance()
+			continue
+		}
+		if r == '-' && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E') {
+			l.advance()
+			continue
+		}
+		break
+	}
+
+	tok.kind = tokNumber
+	tok.val = l.src[tok.pos:l.pos]
+	return tok
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
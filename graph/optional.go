@@ -0,0 +1,133 @@
+package graph
+
+import (
+	"github.com/coldog/go-graph/objects"
+	"sync"
+)
+
+// Optional runs the sub traversal from each node at this step, attaching what it finds to the node as its matches.
+// Nodes are returned whether or not the sub traversal finds anything, eg: users and their profile photo, if any:
+//
+//	g.Traversal().Is("user").Optional(graph.Sub().Out("photo"))
+//
+// Each optional step adds a list to the matches of the node, in the order the steps were added.
+func (t *Traversal) Optional(sub *Traversal) *Traversal {
+	t.Optionals = append(t.Optionals, sub.top())
+	return t
+}
+
+// Coalesce runs the branches in turn from each node at this step and returns the results of the first branch which
+// finds anything, returning the next step of the traversal:
+//
+//	g.Traversal().Is("user").Coalesce(graph.Sub().Out("photo"), graph.Sub().Out("avatar"))
+func (t *Traversal) Coalesce(branches ...*Traversal) *Traversal {
+	t.Next = &TraversalPath{
+		Target:   &Traversal{LimitBy: 2000, G: t.G, root: t.top()},
+		Coalesce: tops(branches),
+		LimitBy:  2000,
+	}
+	return t.Next.Target
+}
+
+// planOptional adds the step running an optional sub traversal. The sub traversal is planned into a child pipeline
+// which is run once for each node.
+func planOptional(p *Pipeline, g *Graph, sub *Traversal, level int) error {
+	bind(sub, g)
+
+	cp := p.child()
+	if err := planFrom(cp, g, sub, level, false); err != nil {
+		return err
+	}
+
+	body := cp.compose()
+	p.add(&StepInfo{Step: "optional", Level: level, Body: cp.Explain()}, func(*StepStats) Step {
+		return optional(body)
+	})
+	return nil
+}
+
+// planCoalesce adds the step running the branches of a coalesce, each planned into a child pipeline.
+func planCoalesce(p *Pipeline, g *Graph, branches []*Traversal, level int) error {
+	if len(branches) == 0 {
+		return invalidf("coalesce must have a branch")
+	}
+
+	bodies := []Step{}
+	info := []*StepInfo{}
+	for _, b := range branches {
+		bind(b, g)
+		if b.returnsEdges() {
+			return invalidf("the branches of a coalesce cannot return edges")
+		}
+
+		cp := p.child()
+		if err := planFrom(cp, g, b, level, false); err != nil {
+			return err
+		}
+
+		bodies = append(bodies, cp.compose())
+		info = append(info, &StepInfo{Step: "branch", Level: level, Body: cp.Explain()})
+	}
+
+	p.add(&StepInfo{Step: "coalesce", Level: level, Body: info}, func(*StepStats) Step { return coalesce(bodies) })
+	return nil
+}
+
+// optional returns the step attaching the results of the body run from each incoming node to the node.
+func optional(body Step) Step {
+	return each(func(o *objects.Object, out chan<- *objects.Object) {
+		matches := []*objects.Object{}
+		for m := range body(feed([]*objects.Object{start(o)})) {
+			matches = append(matches, m)
+		}
+
+		o.Matches = append(o.Matches, matches)
+		out <- o
+	})
+}
+
+// coalesce returns the step sending on the results of the first body finding anything from each incoming node.
+func coalesce(bodies []Step) Step {
+	return each(func(o *objects.Object, out chan<- *objects.Object) {
+		for _, body := range bodies {
+			found := false
+			for m := range body(feed([]*objects.Object{start(o)})) {
+				found = true
+				out <- m
+			}
+
+			if found {
+				return
+			}
+		}
+	})
+}
+
+// start returns a copy of the node to start a sub traversal from, so the results of the sub traversal never hold
+// the node itself.
+func start(o *objects.Object) *objects.Object {
+	return &objects.Object{Key: o.Key, Val: o.Val, Path: o.Path}
+}
+
+// each returns a step calling f for each incoming object from a pool of workers.
+func each(f func(o *objects.Object, out chan<- *objects.Object)) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		wg := &sync.WaitGroup{}
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				for o := range in {
+					f(o, out)
+				}
+			}()
+		}
+
+		go func() {
+			wg.Wait()
+			close(out)
+		}()
+		return out
+	}
+}
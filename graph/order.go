@@ -0,0 +1,361 @@
+package graph
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Order sorts the results of a traversal by a property of their body, "id" sorts by the node ID.
+type Order struct {
+	By   string `json:"by"`
+	Desc bool   `json:"desc,omitempty"`
+}
+
+func (o Order) String() string {
+	if o.Desc {
+		return o.By + " desc"
+	}
+	return o.By
+}
+
+// CursorError is returned when the cursor of a paged traversal cannot be decoded or was returned by a traversal
+// with a different order.
+type CursorError struct {
+	Cursor string `json:"cursor"`
+}
+
+func (e *CursorError) Error() string {
+	return "invalid cursor " + e.Cursor
+}
+
+// TruncatedError is returned by a paged traversal when a scan of one of its steps hit its limit, so the results the
+// pages are cut from are incomplete and the pages could skip or repeat results.
+type TruncatedError struct {
+	Step  string `json:"step"`
+	Level int    `json:"level"`
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("cannot page the results, a scan of the %s step at level %d hit its limit", e.Step, e.Level)
+}
+
+// Order sorts the results of the traversal by the property, results with equal values are sorted by key. Each call
+// adds a property to sort by and the order applies to the whole traversal. Sorting waits for every result so skip
+// and limit still apply to the unsorted results of their step, use Page to page through sorted results.
+func (t *Traversal) Order(by string, desc bool) *Traversal {
+	var root *Traversal
+	if t.root == nil {
+		root = t
+	} else {
+		root = t.root
+	}
+
+	root.Orders = append(root.Orders, Order{By: by, Desc: desc})
+	return t
+}
+
+// Page returns the results of the traversal a page at a time, sorted by its order or by key without an order. The
+// cursor is empty for the first page and otherwise the cursor returned by RunPage for the previous page.
+//
+// A traversal returning its root nodes by key reads each page from the store starting after the cursor, regardless
+// of the limit of the root. Any other traversal sorts every result found within the limits of each step and returns
+// a *TruncatedError when a scan hits its limit.
+func (t *Traversal) Page(size int, cursor string) *Traversal {
+	var root *Traversal
+	if t.root == nil {
+		root = t
+	} else {
+		root = t.root
+	}
+
+	root.PageSize = size
+	root.Cursor = cursor
+	return t
+}
+
+// RunPage runs a paged traversal returning the page of results and the cursor of the next page, which is empty on
+// the last page.
+func (g *Graph) RunPage(ctx context.Context, t *Traversal) ([]*objects.Object, string, error) {
+	res, p, err := g.run(ctx, t, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return res, p.cursor, nil
+}
+
+// cursor is the position of the last result of a page.
+type cursor struct {
+	Order  string        `json:"o"`
+	Values []interface{} `json:"v"`
+	Key    string        `json:"k"`
+}
+
+func orderString(orders []Order) string {
+	list := []string{}
+	for _, o := range orders {
+		list = append(list, o.String())
+	}
+	return strings.Join(list, ",")
+}
+
+func decodeCursor(s string, orders []Order) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &CursorError{Cursor: s}
+	}
+
+	c := &cursor{}
+	if err := json.Unmarshal(data, c); err != nil || c.Order != orderString(orders) || len(c.Values) != len(orders) {
+		return nil, &CursorError{Cursor: s}
+	}
+	return c, nil
+}
+
+func (c *cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// planOrder adds the step sorting and paging the results when the traversal is ordered or paged.
+func planOrder(p *Pipeline, g *Graph, t *Traversal) error {
+	if len(t.Orders) == 0 && t.PageSize <= 0 && t.Cursor == "" {
+		return nil
+	}
+
+	var after *cursor
+	if t.Cursor != "" {
+		c, err := decodeCursor(t.Cursor, t.Orders)
+		if err != nil {
+			return err
+		}
+		after = c
+	}
+
+	level := 0
+	for l := t; l.Next != nil; l = l.Next.Target {
+		level++
+	}
+
+	filters := []string{}
+	for _, o := range t.Orders {
+		filters = append(filters, o.String())
+	}
+
+	paged := (t.PageSize > 0 || t.Cursor != "") && !g.seeks(t)
+	p.add(&StepInfo{Step: "order", Level: level, Limit: t.PageSize, Filters: filters}, func(st *StepStats) Step {
+		return order(p, st, g.store, t.Orders, after, t.PageSize, paged)
+	})
+	return nil
+}
+
+// seeks returns true when a traversal paged by key returns its root nodes, which are then read a page at a time
+// starting after the cursor, see seek.
+func (g *Graph) seeks(t *Traversal) bool {
+	if t.PageSize <= 0 || t.ID != "" || len(t.Orders) > 0 || t.Next != nil || t.Paths != nil || t.Aggregation != nil || len(t.Selects) > 0 {
+		return false
+	}
+
+	if len(t.Optionals) > 0 || t.hasSets() {
+		return false
+	}
+
+	for _, s := range t.filters {
+		if s.name != "body" {
+			return false
+		}
+	}
+
+	idx, _ := g.indexFor(t)
+	return idx == nil
+}
+
+// seek returns the root nodes of a traversal paged by key matching its filters, starting after the key of the cursor.
+// A node past the page is read to tell whether there is a next page.
+func seek(p *Pipeline, st *StepStats, s store.Store, t *Traversal) <-chan *objects.Object {
+	prefix := concat(t.NodeType, objects.NodeSep, t.ID)
+	r := keyRange{prefix, after(prefix)}
+
+	if t.Cursor != "" {
+		c, err := decodeCursor(t.Cursor, t.Orders)
+		if err != nil {
+			p.Fail(err)
+
+			out := make(chan *objects.Object)
+			close(out)
+			return out
+		}
+
+		if c.Key >= r.start {
+			r.start = c.Key + "\x00"
+		}
+	}
+	return p.scanMatching(st, s, r, t.PageSize+1, t.predicates)
+}
+
+// truncated returns the first step of the pipeline with a scan which hit its limit, or nil.
+func (p *Pipeline) truncated() *StepInfo {
+	for _, s := range p.steps {
+		if atomic.LoadInt64(&s.stats.Truncated) > 0 {
+			return s.info
+		}
+	}
+	return nil
+}
+
+// sortable is a result with the values it is sorted by.
+type sortable struct {
+	obj    *objects.Object
+	values []interface{}
+	key    string
+}
+
+// order returns the step sorting every result, dropping the results up to the cursor and returning a page of size
+// results. The cursor of the next page is set on the pipeline when there are more results. When paged is set the
+// pipeline fails with a *TruncatedError rather than returning a page when a scan before the step hit its limit.
+func order(p *Pipeline, st *StepStats, s store.Store, orders []Order, after *cursor, size int, paged bool) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+
+			list := []*sortable{}
+			for o := range in {
+				item, err := sortValues(p, st, s, o, orders)
+				if err != nil {
+					p.Fail(err)
+					continue
+				}
+				list = append(list, item)
+			}
+
+			if info := p.truncated(); paged && info != nil {
+				p.Fail(&TruncatedError{Step: info.Step, Level: info.Level})
+				return
+			}
+
+			sort.SliceStable(list, func(i, j int) bool {
+				return compareSorted(orders, list[i].values, list[i].key, list[j].values, list[j].key) < 0
+			})
+
+			n := 0
+			var last *sortable
+			for _, item := range list {
+				if after != nil && compareSorted(orders, item.values, item.key, after.Values, after.Key) <= 0 {
+					continue
+				}
+
+				if size > 0 && n == size {
+					p.cursor = (&cursor{Order: orderString(orders), Values: last.values, Key: last.key}).encode()
+					break
+				}
+
+				n++
+				last = item
+				out <- item.obj
+			}
+		}()
+		return out
+	}
+}
+
+// sortValues returns the result with the values of the properties it is sorted by, loading the body of the result
+// if it is needed. The body is not kept on the result.
+func sortValues(p *Pipeline, st *StepStats, s store.Store, o *objects.Object, orders []Order) (*sortable, error) {
+	item := &sortable{obj: o, key: o.Key}
+	if o.Path != nil {
+		item.key = o.PathKey()
+	}
+
+	body := o.Val
+	for _, ord := range orders {
+		if ord.By == "id" && o.IsNode() {
+			item.values = append(item.values, o.Node().ID)
+			continue
+		}
+
+		if body == nil {
+			obj, err := p.get(st, s, o.Key)
+			if err != nil {
+				return nil, err
+			}
+
+			body = map[string]interface{}{}
+			if obj != nil && obj.Val != nil {
+				body = obj.Val
+			}
+		}
+
+		v, _ := lookup(body, ord.By)
+		item.values = append(item.values, v)
+	}
+	return item, nil
+}
+
+// compareSorted compares two results by their values in the order and then by key.
+func compareSorted(orders []Order, av []interface{}, ak string, bv []interface{}, bk string) int {
+	for i, ord := range orders {
+		c := compareAny(av[i], bv[i])
+		if ord.Desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(ak, bk)
+}
+
+// compareAny orders any two values, missing values sort first followed by booleans, numbers, strings and then any
+// other value by its JSON encoding.
+func compareAny(a, b interface{}) int {
+	ra, rb := sortRank(a), sortRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch ra {
+	case 0:
+		return 0
+	case 1:
+		if a.(bool) == b.(bool) {
+			return 0
+		} else if !a.(bool) {
+			return -1
+		}
+		return 1
+	case 2, 3:
+		c, _ := compare(a, b)
+		return c
+	}
+	return strings.Compare(literal(a), literal(b))
+}
+
+func sortRank(v interface{}) int {
+	if v == nil {
+		return 0
+	}
+
+	if _, ok := v.(bool); ok {
+		return 1
+	}
+
+	if _, ok := toFloat(v); ok {
+		return 2
+	}
+
+	if _, ok := v.(string); ok {
+		return 3
+	}
+	return 4
+}
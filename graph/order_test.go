@@ -0,0 +1,42 @@
+package graph
+
+import (
+	"testing"
+)
+
+func TestOrder_CompareAny(t *testing.T) {
+	ordered := []interface{}{nil, false, true, -1, 2.5, 3, "a", "b", []interface{}{1}}
+
+	for i, a := range ordered {
+		for j, b := range ordered {
+			exp := 0
+			if i < j {
+				exp = -1
+			} else if i > j {
+				exp = 1
+			}
+
+			if got := compareAny(a, b); got != exp {
+				t.Errorf("compare %v to %v: expected %d got %d", a, b, exp, got)
+			}
+		}
+	}
+}
+
+func TestOrder_Cursor(t *testing.T) {
+	orders := []Order{{By: "n", Desc: true}, {By: "name"}}
+	c := &cursor{Order: orderString(orders), Values: []interface{}{3.0, "a"}, Key: "user_1"}
+
+	got, err := decodeCursor(c.encode(), orders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if compareSorted(orders, got.Values, got.Key, c.Values, c.Key) != 0 {
+		t.Fatalf("expected %+v got %+v", c, got)
+	}
+
+	if _, err := decodeCursor(c.encode(), orders[:1]); err == nil {
+		t.Fatal("expected an error for a cursor of another order")
+	}
+}
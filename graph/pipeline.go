@@ -1,30 +1,365 @@
 package graph
 
-import "github.com/coldog/go-graph/objects"
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Step func(in <-chan *objects.Object) <-chan *objects.Object
 
-type Pipeline struct {
-	steps   []Step
-	results []*objects.Object
+// StepInfo describes a step of a pipeline. Prefixes are the shapes of the prefix scans the step runs, where <node>
+// stands in for the key of each incoming node, and Ranges the shapes of the range scans skipping the types of edges
+// in Except.
+type StepInfo struct {
+	Step     string        `json:"step"`
+	Level    int           `json:"level"`
+	Prefixes []string      `json:"prefixes,omitempty"`
+	Limit    int           `json:"limit,omitempty"`
+	Index    string        `json:"index,omitempty"`
+	Values   []interface{} `json:"values,omitempty"`
+	Types    []string      `json:"types,omitempty"`
+	Except   []string      `json:"except,omitempty"`
+	Ranges   []string      `json:"ranges,omitempty"`
+	Filters  []string      `json:"filters,omitempty"`
+	Body     []*StepInfo   `json:"body,omitempty"`
+}
+
+// StepStats are the counters of a step, collected when a pipeline is profiled. Time is the time from the start of
+// the pipeline until the step sent its last object. Truncated counts the prefix scans which hit their limit.
+type StepStats struct {
+	In        int64         `json:"in"`
+	Out       int64         `json:"out"`
+	Scanned   int64         `json:"scanned"`
+	Calls     int64         `json:"store_calls"`
+	Truncated int64         `json:"truncated"`
+	Time      time.Duration `json:"time_ns"`
+}
+
+// StepProfile is the description and counters of a step of a profiled pipeline.
+type StepProfile struct {
+	*StepInfo
+	*StepStats
+}
+
+type pipeStep struct {
+	info  *StepInfo
+	stats *StepStats
+	step  Step
+}
+
+// NewPipeline returns a pipeline which is cancelled along with the context.
+func NewPipeline(ctx context.Context) *Pipeline {
+	return newPipeline(ctx, Budget{})
+}
+
+func newPipeline(ctx context.Context, budget Budget) *Pipeline {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Pipeline{
+		ctx:    ctx,
+		cancel: cancel,
+		lock:   &sync.Mutex{},
+		budget: budget,
+		keys:   new(int64),
+	}
+}
+
+// child returns a pipeline for steps run by a step of p, such as the body of a repeat. The child shares the
+// context and budget of p and failing the child fails p.
+func (p *Pipeline) child() *Pipeline {
+	return &Pipeline{
+		ctx:     p.ctx,
+		cancel:  p.cancel,
+		lock:    p.lock,
+		budget:  p.budget,
+		keys:    p.keys,
+		profile: p.profile,
+		paths:   p.paths,
+		parent:  p,
+	}
 }
 
-func (p *Pipeline) emit(o *objects.Object) {
-	p.results = append(p.results, o)
+// compose returns a step running every step of the pipeline in turn.
+func (p *Pipeline) compose() Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		next := in
+		for _, s := range p.steps {
+			next = s.step(next)
+		}
+		return next
+	}
+}
+
+type Pipeline struct {
+	keys    *int64
+	steps   []*pipeStep
+	ctx     context.Context
+	cancel  context.CancelFunc
+	lock    *sync.Mutex
+	err     error
+	budget  Budget
+	profile bool
+	paths   *PathOptions
+	parent  *Pipeline
+	cursor  string
+	value   interface{}
 }
 
 func (p *Pipeline) AddStep(s Step) {
-	p.steps = append(p.steps, s)
+	p.add(&StepInfo{Step: "step"}, func(*StepStats) Step { return s })
+}
+
+// add adds a step described by info, build is passed the counters of the step.
+func (p *Pipeline) add(info *StepInfo, build func(st *StepStats) Step) {
+	st := &StepStats{}
+	p.steps = append(p.steps, &pipeStep{info: info, stats: st, step: build(st)})
+}
+
+// Explain returns the description of the steps of the pipeline.
+func (p *Pipeline) Explain() []*StepInfo {
+	list := []*StepInfo{}
+	for _, s := range p.steps {
+		list = append(list, s.info)
+	}
+	return list
+}
+
+// Profile returns the description and counters of the steps of the pipeline. Only the store calls, keys scanned
+// and truncated scans are counted unless the pipeline was run with profiling.
+func (p *Pipeline) Profile() []*StepProfile {
+	list := []*StepProfile{}
+	for _, s := range p.steps {
+		list = append(list, &StepProfile{StepInfo: s.info, StepStats: s.stats})
+	}
+	return list
+}
+
+// Context returns the context of the pipeline which is cancelled once the pipeline fails.
+func (p *Pipeline) Context() context.Context {
+	return p.ctx
+}
+
+// Fail records the error and cancels the pipeline. Only the first error is kept.
+func (p *Pipeline) Fail(err error) {
+	if p.parent != nil {
+		p.parent.Fail(err)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err == nil {
+		p.err = err
+		p.cancel()
+	}
 }
 
-func (p *Pipeline) Collect() []*objects.Object {
+// Err returns the error the pipeline failed with.
+func (p *Pipeline) Err() error {
+	if p.parent != nil {
+		return p.parent.Err()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// Collect runs the pipeline returning the results. If the pipeline fails the remaining objects are drained so
+// every step can exit and the error is returned.
+func (p *Pipeline) Collect() ([]*objects.Object, error) {
+	var res []*objects.Object
+	err := p.Each(func(o *objects.Object) error {
+		res = append(res, o)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Each runs the pipeline calling f with each result as soon as the last step sends it. An error returned by f
+// fails the pipeline. If the pipeline fails the remaining objects are drained so every step can exit and the error
+// is returned.
+func (p *Pipeline) Each(f func(o *objects.Object) error) error {
+	defer p.cancel()
+
+	start := time.Now()
+
 	var next <-chan *objects.Object = nil
-	for _, stage := range p.steps {
-		next = stage(next)
+	for _, s := range p.steps {
+		if p.profile {
+			next = profile(s, next, start)
+		} else {
+			next = s.step(next)
+		}
 	}
 
 	for obj := range next {
-		p.results = append(p.results, obj)
+		if p.ctx.Err() == nil {
+			if err := f(obj); err != nil {
+				p.Fail(err)
+			}
+		}
+	}
+
+	if err := p.ctx.Err(); err != nil {
+		p.Fail(err)
+		return p.Err()
 	}
-	return p.results
+	return nil
+}
+
+// profile runs the step counting the objects into and out of it.
+func profile(s *pipeStep, in <-chan *objects.Object, start time.Time) <-chan *objects.Object {
+	if in != nil {
+		counted := make(chan *objects.Object)
+		go func(in <-chan *objects.Object) {
+			defer close(counted)
+			for o := range in {
+				atomic.AddInt64(&s.stats.In, 1)
+				counted <- o
+			}
+		}(in)
+		in = counted
+	}
+
+	res := s.step(in)
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+		for o := range res {
+			atomic.AddInt64(&s.stats.Out, 1)
+			out <- o
+		}
+		s.stats.Time = time.Since(start)
+	}()
+	return out
+}
+
+// prefix runs a prefix query against the store under the context of the pipeline, failing the pipeline if the
+// query returns an error. The keys scanned are counted against the step and the budget of the pipeline.
+func (p *Pipeline) prefix(st *StepStats, s store.Store, prefix string, count int) <-chan *objects.Object {
+	atomic.AddInt64(&st.Calls, 1)
+
+	res, errc := s.Prefix(p.ctx, prefix, peek(count))
+	return p.scan(st, res, errc, count)
+}
+
+// scanRange runs a range query against the store under the context of the pipeline, see prefix.
+func (p *Pipeline) scanRange(st *StepStats, s store.Store, r keyRange, count int) <-chan *objects.Object {
+	atomic.AddInt64(&st.Calls, 1)
+
+	res, errc := s.Range(p.ctx, r.start, r.end, peek(count))
+	return p.scan(st, res, errc, count)
+}
+
+// scanMatching scans the keys in the range a page of at least matchPage keys at a time until count of them match the
+// predicates, so the count limits the matching keys rather than the keys scanned. Only the matching keys are passed
+// on and the scan is counted as truncated when there is a key past the last match.
+func (p *Pipeline) scanMatching(st *StepStats, s store.Store, r keyRange, count int, preds []Predicate) <-chan *objects.Object {
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+
+		page := count
+		if page < matchPage {
+			page = matchPage
+		}
+
+		matched := 0
+		more := false
+		for {
+			// once every match is found only a single key is read to tell whether the scan was truncated.
+			if matched == count {
+				page = 1
+			}
+
+			atomic.AddInt64(&st.Calls, 1)
+			res, errc := s.Range(p.ctx, r.start, r.end, page)
+
+			n := 0
+			for o := range p.scan(st, res, errc, 0) {
+				n++
+				r.start = o.Key + "\x00"
+
+				if matched == count {
+					more = true
+					continue
+				}
+
+				if matches(o.Val, preds) {
+					matched++
+					out <- o
+				}
+			}
+
+			if more || n < page || p.ctx.Err() != nil {
+				break
+			}
+		}
+
+		if more {
+			atomic.AddInt64(&st.Truncated, 1)
+		}
+	}()
+	return out
+}
+
+// peek returns the count to query for to tell whether a scan of count keys was truncated, one more key than count.
+func peek(count int) int {
+	if count <= 0 || count >= scanAll {
+		return count
+	}
+	return count + 1
+}
+
+// scan passes on up to count results of a query queried with peek, counting the keys scanned. The scan is counted
+// as truncated when the query found a key past count. The error of the query is read before the results are
+// closed, so the pipeline has failed by the time the step finishes.
+func (p *Pipeline) scan(st *StepStats, res <-chan *objects.Object, errc <-chan error, count int) <-chan *objects.Object {
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+
+		n := 0
+		truncated := false
+		for o := range res {
+			if count > 0 && n == count {
+				truncated = true
+				continue
+			}
+
+			n++
+			atomic.AddInt64(&st.Scanned, 1)
+
+			if max := p.budget.MaxScanned; max > 0 && atomic.AddInt64(p.keys, 1) > max {
+				p.Fail(&BudgetError{Limit: "scanned", Max: fmt.Sprint(max)})
+				continue
+			}
+
+			out <- o
+		}
+
+		if truncated {
+			atomic.AddInt64(&st.Truncated, 1)
+		}
+
+		if err := <-errc; err != nil {
+			p.Fail(err)
+		}
+	}()
+	return out
+}
+
+// get reads a key from the store under the context of the pipeline.
+func (p *Pipeline) get(st *StepStats, s store.Store, key string) (*objects.Object, error) {
+	atomic.AddInt64(&st.Calls, 1)
+	return s.Get(p.ctx, key)
 }
@@ -1,37 +1,41 @@
 package graph
 
 import (
+	"context"
 	"fmt"
 	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
 	"github.com/coldog/go-graph/store/bolt"
 	"testing"
+	"time"
 )
 
 func TestPipeline_Queries(t *testing.T) {
-	p := &Pipeline{}
+	ctx := context.Background()
+	p := NewPipeline(ctx)
 	store := bolt.NewBoltStore("test")
-	store.Open()
+	store.Open(ctx)
 	defer store.Close()
 	defer store.Drop()
 
 	n := objects.NewNode("test2")
 	n.ID = "1234"
 
-	store.Put(&objects.Object{n.Key(), n.Body})
+	store.Put(ctx, &objects.Object{Key: n.Key(), Val: n.Body})
 
 	for i := 0; i < 20; i++ {
 		n2 := objects.NewNode("test2")
 		e := objects.NewEdge("likes", n.Key(), n2.Key())
-		store.Put(
-			&objects.Object{e.ForwardKey(), e.Body},
-			&objects.Object{e.ReverseKey(), e.Body},
+		store.Put(ctx,
+			&objects.Object{Key: e.ForwardKey(), Val: e.Body},
+			&objects.Object{Key: e.ReverseKey(), Val: e.Body},
 		)
 	}
 
 	p.AddStep(func(in <-chan *objects.Object) <-chan *objects.Object {
 		out := make(chan *objects.Object, 1)
 		defer close(out)
-		obj, _ := store.Get("test2_1234")
+		obj, _ := store.Get(ctx, "test2_1234")
 		out <- obj
 		return out
 	})
@@ -41,7 +45,7 @@ func TestPipeline_Queries(t *testing.T) {
 		go func() {
 			defer close(out)
 			for o := range in {
-				ch, _ := store.Prefix(
+				ch, _ := store.Prefix(ctx,
 					concat(objects.ForwardEdgeKey, o.Key, objects.PathSep, "likes"),
 					20,
 				)
@@ -55,8 +59,45 @@ func TestPipeline_Queries(t *testing.T) {
 		return out
 	})
 
-	list := p.Collect()
+	list, err := p.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	for _, obj := range list {
 		fmt.Printf("%s\n", obj.Key)
 	}
 }
+
+// lateStore is a store whose scans fail after closing their results.
+type lateStore struct {
+	store.Store
+	err error
+}
+
+func (s *lateStore) Prefix(ctx context.Context, prefix string, count int) (<-chan *objects.Object, <-chan error) {
+	res := make(chan *objects.Object)
+	errc := make(chan error, 1)
+	go func() {
+		res <- &objects.Object{Key: prefix + "1"}
+		close(res)
+
+		time.Sleep(2 * time.Millisecond)
+		errc <- s.err
+		close(errc)
+	}()
+	return res, errc
+}
+
+func TestPipeline_StoreError(t *testing.T) {
+	s := &lateStore{err: fmt.Errorf("store failed")}
+	g := New(s)
+
+	for i := 0; i < 20; i++ {
+		tr := g.Traversal()
+		tr.Is("user")
+
+		_, err := g.Run(context.Background(), tr)
+		equals(t, s.err, err)
+	}
+}
@@ -0,0 +1,491 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A Predicate is a compiled filter expression which is evaluated against the body of a node or edge. Predicates
+// are written in a small expression language and are what the `filters` field of a traversal and the `filter`
+// field of a traversal path are compiled into:
+//
+//	age >= 21 and not (status in ["banned", "deleted"])
+//	email exists or name prefix "admin"
+//	address.city == "Berlin"
+//
+// Fields are looked up in the body, nested maps may be reached with dots. A field name which is not an identifier is
+// written as a Json string, eg: "first-name" == "alice". Values are written as Json literals.
+// Comparing values of different types is never true.
+type Predicate interface {
+	Match(body map[string]interface{}) bool
+	String() string
+}
+
+// ParsePredicate compiles the expression into a Predicate.
+func ParsePredicate(src string) (Predicate, error) {
+	p := &parser{lex: newLexer(src)}
+	p.next()
+
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+
+	return e, nil
+}
+
+// MustParsePredicate is like ParsePredicate but panics if the expression cannot be parsed.
+func MustParsePredicate(src string) Predicate {
+	pred, err := ParsePredicate(src)
+	if err != nil {
+		panic(err)
+	}
+	return pred
+}
+
+type andExpr struct {
+	left, right Predicate
+}
+
+func (e *andExpr) Match(body map[string]interface{}) bool {
+	return e.left.Match(body) && e.right.Match(body)
+}
+
+func (e *andExpr) String() string {
+	return fmt.Sprintf("(%s and %s)", e.left, e.right)
+}
+
+type orExpr struct {
+	left, right Predicate
+}
+
+func (e *orExpr) Match(body map[string]interface{}) bool {
+	return e.left.Match(body) || e.right.Match(body)
+}
+
+func (e *orExpr) String() string {
+	return fmt.Sprintf("(%s or %s)", e.left, e.right)
+}
+
+type notExpr struct {
+	expr Predicate
+}
+
+func (e *notExpr) Match(body map[string]interface{}) bool {
+	return !e.expr.Match(body)
+}
+
+func (e *notExpr) String() string {
+	return fmt.Sprintf("not %s", e.expr)
+}
+
+type existsExpr struct {
+	field string
+}
+
+func (e *existsExpr) Match(body map[string]interface{}) bool {
+	_, ok := lookup(body, e.field)
+	return ok
+}
+
+func (e *existsExpr) String() string {
+	return fmt.Sprintf("%s exists", fieldName(e.field))
+}
+
+type inExpr struct {
+	field  string
+	values []interface{}
+}
+
+func (e *inExpr) Match(body map[string]interface{}) bool {
+	val, ok := lookup(body, e.field)
+	if !ok {
+		return false
+	}
+
+	for _, v := range e.values {
+		if c, ok := compare(val, v); ok && c == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *inExpr) String() string {
+	return fmt.Sprintf("%s in %s", fieldName(e.field), literal(e.values))
+}
+
+type compareExpr struct {
+	field string
+	op    string
+	value interface{}
+}
+
+func (e *compareExpr) Match(body map[string]interface{}) bool {
+	val, ok := lookup(body, e.field)
+	if !ok {
+		return false
+	}
+
+	switch e.op {
+	case "prefix", "contains":
+		s, ok1 := val.(string)
+		sub, ok2 := e.value.(string)
+		if !ok1 || !ok2 {
+			return false
+		}
+
+		if e.op == "prefix" {
+			return strings.HasPrefix(s, sub)
+		}
+		return strings.Contains(s, sub)
+	}
+
+	c, ok := compare(val, e.value)
+	if !ok {
+		// values which cannot be compared are only ever not equal.
+		return e.op == "!="
+	}
+
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func (e *compareExpr) String() string {
+	return fmt.Sprintf("%s %s %s", fieldName(e.field), e.op, literal(e.value))
+}
+
+// lookup resolves a dotted field name against the body.
+func lookup(body map[string]interface{}, field string) (interface{}, bool) {
+	var cur interface{} = body
+	for _, part := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// compare returns -1, 0 or 1 comparing a to b. The second return value is false when the values are not of a
+// comparable type.
+func compare(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+
+	case bool:
+		bv, ok := b.(bool)
+		if !ok || av != bv {
+			return 0, false
+		}
+		return 0, true
+
+	case nil:
+		if b != nil {
+			return 0, false
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func literal(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+// jsonValue returns the value as it reads back from its Json encoding, the way the values of a parsed predicate are
+// held.
+func jsonValue(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+
+	var val interface{}
+	if err := json.Unmarshal(data, &val); err != nil {
+		return v
+	}
+	return val
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+
+	// params are the values of the $parameters of a stored query.
+	params map[string]interface{}
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if p.tok.kind == tokError {
+		return &SyntaxError{Line: p.tok.line, Column: p.tok.col, Msg: p.tok.val}
+	}
+	return &SyntaxError{Line: p.tok.line, Column: p.tok.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) keyword(word string) bool {
+	return p.tok.kind == tokIdent && p.tok.val == word
+}
+
+// expr := and ("or" and)*
+func (p *parser) parseExpr() (Predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+// and := not ("and" not)*
+func (p *parser) parseAnd() (Predicate, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+	return left, nil
+}
+
+// not := "not" not | "(" expr ")" | term
+func (p *parser) parseNot() (Predicate, error) {
+	if p.keyword("not") {
+		p.next()
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{e}, nil
+	}
+
+	if p.tok.kind == tokLParen {
+		p.next()
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ) but found %s", p.tok)
+		}
+		p.next()
+		return e, nil
+	}
+
+	return p.parseTerm()
+}
+
+// term := field "exists" | field "in" list | field op value
+// field := ident | string
+func (p *parser) parseTerm() (Predicate, error) {
+	var field string
+	switch {
+	case p.tok.kind == tokString:
+		if err := json.Unmarshal([]byte(p.tok.val), &field); err != nil || field == "" {
+			return nil, p.errorf("invalid field name %s", p.tok.val)
+		}
+	case p.tok.kind == tokIdent && !isKeyword(p.tok.val):
+		field = p.tok.val
+	default:
+		return nil, p.errorf("expected a field name but found %s", p.tok)
+	}
+	p.next()
+
+	switch {
+	case p.keyword("exists"):
+		p.next()
+		return &existsExpr{field}, nil
+
+	case p.keyword("in"):
+		p.next()
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		list, ok := val.([]interface{})
+		if !ok {
+			return nil, p.errorf("expected a list after in")
+		}
+		return &inExpr{field, list}, nil
+
+	case p.keyword("prefix"), p.keyword("contains"), p.tok.kind == tokOp:
+		op := p.tok.val
+		p.next()
+
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return &compareExpr{field, op, val}, nil
+	}
+
+	return nil, p.errorf("expected an operator after %s but found %s", field, p.tok)
+}
+
+// value := string | number | param | "true" | "false" | "null" | "[" (value ("," value)*)? "]"
+func (p *parser) parseValue() (interface{}, error) {
+	switch p.tok.kind {
+	case tokString, tokNumber:
+		var v interface{}
+		if err := json.Unmarshal([]byte(p.tok.val), &v); err != nil {
+			return nil, p.errorf("invalid literal %s", p.tok.val)
+		}
+		p.next()
+		return v, nil
+
+	case tokIdent:
+		var v interface{}
+		switch p.tok.val {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			return nil, p.errorf("expected a value but found %s", p.tok)
+		}
+		p.next()
+		return v, nil
+
+	case tokParam:
+		v, ok := p.params[p.tok.val[1:]]
+		if !ok {
+			return nil, p.errorf("unknown parameter %s", p.tok.val)
+		}
+		p.next()
+		return v, nil
+
+	case tokLBracket:
+		p.next()
+		list := []interface{}{}
+		for p.tok.kind != tokRBracket {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+
+			if p.tok.kind == tokComma {
+				p.next()
+			} else if p.tok.kind != tokRBracket {
+				return nil, p.errorf("expected , or ] but found %s", p.tok)
+			}
+		}
+		p.next()
+		return list, nil
+	}
+
+	return nil, p.errorf("expected a value but found %s", p.tok)
+}
+
+// fieldName returns the field as it is written in an expression, quoted when it does not read back as an identifier.
+func fieldName(field string) string {
+	if field == "" || isKeyword(field) {
+		return literal(field)
+	}
+
+	for i, r := range field {
+		if !isIdentRune(r) && (i == 0 || !unicode.IsDigit(r) && r != '.') {
+			return literal(field)
+		}
+	}
+	return field
+}
+
+func isKeyword(s string) bool {
+	switch s {
+	case "and", "or", "not", "in", "exists", "prefix", "contains", "true", "false", "null":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package graph
+
+import (
+	"testing"
+)
+
+func TestPredicate_Match(t *testing.T) {
+	body := map[string]interface{}{
+		"name":   "alice",
+		"age":    float64(31),
+		"admin":  true,
+		"tags":   []interface{}{"a", "b"},
+		"status": "active",
+		"address": map[string]interface{}{
+			"city": "Berlin",
+		},
+	}
+
+	cases := map[string]bool{
+		`age > 30`:                                     true,
+		`age >= 31 and age <= 31`:                      true,
+		`age < 18 or name == "alice"`:                  true,
+		`not (age < 18)`:                               true,
+		`age != 31`:                                    false,
+		`age == "31"`:                                  false,
+		`name != 31`:                                   true,
+		`admin == true`:                                true,
+		`status in ["active", "pending"]`:              true,
+		`status in ["deleted"]`:                        false,
+		`email exists`:                                 false,
+		`not email exists and name exists`:             true,
+		`name prefix "ali"`:                            true,
+		`name contains "lic"`:                          true,
+		`age contains "3"`:                             false,
+		`address.city == "Berlin"`:                     true,
+		`address.zip exists`:                           false,
+		`missing == null`:                              false,
+		`age > -1.5e2 and (admin == false or age > 1)`: true,
+	}
+
+	for src, exp := range cases {
+		pred, err := ParsePredicate(src)
+		ok(t, err)
+		assert(t, pred.Match(body) == exp, "%s: expected %v", src, exp)
+	}
+}
+
+func TestPredicate_String(t *testing.T) {
+	cases := map[string]string{
+		`age >= 21`:                       `age >= 21`,
+		`address.city == "Berlin"`:        `address.city == "Berlin"`,
+		`"first-name" == "alice"`:         `"first-name" == "alice"`,
+		`"in" exists`:                     `"in" exists`,
+		`"a b" in [1] or "x_1" prefix ""`: `("a b" in [1] or x_1 prefix "")`,
+	}
+
+	for src, exp := range cases {
+		pred, err := ParsePredicate(src)
+		ok(t, err)
+		equals(t, exp, pred.String())
+
+		_, err = ParsePredicate(pred.String())
+		ok(t, err)
+	}
+}
+
+func TestPredicate_SyntaxErrors(t *testing.T) {
+	cases := map[string]SyntaxError{
+		``:                    {Line: 1, Column: 1},
+		`age >`:               {Line: 1, Column: 6},
+		`age = 1`:             {Line: 1, Column: 5},
+		`name == "abc`:        {Line: 1, Column: 9},
+		`(age > 1`:            {Line: 1, Column: 9},
+		"age > 1 and\n  in 3": {Line: 2, Column: 3},
+		`status in "active"`:  {Line: 1, Column: 19},
+		`age > 1 age`:         {Line: 1, Column: 9},
+	}
+
+	for src, exp := range cases {
+		_, err := ParsePredicate(src)
+		serr, isSyntax := err.(*SyntaxError)
+		assert(t, isSyntax, "%s: expected a syntax error got %v", src, err)
+		equals(t, exp.Line, serr.Line)
+		equals(t, exp.Column, serr.Column)
+	}
+}
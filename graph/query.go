@@ -0,0 +1,472 @@
+package graph
+
+import (
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"strconv"
+)
+
+// ParseQuery parses a query written in the text query language into a traversal. A query is a step followed by
+// any number of hops to further steps, and then clauses applying to the whole traversal:
+//
+//	user(id: "42") -follows-> user -posts-> post where likes > 10 limit 20
+//
+// A step is a node type, optional after the first step, followed by properties to match, a label, a filter and a
+// limit. The limit of the first step limits the nodes scanned like Traversal.Limit, on later steps it keeps the
+// first nodes found:
+//
+//	post(id: "1", kind: "photo") as p where likes > 10 and tags contains "go" limit 20
+//
+// The "id" property is the node ID, any other property is matched against the node body. Filters are written in
+// the predicate language, see Predicate. A hop follows edges out (-types->), in (<-types-) or both ways (-types-)
+// where types are edge types separated by |, any type with no types or any type except some with !types. Hops
+// may filter the edge bodies and set a limit like a step:
+//
+//	user -likes where at > 1500000000 limit 50-> post
+//	user <-!dislike- user
+//
+// The clauses are:
+//
+//	order by likes desc, id     sort the results, see Traversal.Order
+//	page 20 after "cursor"      return a page of results, see Traversal.Page
+//	select u, p                 return rows of the labelled steps, see Traversal.Select
+//	return path                 return the path to each result, "return distinct path" drops duplicate paths
+//	return count                aggregate the results, also count_distinct(prop), sum(prop), mean(prop),
+//	                            min(prop), max(prop) and group(prop) by op(prop), see Aggregation
+//
+// Errors in the query are returned as a *SyntaxError with the line and column of the error.
+func ParseQuery(src string) (*Traversal, error) {
+	return parseQuery(src, nil)
+}
+
+// parseQuery parses the query replacing each $parameter with its value.
+func parseQuery(src string, params map[string]interface{}) (*Traversal, error) {
+	p := &queryParser{parser: parser{lex: newLexer(src), params: params}}
+	p.next()
+
+	t, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return t, nil
+}
+
+// Query parses the query into a traversal of the graph, see ParseQuery.
+func (g *Graph) Query(src string) (*Traversal, error) {
+	t, err := ParseQuery(src)
+	if err != nil {
+		return nil, err
+	}
+
+	bind(t, g)
+	return t, nil
+}
+
+// queryParser parses the text query language, reusing the lexer and predicate parser of the filters.
+type queryParser struct {
+	parser
+}
+
+// query := step (hop step)* clause*
+func (p *queryParser) parseQuery() (*Traversal, error) {
+	if p.tok.kind != tokIdent || isQueryKeyword(p.tok.val) {
+		return nil, p.errorf("expected a node type but found %s", p.tok)
+	}
+
+	root := &Traversal{LimitBy: 100}
+	if err := p.parseStep(root); err != nil {
+		return nil, err
+	}
+
+	for t := root; p.tok.kind == tokDash || p.tok.kind == tokLArrow; {
+		next, err := p.parseHop(t)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.parseStep(next); err != nil {
+			return nil, err
+		}
+		t = next
+	}
+
+	for p.tok.kind != tokEOF {
+		if err := p.parseClause(root); err != nil {
+			return nil, err
+		}
+	}
+
+	if root.Aggregation != nil {
+		if err := root.Aggregation.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(root.Selects) > 0 {
+		if _, err := root.labels(); err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+// step := type? ("(" prop ("," prop)* ")")? ("as" label)? ("where" predicate)? ("limit" number)?
+func (p *queryParser) parseStep(t *Traversal) error {
+	if p.tok.kind == tokIdent && !isQueryKeyword(p.tok.val) {
+		t.NodeType = p.tok.val
+		p.next()
+	}
+
+	if p.tok.kind == tokLParen {
+		if err := p.parseProps(t); err != nil {
+			return err
+		}
+	}
+
+	if p.keyword("as") {
+		p.next()
+		if p.tok.kind != tokIdent || isQueryKeyword(p.tok.val) {
+			return p.errorf("expected a label but found %s", p.tok)
+		}
+		t.Label = p.tok.val
+		p.next()
+	}
+
+	if p.keyword("where") {
+		pred, err := p.parseWhere()
+		if err != nil {
+			return err
+		}
+		t.Filters = append(t.Filters, pred.String())
+		t.predicates = append(t.predicates, pred)
+	}
+
+	if p.keyword("limit") {
+		n, err := p.parseInt()
+		if err != nil {
+			return err
+		}
+
+		if t.root == nil {
+			t.LimitBy = n
+		} else {
+			t.first(n)
+		}
+	}
+	return nil
+}
+
+// first keeps the first n nodes at this step of the traversal.
+func (t *Traversal) first(n int) *Traversal {
+	return t.aggregate("limit", func(in <-chan *objects.Object) <-chan *objects.Object {
+		c := 0
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+			for o := range in {
+				c++
+				if c <= n {
+					out <- o
+				}
+			}
+		}()
+		return out
+	})
+}
+
+// props := "(" ident ":" value ("," ident ":" value)* ")"
+func (p *queryParser) parseProps(t *Traversal) error {
+	p.next()
+	for p.tok.kind != tokRParen {
+		if p.tok.kind != tokIdent {
+			return p.errorf("expected a property name but found %s", p.tok)
+		}
+		prop := p.tok.val
+		p.next()
+
+		if p.tok.kind != tokColon {
+			return p.errorf("expected : but found %s", p.tok)
+		}
+		p.next()
+
+		tok := p.tok
+		val, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+
+		if prop == "id" {
+			id, ok := val.(string)
+			if !ok {
+				return &SyntaxError{Line: tok.line, Column: tok.col, Msg: "the id must be a string"}
+			}
+			t.ID = id
+		} else {
+			src := fmt.Sprintf("%s == %s", prop, literal(val))
+			pred, err := ParsePredicate(src)
+			if err != nil {
+				return err
+			}
+			t.Filters = append(t.Filters, src)
+			t.predicates = append(t.predicates, pred)
+		}
+
+		if p.tok.kind == tokComma {
+			p.next()
+		} else if p.tok.kind != tokRParen {
+			return p.errorf("expected , or ) but found %s", p.tok)
+		}
+	}
+	p.next()
+	return nil
+}
+
+// hop := "-" edges "->" | "<-" edges "-" | "-" edges "-"
+// edges := ("!"? type ("|" type)*)? ("where" predicate)? ("limit" number)?
+func (p *queryParser) parseHop(t *Traversal) (*Traversal, error) {
+	in := p.tok.kind == tokLArrow
+	p.next()
+
+	except := false
+	if p.tok.kind == tokBang {
+		except = true
+		p.next()
+	}
+
+	types := []string{}
+	for p.tok.kind == tokIdent && !isQueryKeyword(p.tok.val) {
+		types = append(types, p.tok.val)
+		p.next()
+
+		if p.tok.kind != tokPipe {
+			break
+		}
+		p.next()
+	}
+
+	if except && len(types) == 0 {
+		return nil, p.errorf("expected an edge type after ! but found %s", p.tok)
+	}
+
+	var next *Traversal
+	if except {
+		next = t.relExcept(objects.Out, types)
+	} else {
+		next = t.rel(objects.Out, nil, types)
+	}
+	hop := t.Next
+
+	if p.keyword("where") {
+		pred, err := p.parseWhere()
+		if err != nil {
+			return nil, err
+		}
+		hop.Filter = pred.String()
+		hop.where = pred
+	}
+
+	if p.keyword("limit") {
+		n, err := p.parseInt()
+		if err != nil {
+			return nil, err
+		}
+		hop.LimitBy = n
+	}
+
+	switch {
+	case in && p.tok.kind == tokDash:
+		hop.Dir = objects.In
+	case !in && p.tok.kind == tokArrow:
+		hop.Dir = objects.Out
+	case !in && p.tok.kind == tokDash:
+		hop.Dir = objects.Both
+	case in:
+		return nil, p.errorf("expected - but found %s", p.tok)
+	default:
+		return nil, p.errorf("expected -> or - but found %s", p.tok)
+	}
+	p.next()
+	return next, nil
+}
+
+// parseWhere parses "where" followed by a predicate.
+func (p *queryParser) parseWhere() (Predicate, error) {
+	p.next()
+	return p.parseExpr()
+}
+
+// parseInt parses the keyword at the token followed by a positive integer.
+func (p *queryParser) parseInt() (int, error) {
+	word := p.tok.val
+	p.next()
+
+	tok := p.tok
+	if tok.kind == tokParam {
+		v, err := p.parseValue()
+		if err != nil {
+			return 0, err
+		}
+
+		if f, isNum := v.(float64); isNum && f == float64(int(f)) && f > 0 {
+			return int(f), nil
+		}
+		return 0, &SyntaxError{Line: tok.line, Column: tok.col, Msg: fmt.Sprintf("%s must be a positive integer", tok.val)}
+	}
+
+	n, err := strconv.Atoi(tok.val)
+	if tok.kind != tokNumber || err != nil || n <= 0 {
+		return 0, p.errorf("expected a positive integer after %s but found %s", word, p.tok)
+	}
+	p.next()
+	return n, nil
+}
+
+// clause := "order" "by" field ("asc" | "desc")? ("," field ("asc" | "desc")?)*
+//
+//	| "page" number ("after" string)?
+//	| "select" label ("," label)*
+//	| "return" ("path" | "distinct" "path" | aggregation)
+func (p *queryParser) parseClause(root *Traversal) error {
+	switch {
+	case p.keyword("order"):
+		p.next()
+		if !p.keyword("by") {
+			return p.errorf("expected by but found %s", p.tok)
+		}
+		p.next()
+
+		for {
+			if p.tok.kind != tokIdent {
+				return p.errorf("expected a property but found %s", p.tok)
+			}
+			o := Order{By: p.tok.val}
+			p.next()
+
+			if p.keyword("desc") || p.keyword("asc") {
+				o.Desc = p.tok.val == "desc"
+				p.next()
+			}
+			root.Orders = append(root.Orders, o)
+
+			if p.tok.kind != tokComma {
+				return nil
+			}
+			p.next()
+		}
+
+	case p.keyword("page"):
+		n, err := p.parseInt()
+		if err != nil {
+			return err
+		}
+		root.PageSize = n
+
+		if p.keyword("after") {
+			p.next()
+			if p.tok.kind != tokString && p.tok.kind != tokParam {
+				return p.errorf("expected a cursor but found %s", p.tok)
+			}
+
+			tok := p.tok
+			v, err := p.parseValue()
+			if err != nil {
+				return err
+			}
+
+			cursor, isString := v.(string)
+			if !isString {
+				return &SyntaxError{Line: tok.line, Column: tok.col, Msg: fmt.Sprintf("%s must be a string", tok.val)}
+			}
+			root.Cursor = cursor
+		}
+		return nil
+
+	case p.keyword("select"):
+		p.next()
+		for {
+			if p.tok.kind != tokIdent {
+				return p.errorf("expected a label but found %s", p.tok)
+			}
+			root.Selects = append(root.Selects, p.tok.val)
+			p.next()
+
+			if p.tok.kind != tokComma {
+				return nil
+			}
+			p.next()
+		}
+
+	case p.keyword("return"):
+		p.next()
+		if p.keyword("path") || p.keyword("distinct") {
+			distinct := p.keyword("distinct")
+			if distinct {
+				p.next()
+				if !p.keyword("path") {
+					return p.errorf("expected path but found %s", p.tok)
+				}
+			}
+			p.next()
+
+			root.Paths = &PathOptions{Distinct: distinct}
+			return nil
+		}
+
+		a, err := p.parseAggregation()
+		if err != nil {
+			return err
+		}
+
+		if a.Op == "group" && p.keyword("by") {
+			p.next()
+			if a.By, err = p.parseAggregation(); err != nil {
+				return err
+			}
+		}
+		root.Aggregation = a
+		return nil
+	}
+
+	return p.errorf("expected order, page, select or return but found %s", p.tok)
+}
+
+// aggregation := op ("(" property? ")")?
+func (p *queryParser) parseAggregation() (*Aggregation, error) {
+	if p.tok.kind != tokIdent {
+		return nil, p.errorf("expected an aggregation but found %s", p.tok)
+	}
+
+	tok := p.tok
+	a := &Aggregation{Op: tok.val}
+	p.next()
+
+	if p.tok.kind == tokLParen {
+		p.next()
+		if p.tok.kind == tokIdent {
+			a.Property = p.tok.val
+			p.next()
+		}
+
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ) but found %s", p.tok)
+		}
+		p.next()
+	}
+
+	if err := a.compile(); err != nil {
+		return nil, &SyntaxError{Line: tok.line, Column: tok.col, Msg: err.Error()}
+	}
+	return a, nil
+}
+
+func isQueryKeyword(s string) bool {
+	switch s {
+	case "as", "where", "limit", "order", "page", "select", "return":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package graph
+
+import (
+	"github.com/coldog/go-graph/objects"
+	"testing"
+)
+
+func TestQuery_Parse(t *testing.T) {
+	tr, err := ParseQuery(`user(id: "42") -follows-> user as u -posts|likes limit 50-> post where likes > 10 limit 20
+	  order by likes desc, id page 10 select u`)
+	ok(t, err)
+
+	equals(t, "user", tr.NodeType)
+	equals(t, "42", tr.ID)
+	equals(t, 100, tr.LimitBy)
+
+	follows := tr.Next
+	equals(t, []string{"follows"}, follows.Types)
+	equals(t, objects.Out, follows.Dir)
+	equals(t, "u", follows.Target.Label)
+
+	posts := follows.Target.Next
+	equals(t, []string{"posts", "likes"}, posts.Types)
+	equals(t, 50, posts.LimitBy)
+	equals(t, "post", posts.Target.NodeType)
+	equals(t, []string{"likes > 10"}, posts.Target.Filters)
+	equals(t, 1, len(posts.Target.filters))
+	equals(t, "limit", posts.Target.filters[0].name)
+	assert(t, posts.Target.Next == nil, "expected the last step")
+
+	equals(t, []Order{{By: "likes", Desc: true}, {By: "id"}}, tr.Orders)
+	equals(t, 10, tr.PageSize)
+	equals(t, []string{"u"}, tr.Selects)
+}
+
+func TestQuery_Hops(t *testing.T) {
+	tr, err := ParseQuery(`post(kind: "photo") <-likes where at > 5- user -!dislike- --> <-- user`)
+	ok(t, err)
+
+	equals(t, []string{`kind == "photo"`}, tr.Filters)
+	equals(t, objects.In, tr.Next.Dir)
+	equals(t, "at > 5", tr.Next.Filter)
+
+	both := tr.Next.Target.Next
+	equals(t, objects.Both, both.Dir)
+	equals(t, []string{"dislike"}, both.ExceptTypes)
+
+	out := both.Target.Next
+	equals(t, objects.Out, out.Dir)
+	equals(t, 0, len(out.Types))
+	equals(t, objects.In, out.Target.Next.Dir)
+	equals(t, "user", out.Target.Next.Target.NodeType)
+}
+
+func TestQuery_Return(t *testing.T) {
+	tr, err := ParseQuery(`user -posts-> post return group(kind) by sum(likes)`)
+	ok(t, err)
+	equals(t, &Aggregation{Op: "group", Property: "kind", By: &Aggregation{Op: "sum", Property: "likes"}}, tr.Aggregation)
+
+	tr, err = ParseQuery(`user return count`)
+	ok(t, err)
+	equals(t, "count", tr.Aggregation.Op)
+
+	tr, err = ParseQuery(`user -follows-> user return distinct path`)
+	ok(t, err)
+	equals(t, &PathOptions{Distinct: true}, tr.Paths)
+}
+
+func TestQuery_SyntaxErrors(t *testing.T) {
+	cases := map[string]SyntaxError{
+		``:                                  {Line: 1, Column: 1},
+		`-follows-> user`:                   {Line: 1, Column: 1},
+		`user -follows user`:                {Line: 1, Column: 15},
+		`user <-follows-> user`:             {Line: 1, Column: 15},
+		`user(id: 42)`:                      {Line: 1, Column: 10},
+		`user(id "42")`:                     {Line: 1, Column: 9},
+		`user where n >`:                    {Line: 1, Column: 15},
+		`user limit 0`:                      {Line: 1, Column: 12},
+		"user -follows-> user\n  sort by n": {Line: 2, Column: 3},
+		`user return median(n)`:             {Line: 1, Column: 13},
+		`user -!-> post`:                    {Line: 1, Column: 8},
+	}
+
+	for src, exp := range cases {
+		_, err := ParseQuery(src)
+		serr, isSyntax := err.(*SyntaxError)
+		assert(t, isSyntax, "%s: expected a syntax error got %v", src, err)
+		equals(t, exp.Line, serr.Line)
+		equals(t, exp.Column, serr.Column)
+	}
+
+	_, err := ParseQuery(`user as u select p`)
+	assert(t, err != nil, "expected an error selecting an unknown label")
+}
+
+func TestQuery_Params(t *testing.T) {
+	q := &StoredQuery{
+		Name:   "posts",
+		Query:  `user(id: $id) -posts-> post where kind in $kinds limit $limit`,
+		Params: map[string]string{"id": "string", "kinds": "list", "limit": "integer"},
+	}
+	ok(t, q.check())
+
+	tr, err := q.Bind(map[string]interface{}{"id": "42", "kinds": []interface{}{"photo"}, "limit": int64(5)})
+	ok(t, err)
+	equals(t, "42", tr.ID)
+	equals(t, []string{`kind in ["photo"]`}, tr.Next.Target.Filters)
+
+	cases := []map[string]interface{}{
+		{"id": "42", "kinds": []interface{}{}},
+		{"id": "42", "kinds": []interface{}{}, "limit": 1.5},
+		{"id": 42, "kinds": []interface{}{}, "limit": 1},
+		{"id": "42", "kinds": []interface{}{}, "limit": 1, "other": 1},
+	}
+	for _, params := range cases {
+		_, err := q.Bind(params)
+		_, isParam := err.(*ParamError)
+		assert(t, isParam, "%v: expected a param error got %v", params, err)
+	}
+
+	_, err = ParseQuery(`user(id: $id)`)
+	_, isSyntax := err.(*SyntaxError)
+	assert(t, isSyntax, "expected a syntax error got %v", err)
+}
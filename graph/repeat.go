@@ -0,0 +1,259 @@
+package graph
+
+import (
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
+)
+
+// defaultMaxDepth is the depth a repeat is limited to when no max depth is given.
+const defaultMaxDepth = 10
+
+// Repeat follows the body of the repeat any number of times, see Traversal.Repeat.
+type Repeat struct {
+	// Body is the traversal followed on each iteration, starting from the nodes found by the previous iteration.
+	Body *Traversal `json:"body"`
+
+	// Times is the number of iterations, the nodes found on the last iteration are emitted.
+	Times int `json:"times,omitempty"`
+
+	// Until is a predicate on the body of the nodes found. Matching nodes are emitted and not followed further.
+	Until string `json:"until,omitempty"`
+
+	// Emit emits the nodes found on every iteration.
+	Emit bool `json:"emit,omitempty"`
+
+	// MaxDepth limits the number of iterations, defaulting to 10.
+	MaxDepth int `json:"max_depth,omitempty"`
+
+	until Predicate
+}
+
+// compile parses the until predicate and checks the repeat will stop.
+func (r *Repeat) compile() error {
+	if r.Body == nil {
+		return invalidf("repeat must have a body")
+	}
+
+	if r.Times < 0 || r.MaxDepth < 0 {
+		return invalidf("repeat times and max depth cannot be negative")
+	}
+
+	if r.Times == 0 && r.Until == "" && !r.Emit {
+		return invalidf("repeat must have times, until or emit")
+	}
+
+	if r.Until != "" && r.until == nil {
+		pred, err := ParsePredicate(r.Until)
+		if err != nil {
+			return err
+		}
+		r.until = pred
+	}
+
+	if _, err := r.depth(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// depth returns the number of iterations to run.
+func (r *Repeat) depth() (int, error) {
+	max := r.MaxDepth
+	if max == 0 {
+		max = defaultMaxDepth
+	}
+
+	if r.Times > max {
+		return 0, invalidf("repeat times %d exceeds the max depth %d", r.Times, max)
+	}
+
+	if r.Times > 0 {
+		return r.Times, nil
+	}
+	return max, nil
+}
+
+// Sub returns an anonymous traversal to use as the body of a repeat, an optional step or a branch of a coalesce,
+// eg: Sub().Out("follows").
+func Sub() *Traversal {
+	return &Traversal{LimitBy: 2000}
+}
+
+// Repeat follows the body traversal from the nodes at this step any number of times, returning the next step of
+// the traversal. How often the body is followed is set with Times, Until, Emit and MaxDepth:
+//
+//	g.Traversal().Is("user").Has("id", "1").Repeat(graph.Sub().Out("follows")).Times(3)
+//
+// A node is never followed twice, so Times(n) finds the nodes whose shortest distance is n iterations. When the
+// traversal returns paths a node is only skipped when it is already on its own path.
+func (t *Traversal) Repeat(body *Traversal) *Traversal {
+	var root *Traversal
+	if t.root == nil {
+		root = t
+	} else {
+		root = t.root
+	}
+
+	if body.root != nil {
+		body = body.root
+	}
+
+	t.Next = &TraversalPath{
+		Target:  &Traversal{LimitBy: 2000, G: t.G, root: root},
+		Repeat:  &Repeat{Body: body},
+		LimitBy: 2000,
+	}
+	t.Next.Target.via = t.Next
+	return t.Next.Target
+}
+
+// Times follows the body of the repeat leading to this step n times.
+func (t *Traversal) Times(n int) *Traversal {
+	t.repeat().Times = n
+	return t
+}
+
+// Until follows the body of the repeat leading to this step until the nodes found match the predicate expression.
+// The expression is parsed when the traversal is run, which returns its *SyntaxError.
+func (t *Traversal) Until(expr string) *Traversal {
+	r := t.repeat()
+	r.Until = expr
+	r.until = nil
+	return t
+}
+
+// Emit returns the nodes found by every iteration of the repeat leading to this step.
+func (t *Traversal) Emit() *Traversal {
+	t.repeat().Emit = true
+	return t
+}
+
+// MaxDepth limits the iterations of the repeat leading to this step.
+func (t *Traversal) MaxDepth(n int) *Traversal {
+	t.repeat().MaxDepth = n
+	return t
+}
+
+func (t *Traversal) repeat() *Repeat {
+	if t.via == nil || t.via.Repeat == nil {
+		panic("times, until, emit and max depth must follow a repeat")
+	}
+	return t.via.Repeat
+}
+
+// planRepeat adds the step running a repeat. The body is planned into a child pipeline which is run once for each
+// iteration.
+func planRepeat(p *Pipeline, g *Graph, r *Repeat, level int) error {
+	if err := r.compile(); err != nil {
+		return err
+	}
+
+	depth, err := r.depth()
+	if err != nil {
+		return err
+	}
+
+	bind(r.Body, g)
+	if r.Body.returnsEdges() {
+		return invalidf("the body of a repeat cannot return edges")
+	}
+
+	cp := p.child()
+	if err := planFrom(cp, g, r.Body, level, false); err != nil {
+		return err
+	}
+
+	filters := []string{}
+	if r.Until != "" {
+		filters = append(filters, r.Until)
+	}
+
+	body := cp.compose()
+	p.add(&StepInfo{Step: "repeat", Level: level, Limit: depth, Filters: filters, Body: cp.Explain()}, func(st *StepStats) Step {
+		return repeat(p, st, g.store, r, depth, body)
+	})
+	return nil
+}
+
+// repeat returns the step following the body of a repeat breadth first from the incoming nodes.
+func repeat(p *Pipeline, st *StepStats, s store.Store, r *Repeat, depth int, body Step) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+
+			visited := map[string]bool{}
+			frontier := []*objects.Object{}
+			for o := range in {
+				visited[o.Key] = true
+				frontier = append(frontier, o)
+			}
+
+			for d := 1; d <= depth && len(frontier) > 0 && p.ctx.Err() == nil; d++ {
+				next := []*objects.Object{}
+				for o := range body(feed(frontier)) {
+					if cyclic(o, visited) {
+						continue
+					}
+					visited[o.Key] = true
+
+					if r.until != nil {
+						if o.Val == nil {
+							obj, err := p.get(st, s, o.Key)
+							if err != nil {
+								p.Fail(err)
+								continue
+							}
+
+							if obj != nil {
+								o.Val = obj.Val
+							}
+						}
+
+						if r.until.Match(o.Val) {
+							out <- o
+							continue
+						}
+					}
+
+					if r.Emit || d == r.Times {
+						out <- o
+					}
+
+					if d != r.Times {
+						next = append(next, o)
+					}
+				}
+				frontier = next
+			}
+		}()
+		return out
+	}
+}
+
+// cyclic returns true when following the node would revisit a node. With paths a node is only revisited when it is
+// already on its own path, otherwise when it was found before.
+func cyclic(o *objects.Object, visited map[string]bool) bool {
+	if o.Path == nil {
+		return visited[o.Key]
+	}
+
+	for _, prev := range o.Path[:len(o.Path)-1] {
+		if prev.Key == o.Key {
+			return true
+		}
+	}
+	return false
+}
+
+// feed returns a channel sending the objects.
+func feed(objs []*objects.Object) <-chan *objects.Object {
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+		for _, o := range objs {
+			out <- o
+		}
+	}()
+	return out
+}
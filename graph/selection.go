@@ -0,0 +1,125 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+)
+
+// Row is a result of a traversal selecting labelled steps, holding the node or edge found at each of the steps.
+type Row map[string]*objects.Object
+
+// As labels the nodes at this step of the traversal so they can be selected, see Select.
+func (t *Traversal) As(label string) *Traversal {
+	t.Label = label
+	return t
+}
+
+// Select returns the nodes at the labelled steps of the traversal as rows, one row for each path found by the
+// traversal. Use Graph.Select or Traversal.Rows to run the traversal.
+func (t *Traversal) Select(labels ...string) *Traversal {
+	if t.root == nil {
+		t.Selects = labels
+	} else {
+		t.root.Selects = labels
+	}
+	return t
+}
+
+// Rows runs the traversal returning the selected rows.
+func (t *Traversal) Rows(ctx context.Context) ([]Row, error) {
+	var root *Traversal
+	if t.root == nil {
+		root = t
+	} else {
+		root = t.root
+	}
+	return t.G.Select(ctx, root)
+}
+
+// Select runs the traversal returning the rows selected by the traversal.
+func (g *Graph) Select(ctx context.Context, t *Traversal) ([]Row, error) {
+	if _, err := t.labels(); err != nil {
+		return nil, err
+	}
+
+	res, err := g.Run(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return Rows(t, res)
+}
+
+// Rows returns the rows selected by the traversal from its results.
+func Rows(t *Traversal, res []*objects.Object) ([]Row, error) {
+	positions, err := t.labels()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []Row{}
+	for _, o := range res {
+		row := Row{}
+		for _, label := range t.Selects {
+			i := positions[label]
+			if i >= len(o.Path) {
+				return nil, fmt.Errorf("select %s: result has no path", label)
+			}
+
+			row[label] = &objects.Object{Key: o.Path[i].Key, Val: o.Path[i].Val, Matches: o.Path[i].Matches}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// labels returns the position in the result paths of each labelled step of the traversal, checking labels are
+// unique and that every selected label exists. A hop adds an edge and a node to the paths, a hop returning edges
+// or following them to the other node only adds one.
+func (t *Traversal) labels() (map[string]int, error) {
+	if t.hasSets() {
+		return nil, invalidf("labels cannot be selected from a traversal with set operations")
+	}
+
+	levels := map[string]int{}
+	repeated := false
+	for i, l := 0, t; l != nil; {
+		if l.Label != "" {
+			if repeated {
+				return nil, invalidf("label %s follows a repeat or coalesce and cannot be selected", l.Label)
+			}
+
+			if _, ok := levels[l.Label]; ok {
+				return nil, invalidf("label %s is used more than once", l.Label)
+			}
+			levels[l.Label] = i
+		}
+
+		if l.Next == nil {
+			break
+		}
+
+		repeated = repeated || l.Next.Repeat != nil || len(l.Next.Coalesce) > 0
+		if l.Next.Edges || l.Next.Other {
+			i++
+		} else {
+			i += 2
+		}
+		l = l.Next.Target
+	}
+
+	for _, label := range t.Selects {
+		if _, ok := levels[label]; !ok {
+			return nil, invalidf("select %s: no step is labelled %s", label, label)
+		}
+	}
+	return levels, nil
+}
+
+// pathsFor returns the path options of a traversal. Paths are tracked when the traversal selects labels.
+func pathsFor(t *Traversal) *PathOptions {
+	if t.Paths == nil && len(t.Selects) > 0 {
+		return &PathOptions{}
+	}
+	return t.Paths
+}
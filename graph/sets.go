@@ -0,0 +1,158 @@
+package graph
+
+import (
+	"github.com/coldog/go-graph/objects"
+)
+
+// Union adds the results of the other traversals to the results of the traversal, keeping one result per node key.
+// Set operations apply to the whole traversal, before any order or aggregation: unions first, then intersections
+// and then exceptions.
+func (t *Traversal) Union(others ...*Traversal) *Traversal {
+	root := t.top()
+	root.Unions = append(root.Unions, tops(others)...)
+	return t
+}
+
+// Intersect keeps the results of the traversal whose node key is also found by every other traversal.
+func (t *Traversal) Intersect(others ...*Traversal) *Traversal {
+	root := t.top()
+	root.Intersects = append(root.Intersects, tops(others)...)
+	return t
+}
+
+// Except drops the results of the traversal whose node key is found by any of the other traversals, eg: posts liked
+// by the people a user follows except the posts the user liked.
+func (t *Traversal) Except(others ...*Traversal) *Traversal {
+	root := t.top()
+	root.Excepts = append(root.Excepts, tops(others)...)
+	return t
+}
+
+// top returns the root of the traversal.
+func (t *Traversal) top() *Traversal {
+	if t.root == nil {
+		return t
+	}
+	return t.root
+}
+
+func tops(list []*Traversal) []*Traversal {
+	res := []*Traversal{}
+	for _, t := range list {
+		res = append(res, t.top())
+	}
+	return res
+}
+
+// hasSets returns true when the traversal has set operations.
+func (t *Traversal) hasSets() bool {
+	return len(t.Unions) > 0 || len(t.Intersects) > 0 || len(t.Excepts) > 0
+}
+
+// planSets adds a step for each of the set operations of the traversal. Each other traversal is planned into a
+// child pipeline run by the step.
+func planSets(p *Pipeline, g *Graph, t *Traversal) error {
+	ops := []struct {
+		name  string
+		list  []*Traversal
+		build func(p *Pipeline, sub Step) Step
+	}{
+		{"union", t.Unions, union},
+		{"intersect", t.Intersects, intersect},
+		{"except", t.Excepts, except},
+	}
+
+	for _, op := range ops {
+		for _, other := range op.list {
+			if other.Aggregation != nil || other.PageSize > 0 || other.Cursor != "" {
+				return invalidf("%s traversals cannot be aggregated or paged", op.name)
+			}
+
+			bind(other, g)
+
+			cp := p.child()
+			if err := planFrom(cp, g, other, 0, true); err != nil {
+				return err
+			}
+
+			if err := planSets(cp, g, other); err != nil {
+				return err
+			}
+
+			sub := cp.compose()
+			build := op.build
+			p.add(&StepInfo{Step: op.name, Body: cp.Explain()}, func(*StepStats) Step { return build(p, sub) })
+		}
+	}
+	return nil
+}
+
+// bind sets the graph of every level of a traversal built without one, such as the body of a repeat.
+func bind(t *Traversal, g *Graph) {
+	for l := t; l != nil; {
+		if l.G == nil {
+			l.G = g
+		}
+
+		if l.Next == nil {
+			break
+		}
+		l = l.Next.Target
+	}
+}
+
+// union returns the step sending on the incoming objects and then the results of the sub pipeline, once per key.
+func union(p *Pipeline, sub Step) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+
+			seen := map[string]bool{}
+			for _, ch := range []<-chan *objects.Object{in, sub(nil)} {
+				for o := range ch {
+					if seen[o.Key] {
+						continue
+					}
+
+					seen[o.Key] = true
+					out <- o
+				}
+			}
+		}()
+		return out
+	}
+}
+
+// intersect returns the step keeping the incoming objects whose key is found by the sub pipeline.
+func intersect(p *Pipeline, sub Step) Step {
+	return filterKeys(sub, true)
+}
+
+// except returns the step dropping the incoming objects whose key is found by the sub pipeline.
+func except(p *Pipeline, sub Step) Step {
+	return filterKeys(sub, false)
+}
+
+// filterKeys returns a step running the sub pipeline to completion and then passing along the incoming objects
+// whose key was found or not found by it.
+func filterKeys(sub Step, found bool) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+
+			keys := map[string]bool{}
+			for o := range sub(nil) {
+				keys[o.Key] = true
+			}
+
+			for o := range in {
+				if keys[o.Key] == found {
+					out <- o
+				}
+			}
+		}()
+		return out
+	}
+}
@@ -0,0 +1,364 @@
+package graph
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"log"
+	"strings"
+	"time"
+)
+
+// maxSearchFrontier bounds the nodes waiting to be visited by a shortest path search when the budget does not.
+const maxSearchFrontier = 100000
+
+// ShortestPathOptions configure the search for the shortest paths between two nodes.
+type ShortestPathOptions struct {
+	// Types are the edge types followed, all edges are followed when empty.
+	Types []string `json:"types,omitempty"`
+
+	// Dir is the direction edges are followed in from the source.
+	Dir objects.Direction `json:"direction"`
+
+	// MaxDepth limits the number of edges in a path, defaulting to 10.
+	MaxDepth int `json:"max_depth,omitempty"`
+
+	// Weight is the property of the edge body holding the cost of following the edge, nested properties are reached
+	// with dots. Every edge followed must hold a non-negative number. Without a weight every edge costs 1.
+	Weight string `json:"weight,omitempty"`
+
+	// K is the number of paths returned, defaulting to 1.
+	K int `json:"k,omitempty"`
+
+	// LimitBy limits the edges followed from each node, defaulting to 2000.
+	LimitBy int `json:"limit,omitempty"`
+}
+
+// Path is a path found between two nodes, alternating between nodes and edges from the source to the target.
+type Path struct {
+	Objects []*objects.Object `json:"objects"`
+	Cost    float64           `json:"cost"`
+}
+
+// ShortestPath returns the k shortest paths from the source to the target node, shortest first. Paths never visit
+// a node twice and no paths are returned when the target cannot be reached within the max depth.
+//
+// Unweighted searches for a single path run a breadth first search from both ends at once, otherwise paths are
+// found in order of cost as with Dijkstra's algorithm. Searches are limited by the budget of the graph, and the
+// nodes waiting to be visited to 100000 when the budget has no frontier limit.
+func (g *Graph) ShortestPath(ctx context.Context, source, target string, opts ShortestPathOptions) ([]*Path, error) {
+	if opts.MaxDepth < 0 || opts.K < 0 || opts.LimitBy < 0 {
+		return nil, fmt.Errorf("max depth, k and limit cannot be negative")
+	}
+
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = defaultMaxDepth
+	}
+	if opts.K == 0 {
+		opts.K = 1
+	}
+	if opts.LimitBy == 0 {
+		opts.LimitBy = 2000
+	}
+
+	for _, key := range []string{source, target} {
+		o := &objects.Object{Key: key}
+		if !o.IsNode() || !strings.Contains(key, objects.NodeSep) {
+			return nil, fmt.Errorf("%s is not a node key", key)
+		}
+
+		obj, err := g.store.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		} else if obj == nil {
+			return nil, fmt.Errorf("node %s does not exist", key)
+		}
+	}
+
+	g.lock.RLock()
+	budget := g.budget
+	g.lock.RUnlock()
+
+	parent := ctx
+	if budget.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget.Timeout)
+		defer cancel()
+	}
+
+	s := &search{g: g, ctx: ctx, budget: budget, opts: opts}
+
+	t1 := time.Now()
+	var paths []*Path
+	var err error
+	if opts.Weight == "" && opts.K == 1 {
+		paths, err = s.bidirectional(source, target)
+	} else {
+		paths, err = s.bestFirst(source, target)
+	}
+
+	if err == context.DeadlineExceeded && parent.Err() == nil {
+		err = &BudgetError{Limit: "timeout", Max: budget.Timeout.String()}
+	}
+
+	if err != nil {
+		log.Printf("[INFO] graph: shortest path from %s to %s failed after %v: %v", source, target, time.Since(t1), err)
+		return nil, err
+	}
+
+	log.Printf("[INFO] graph: shortest path from %s to %s took %v scanning %d keys", source, target, time.Since(t1), s.scanned)
+	return paths, nil
+}
+
+// search holds the state of a shortest path search.
+type search struct {
+	g       *Graph
+	ctx     context.Context
+	budget  Budget
+	opts    ShortestPathOptions
+	scanned int64
+}
+
+// edges returns the edges followed from the node in the direction.
+func (s *search) edges(key string, dir objects.Direction) ([]*objects.Object, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tp := &TraversalPath{Types: s.opts.Types, Dir: dir}
+
+	edges := []*objects.Object{}
+	for _, prefix := range edgePrefixes(tp, concat(key, objects.PathSep)) {
+		res, errc := s.g.store.Prefix(s.ctx, prefix, s.opts.LimitBy)
+		for o := range res {
+			s.scanned++
+			edges = append(edges, o)
+		}
+
+		if err := <-errc; err != nil {
+			return nil, err
+		}
+
+		if max := s.budget.MaxScanned; max > 0 && s.scanned > max {
+			return nil, &BudgetError{Limit: "scanned", Max: fmt.Sprint(max)}
+		}
+	}
+	return edges, nil
+}
+
+// frontier checks the number of nodes waiting to be visited against the budget, or maxSearchFrontier without one.
+func (s *search) frontier(n int) error {
+	max := s.budget.MaxFrontier
+	if max <= 0 {
+		max = maxSearchFrontier
+	}
+
+	if int64(n) > max {
+		return &BudgetError{Limit: "frontier", Max: fmt.Sprint(max)}
+	}
+	return nil
+}
+
+// weight returns the cost of following the edge.
+func (s *search) weight(o *objects.Object) (float64, error) {
+	if s.opts.Weight == "" {
+		return 1, nil
+	}
+
+	v, ok := lookup(o.Val, s.opts.Weight)
+	if !ok {
+		return 0, fmt.Errorf("edge %s has no weight %s", o.Edge().ResourceID(), s.opts.Weight)
+	}
+
+	w, ok := toFloat(v)
+	if !ok {
+		return 0, fmt.Errorf("edge %s has a weight %s of %s which is not a number", o.Edge().ResourceID(), s.opts.Weight, literal(v))
+	} else if w < 0 {
+		return 0, fmt.Errorf("edge %s has a negative weight %s of %v", o.Edge().ResourceID(), s.opts.Weight, w)
+	}
+	return w, nil
+}
+
+// other returns the key of the node at the other end of the edge.
+func other(o *objects.Object) string {
+	e := o.Edge()
+	if string(o.Key[0]) == objects.ForwardEdgeKey {
+		return e.Target
+	}
+	return e.Source
+}
+
+// reverse returns the direction walking an edge back towards where it was followed from.
+func reverse(dir objects.Direction) objects.Direction {
+	switch dir {
+	case objects.Out:
+		return objects.In
+	case objects.In:
+		return objects.Out
+	}
+	return dir
+}
+
+// visit is how a breadth first search reached a node.
+type visit struct {
+	from  string
+	edge  *objects.Object
+	depth int
+}
+
+// bidirectional runs a breadth first search from both the source and the target, expanding the smaller frontier a
+// level at a time until the searches meet.
+func (s *search) bidirectional(source, target string) ([]*Path, error) {
+	if source == target {
+		return []*Path{{Objects: []*objects.Object{{Key: source}}}}, nil
+	}
+
+	fwd := map[string]*visit{source: {}}
+	bwd := map[string]*visit{target: {}}
+	fwdFrontier, bwdFrontier := []string{source}, []string{target}
+	fwdDepth, bwdDepth := 0, 0
+
+	for fwdDepth+bwdDepth < s.opts.MaxDepth && len(fwdFrontier) > 0 && len(bwdFrontier) > 0 {
+		forward := len(fwdFrontier) <= len(bwdFrontier)
+
+		seen, others, frontier, depth, dir := fwd, bwd, fwdFrontier, fwdDepth, s.opts.Dir
+		if !forward {
+			seen, others, frontier, depth, dir = bwd, fwd, bwdFrontier, bwdDepth, reverse(s.opts.Dir)
+		}
+
+		next := []string{}
+		meet, best := "", 0
+		for _, key := range frontier {
+			edges, err := s.edges(key, dir)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, o := range edges {
+				n := other(o)
+				if _, ok := seen[n]; ok {
+					continue
+				}
+
+				seen[n] = &visit{from: key, edge: o, depth: depth + 1}
+				next = append(next, n)
+
+				if v, ok := others[n]; ok && (meet == "" || depth+1+v.depth < best) {
+					meet, best = n, depth+1+v.depth
+				}
+			}
+		}
+
+		if meet != "" {
+			return []*Path{joinVisits(fwd, bwd, meet)}, nil
+		}
+
+		if err := s.frontier(len(next)); err != nil {
+			return nil, err
+		}
+
+		if forward {
+			fwdFrontier, fwdDepth = next, fwdDepth+1
+		} else {
+			bwdFrontier, bwdDepth = next, bwdDepth+1
+		}
+	}
+	return []*Path{}, nil
+}
+
+// joinVisits returns the path through the node where the searches from the source and the target met.
+func joinVisits(fwd, bwd map[string]*visit, meet string) *Path {
+	objs := []*objects.Object{{Key: meet}}
+	for key := meet; fwd[key].edge != nil; key = fwd[key].from {
+		objs = append([]*objects.Object{{Key: fwd[key].from}, fwd[key].edge}, objs...)
+	}
+
+	for key := meet; bwd[key].edge != nil; key = bwd[key].from {
+		objs = append(objs, bwd[key].edge, &objects.Object{Key: bwd[key].from})
+	}
+	return &Path{Objects: objs, Cost: float64(len(objs) / 2)}
+}
+
+// bestFirst visits paths from the source in order of cost, returning the first k paths reaching the target. Each node
+// is expanded at most k times, by its k cheapest paths, so for a single path each node is only visited once as in
+// Dijkstra's algorithm.
+func (s *search) bestFirst(source, target string) ([]*Path, error) {
+	found := []*Path{}
+	expanded := map[string]int{}
+
+	queue := &routes{{key: source, path: []*objects.Object{{Key: source}}}}
+	for queue.Len() > 0 && len(found) < s.opts.K {
+		r := heap.Pop(queue).(*route)
+		if r.key == target {
+			found = append(found, &Path{Objects: r.path, Cost: r.cost})
+			continue
+		}
+
+		if expanded[r.key] >= s.opts.K {
+			continue
+		}
+		expanded[r.key]++
+
+		if len(r.path)/2 >= s.opts.MaxDepth {
+			continue
+		}
+
+		edges, err := s.edges(r.key, s.opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, o := range edges {
+			n := other(o)
+			if expanded[n] >= s.opts.K || onPath(r.path, n) {
+				continue
+			}
+
+			w, err := s.weight(o)
+			if err != nil {
+				return nil, err
+			}
+
+			path := extend(extend(r.path, o), &objects.Object{Key: n})
+			heap.Push(queue, &route{key: n, cost: r.cost + w, path: path})
+		}
+
+		if err := s.frontier(queue.Len()); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// onPath returns true when the node is on the path.
+func onPath(path []*objects.Object, key string) bool {
+	for i := 0; i < len(path); i += 2 {
+		if path[i].Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// route is a path from the source waiting to be visited.
+type route struct {
+	key  string
+	cost float64
+	path []*objects.Object
+}
+
+// routes is a priority queue of routes ordered by cost, see container/heap.
+type routes []*route
+
+func (r routes) Len() int            { return len(r) }
+func (r routes) Less(i, j int) bool  { return r[i].cost < r[j].cost }
+func (r routes) Swap(i, j int)       { r[i], r[j] = r[j], r[i] }
+func (r *routes) Push(x interface{}) { *r = append(*r, x.(*route)) }
+
+func (r *routes) Pop() interface{} {
+	old := *r
+	n := old[len(old)-1]
+	*r = old[:len(old)-1]
+	return n
+}
@@ -0,0 +1,227 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
+	"log"
+	"math"
+	"regexp"
+	"time"
+)
+
+// storedQueryPrefix is the prefix of the keys of stored queries in the system store.
+const storedQueryPrefix = "query_"
+
+// maxStoredQueries limits the stored queries listed.
+const maxStoredQueries = 10000
+
+var queryName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// placeholders are the values each type of parameter is checked with when a query is stored.
+var placeholders = map[string]interface{}{
+	"string":  "",
+	"number":  1.0,
+	"integer": 1.0,
+	"boolean": true,
+	"list":    []interface{}{},
+}
+
+// StoredQuery is a query in the text query language stored under a name, see ParseQuery. The query is a template
+// with $parameters wherever a value or a limit can be written:
+//
+//	user(id: $userId) -follows-> user -posts-> post where likes > $minLikes limit $limit
+//
+// Params declares the type of each parameter: string, number, integer, boolean or list.
+type StoredQuery struct {
+	Name    string            `json:"name"`
+	Query   string            `json:"query"`
+	Params  map[string]string `json:"params,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+// ParamError is returned when a stored query declares an unknown parameter type, or is run with parameters which
+// are missing, undeclared or of the wrong type.
+type ParamError struct {
+	Param string `json:"param"`
+	Msg   string `json:"message"`
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("parameter %s: %s", e.Param, e.Msg)
+}
+
+// check parses the query with a placeholder for each parameter, so a stored query can always be run once it is
+// given parameters of the declared types.
+func (q *StoredQuery) check() error {
+	if !queryName.MatchString(q.Name) {
+		return fmt.Errorf("invalid query name %q", q.Name)
+	}
+
+	vals := map[string]interface{}{}
+	for name, typ := range q.Params {
+		v, ok := placeholders[typ]
+		if !ok {
+			return &ParamError{Param: name, Msg: "unknown type " + typ}
+		}
+		vals[name] = v
+	}
+
+	_, err := parseQuery(q.Query, vals)
+	return err
+}
+
+// Bind returns the traversal of the query with the values of the parameters. Every declared parameter must be
+// given and numbers may be any Go numeric type.
+func (q *StoredQuery) Bind(params map[string]interface{}) (*Traversal, error) {
+	vals := map[string]interface{}{}
+	for name, v := range params {
+		typ, ok := q.Params[name]
+		if !ok {
+			return nil, &ParamError{Param: name, Msg: "not a parameter of query " + q.Name}
+		}
+
+		val, ok := convert(typ, v)
+		if !ok {
+			return nil, &ParamError{Param: name, Msg: fmt.Sprintf("expected a %s but found %s", typ, literal(v))}
+		}
+		vals[name] = val
+	}
+
+	for name := range q.Params {
+		if _, ok := vals[name]; !ok {
+			return nil, &ParamError{Param: name, Msg: "missing"}
+		}
+	}
+	return parseQuery(q.Query, vals)
+}
+
+// convert returns the value of a parameter of the type as it is held by a parsed query.
+func convert(typ string, v interface{}) (interface{}, bool) {
+	switch typ {
+	case "string":
+		_, ok := v.(string)
+		return v, ok
+	case "number":
+		return toFloat(v)
+	case "integer":
+		f, ok := toFloat(v)
+		return f, ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return v, ok
+	case "list":
+		_, ok := v.([]interface{})
+		return v, ok
+	}
+	return nil, false
+}
+
+// system returns the store keeping the records of the graph itself.
+func (g *Graph) system() (store.Store, error) {
+	s, ok := g.store.(store.SystemStore)
+	if !ok {
+		return nil, fmt.Errorf("the store does not support stored queries")
+	}
+	return s.System(), nil
+}
+
+// PutQuery stores the query, replacing any query stored under the same name. The query is checked first, returning
+// a *SyntaxError or *ParamError when it cannot be run.
+func (g *Graph) PutQuery(ctx context.Context, q *StoredQuery) error {
+	if err := q.check(); err != nil {
+		return err
+	}
+
+	sys, err := g.system()
+	if err != nil {
+		return err
+	}
+
+	if q.Created.IsZero() {
+		q.Created = time.Now().UTC()
+	}
+
+	val, err := toBody(q)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] graph: storing query %s: %s", q.Name, q.Query)
+	return sys.Put(ctx, &objects.Object{Key: storedQueryPrefix + q.Name, Val: val})
+}
+
+// GetQuery returns the query stored under the name or nil.
+func (g *Graph) GetQuery(ctx context.Context, name string) (*StoredQuery, error) {
+	sys, err := g.system()
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := sys.Get(ctx, storedQueryPrefix+name)
+	if err != nil || o == nil {
+		return nil, err
+	}
+	return decodeQuery(o)
+}
+
+// Queries returns every stored query sorted by name.
+func (g *Graph) Queries(ctx context.Context) ([]*StoredQuery, error) {
+	sys, err := g.system()
+	if err != nil {
+		return nil, err
+	}
+
+	res, errc := sys.Prefix(ctx, storedQueryPrefix, maxStoredQueries)
+
+	list := []*StoredQuery{}
+	for o := range res {
+		q, err := decodeQuery(o)
+		if err != nil {
+			for range res {
+			}
+			<-errc
+			return nil, err
+		}
+		list = append(list, q)
+	}
+	return list, <-errc
+}
+
+// DeleteQuery removes the query stored under the name.
+func (g *Graph) DeleteQuery(ctx context.Context, name string) error {
+	sys, err := g.system()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] graph: deleting stored query %s", name)
+	return sys.Del(ctx, &objects.Object{Key: storedQueryPrefix + name})
+}
+
+// Stored returns the traversal of the query stored under the name with the parameters, or nil when there is no
+// such query. Each call is logged so the stored queries being run can be audited.
+func (g *Graph) Stored(ctx context.Context, name string, params map[string]interface{}) (*Traversal, error) {
+	q, err := g.GetQuery(ctx, name)
+	if err != nil || q == nil {
+		return nil, err
+	}
+
+	t, err := q.Bind(params)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO] graph: running stored query %s with %s", name, literal(params))
+	bind(t, g)
+	return t, nil
+}
+
+func decodeQuery(o *objects.Object) (*StoredQuery, error) {
+	q := &StoredQuery{}
+	if err := fromBody(o.Val, q); err != nil {
+		return nil, fmt.Errorf("stored query %s: %v", o.Key, err)
+	}
+	return q, nil
+}
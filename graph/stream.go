@@ -0,0 +1,39 @@
+package graph
+
+import (
+	"context"
+	"github.com/coldog/go-graph/objects"
+	"time"
+)
+
+// StreamStats summarise a streamed traversal once it has finished. Cursor is the cursor of the next page of a paged
+// traversal and Value the aggregate of an aggregated traversal, which streams no results.
+type StreamStats struct {
+	Results int           `json:"results"`
+	Steps   int           `json:"steps"`
+	Time    time.Duration `json:"time_ns"`
+	Cursor  string        `json:"cursor,omitempty"`
+	Value   interface{}   `json:"value,omitempty"`
+}
+
+// Stream runs the traversal like Run but calls f with each result as soon as the last step sends it, rather than
+// holding every result in memory. An error returned by f stops the traversal and is returned. Ordered and paged
+// traversals still sort every result before sending the first.
+func (g *Graph) Stream(ctx context.Context, t *Traversal, f func(o *objects.Object) error) (*StreamStats, error) {
+	start := time.Now()
+	stats := &StreamStats{}
+
+	p, err := g.each(ctx, t, false, func(o *objects.Object) error {
+		stats.Results++
+		return f(o)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Steps = len(p.steps)
+	stats.Time = time.Since(start)
+	stats.Cursor = p.cursor
+	stats.Value = p.value
+	return stats, nil
+}
@@ -1,6 +1,8 @@
 package graph
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/coldog/go-graph/objects"
 	"log"
 )
@@ -8,13 +10,69 @@ import (
 type NodeFilter func(n *objects.Node) bool
 type EdgeFilter func(e *objects.Edge) bool
 
+// stage builds a step for the pipeline running the traversal, allowing a step to use the context of the pipeline
+// and to fail it. The name describes the step when the traversal is explained.
+type stage struct {
+	name  string
+	build func(p *Pipeline, st *StepStats) Step
+}
+
 type TraversalPath struct {
-	Types   []string          `json:"types,omitempty"`
-	Dir     objects.Direction `json:"direction"`
-	Target  *Traversal        `json:"target"`
-	LimitBy int               `json:"limit"`
-	Filter  string            `json:"filter"`
-	filter  EdgeFilter
+	Types       []string          `json:"types,omitempty"`
+	ExceptTypes []string          `json:"except_types,omitempty"`
+	Dir         objects.Direction `json:"direction"`
+	Target      *Traversal        `json:"target"`
+	LimitBy     int               `json:"limit"`
+	Filter      string            `json:"filter"`
+	Repeat      *Repeat           `json:"repeat,omitempty"`
+	Coalesce    []*Traversal      `json:"coalesce,omitempty"`
+	Edges       bool              `json:"edges,omitempty"`
+	Other       bool              `json:"other,omitempty"`
+	filter      EdgeFilter
+	where       Predicate
+}
+
+func (tp *TraversalPath) UnmarshalJSON(data []byte) error {
+	type alias TraversalPath
+	if err := json.Unmarshal(data, (*alias)(tp)); err != nil {
+		return err
+	}
+	return tp.compile()
+}
+
+// compile parses the filter expression of the path.
+func (tp *TraversalPath) compile() error {
+	if len(tp.Types) > 0 && len(tp.ExceptTypes) > 0 {
+		return invalidf("a hop cannot have both types and except types")
+	}
+
+	if (tp.Repeat != nil || len(tp.Coalesce) > 0) && tp.Edges {
+		return invalidf("a repeat or coalesce cannot return edges")
+	}
+
+	if tp.Repeat != nil {
+		if err := tp.Repeat.compile(); err != nil {
+			return err
+		}
+	}
+
+	if tp.Filter == "" || tp.where != nil {
+		return nil
+	}
+
+	pred, err := ParsePredicate(tp.Filter)
+	if err != nil {
+		return err
+	}
+
+	tp.where = pred
+	return nil
+}
+
+// PathOptions asks a traversal to return the path to each node found, see Traversal.Path.
+type PathOptions struct {
+	// Distinct drops paths through the same nodes and edges as a path already found.
+	Distinct bool `json:"distinct"`
 }
 
 type Traversal struct {
@@ -23,9 +81,70 @@ type Traversal struct {
 	ID       string         `json:"id"`
 	LimitBy  int            `json:"limit"`
 	Filters  []string       `json:"filters"`
-	G        *Graph         `json:"-"`
-	root     *Traversal
-	filters  []Step
+	Budget   *Budget        `json:"budget,omitempty"`
+	Paths    *PathOptions   `json:"path,omitempty"`
+	Label    string         `json:"as,omitempty"`
+	Selects  []string       `json:"select,omitempty"`
+	Orders   []Order        `json:"order,omitempty"`
+	PageSize int            `json:"page_size,omitempty"`
+	Cursor   string         `json:"cursor,omitempty"`
+	GroupKey string         `json:"group_by,omitempty"`
+
+	Aggregation *Aggregation `json:"aggregate,omitempty"`
+	Unions      []*Traversal `json:"union,omitempty"`
+	Intersects  []*Traversal `json:"intersect,omitempty"`
+	Excepts     []*Traversal `json:"except,omitempty"`
+	Optionals   []*Traversal `json:"optional,omitempty"`
+
+	G       *Graph `json:"-"`
+	root    *Traversal
+	via     *TraversalPath
+	filters []stage
+
+	predicates []Predicate
+}
+
+func (t *Traversal) UnmarshalJSON(data []byte) error {
+	type alias Traversal
+	if err := json.Unmarshal(data, (*alias)(t)); err != nil {
+		return err
+	}
+
+	if err := t.compile(); err != nil {
+		return err
+	}
+
+	if t.GroupKey != "" {
+		t.GroupBy(t.GroupKey)
+	}
+
+	if t.Aggregation != nil {
+		if err := t.Aggregation.compile(); err != nil {
+			return err
+		}
+	}
+
+	if len(t.Selects) > 0 {
+		_, err := t.labels()
+		return err
+	}
+	return nil
+}
+
+// compile parses any filter expressions which have not yet been compiled into predicates.
+func (t *Traversal) compile() error {
+	for _, f := range t.Filters[len(t.predicates):] {
+		pred, err := ParsePredicate(f)
+		if err != nil {
+			return err
+		}
+		t.predicates = append(t.predicates, pred)
+	}
+
+	if t.Next != nil {
+		return t.Next.compile()
+	}
+	return nil
 }
 
 func (t *Traversal) Out(relTypes ...string) *Traversal {
@@ -52,6 +171,28 @@ func (t *Traversal) BothFilter(f EdgeFilter) *Traversal {
 	return t.rel(objects.Both, f, []string{})
 }
 
+// OutExcept follows the outgoing edges of any type except the types. The excluded edges of each node are skipped
+// over rather than scanned.
+func (t *Traversal) OutExcept(relTypes ...string) *Traversal {
+	return t.relExcept(objects.Out, relTypes)
+}
+
+// InExcept follows the incoming edges of any type except the types.
+func (t *Traversal) InExcept(relTypes ...string) *Traversal {
+	return t.relExcept(objects.In, relTypes)
+}
+
+// BothExcept follows the edges in both directions of any type except the types.
+func (t *Traversal) BothExcept(relTypes ...string) *Traversal {
+	return t.relExcept(objects.Both, relTypes)
+}
+
+func (t *Traversal) relExcept(dir objects.Direction, relTypes []string) *Traversal {
+	next := t.rel(dir, nil, []string{})
+	t.Next.ExceptTypes = relTypes
+	return next
+}
+
 func (t *Traversal) rel(dir objects.Direction, filter EdgeFilter, relType []string) *Traversal {
 	var root *Traversal
 	if t.root == nil {
@@ -75,9 +216,11 @@ func (t *Traversal) Is(nodeType string) *Traversal {
 	return t
 }
 
+// Has filters the nodes at this step of the traversal to those where the attribute equals the value. The "id"
+// attribute is matched against the node ID, anything else is matched against a property of the node body.
 func (t *Traversal) Has(attr string, value interface{}) *Traversal {
 	if attr != "id" {
-		panic("only id supported")
+		return t.where(&compareExpr{attr, "==", jsonValue(value)})
 	}
 
 	switch asserted := value.(type) {
@@ -91,13 +234,86 @@ func (t *Traversal) Has(attr string, value interface{}) *Traversal {
 	return t
 }
 
+// HasNot filters the nodes at this step of the traversal to those without the property.
+func (t *Traversal) HasNot(attr string) *Traversal {
+	return t.where(&notExpr{&existsExpr{attr}})
+}
+
+// HasIn filters the nodes at this step of the traversal to those where the property equals one of the values.
+func (t *Traversal) HasIn(attr string, values ...interface{}) *Traversal {
+	list := []interface{}{}
+	for _, v := range values {
+		list = append(list, jsonValue(v))
+	}
+	return t.where(&inExpr{attr, list})
+}
+
+// HasRange filters the nodes at this step of the traversal to those where the property is greater than or equal
+// to min and less than max.
+func (t *Traversal) HasRange(attr string, min, max interface{}) *Traversal {
+	return t.where(&andExpr{&compareExpr{attr, ">=", jsonValue(min)}, &compareExpr{attr, "<", jsonValue(max)}})
+}
+
+// Where filters the nodes at this step of the traversal using a predicate expression evaluated against the node
+// body, see ParsePredicate for the syntax. Bodies are loaded when they are not already present. An expression which
+// cannot be parsed is kept uncompiled, so running the traversal returns its *SyntaxError.
+func (t *Traversal) Where(expr string) *Traversal {
+	t.Filters = append(t.Filters, expr)
+	t.compile()
+	return t
+}
+
+// where adds the predicate to the filters of this step without parsing it, so any attribute and value can be
+// matched. The filter is described by the predicate. Behind an expression which cannot be parsed the predicate is
+// only described, the traversal fails when it is run.
+func (t *Traversal) where(pred Predicate) *Traversal {
+	err := t.compile()
+	t.Filters = append(t.Filters, pred.String())
+	if err == nil {
+		t.predicates = append(t.predicates, pred)
+	}
+	return t
+}
+
+// Path returns each result of the traversal with the nodes and edges followed to reach it, see objects.Object.Path.
+// Nodes are no longer deduplicated at each step so a node reached along several paths is returned once per path.
+// The option applies to the whole traversal.
+func (t *Traversal) Path() *Traversal {
+	return t.path(&PathOptions{})
+}
+
+// DistinctPath returns paths like Path, dropping duplicate paths.
+func (t *Traversal) DistinctPath() *Traversal {
+	return t.path(&PathOptions{Distinct: true})
+}
+
+func (t *Traversal) path(opts *PathOptions) *Traversal {
+	if t.root == nil {
+		t.Paths = opts
+	} else {
+		t.root.Paths = opts
+	}
+	return t
+}
+
+// WithBudget limits the resources used by the traversal, see Budget. The budget applies to the whole traversal and
+// is capped by the budget of the graph.
+func (t *Traversal) WithBudget(b Budget) *Traversal {
+	if t.root == nil {
+		t.Budget = &b
+	} else {
+		t.root.Budget = &b
+	}
+	return t
+}
+
 func (t *Traversal) Limit(s int) *Traversal {
 	t.LimitBy = s
 	return t
 }
 
 func (t *Traversal) Filter(f NodeFilter) *Traversal {
-	t.Aggregate(func(in <-chan *objects.Object) <-chan *objects.Object {
+	t.aggregate("filter", func(in <-chan *objects.Object) <-chan *objects.Object {
 		out := make(chan *objects.Object)
 		go func() {
 			defer close(out)
@@ -115,7 +331,7 @@ func (t *Traversal) Filter(f NodeFilter) *Traversal {
 }
 
 func (t *Traversal) Skip(s int) *Traversal {
-	t.Aggregate(func(in <-chan *objects.Object) <-chan *objects.Object {
+	t.aggregate("skip", func(in <-chan *objects.Object) <-chan *objects.Object {
 		c := 0
 		out := make(chan *objects.Object)
 		go func() {
@@ -133,66 +349,86 @@ func (t *Traversal) Skip(s int) *Traversal {
 	return t
 }
 
+// GroupBy keeps the first node found with each value of the property, "id" groups by the node ID. Bodies are loaded
+// when they are not already present.
 func (t *Traversal) GroupBy(key string) *Traversal {
-	t.Aggregate(func(in <-chan *objects.Object) <-chan *objects.Object {
-		if in == nil {
-			panic("cannot group on nil channel")
-		}
+	t.GroupKey = key
+	t.filters = append(t.filters, stage{"group", func(p *Pipeline, st *StepStats) Step {
+		return func(in <-chan *objects.Object) <-chan *objects.Object {
+			if in == nil {
+				panic("cannot group on nil channel")
+			}
 
-		m := make(map[string]bool)
-		out := make(chan *objects.Object)
-		go func() {
-			defer close(out)
-			for o := range in {
-				if !o.IsNode() {
-					log.Println("[WARN] traversal: not piping node")
-					continue
-				}
+			m := make(map[string]bool)
+			out := make(chan *objects.Object)
+			go func() {
+				defer close(out)
+				for o := range in {
+					if !o.IsNode() {
+						log.Println("[WARN] traversal: not piping node")
+						continue
+					}
+
+					if key != "id" && o.Val == nil {
+						obj, err := p.get(st, t.G.store, o.Key)
+						if err != nil {
+							p.Fail(err)
+							continue
+						}
+
+						if obj != nil {
+							o.Val = obj.Val
+						}
+					}
 
-				if key == "id" {
-					id := o.Node().ID
-					if m[id] {
+					v, _ := property(o, key)
+					group := literal(v)
+					if m[group] {
 						continue
 					}
 
-					m[id] = true
-				} else {
-					// todo:
+					m[group] = true
+					out <- o
 				}
+			}()
 
-				out <- o
-			}
-		}()
-
-		return out
-	})
+			return out
+		}
+	}})
 	return t
 }
 
 func (t *Traversal) WithBody() *Traversal {
-	t.Aggregate(func(in <-chan *objects.Object) <-chan *objects.Object {
-		out := make(chan *objects.Object)
-		go func() {
-			defer close(out)
-			for o := range in {
-				if o.Val == nil {
-					bod, err := t.G.GetBody(o.Key)
-					if err == nil {
-						o.Val = bod
+	t.filters = append(t.filters, stage{"body", func(p *Pipeline, st *StepStats) Step {
+		return func(in <-chan *objects.Object) <-chan *objects.Object {
+			out := make(chan *objects.Object)
+			go func() {
+				defer close(out)
+				for o := range in {
+					if o.Val == nil {
+						obj, err := p.get(st, t.G.store, o.Key)
+						if err != nil {
+							p.Fail(err)
+							continue
+						}
+
+						if obj != nil {
+							o.Val = obj.Val
+						}
 					}
-				}
 
-				out <- o
-			}
-		}()
+					out <- o
+				}
+			}()
 
-		return out
-	})
+			return out
+		}
+	}})
 	return t
 }
 
 func (t *Traversal) ForEach(f func(n *objects.Node)) *Traversal {
-	t.Aggregate(func(in <-chan *objects.Object) <-chan *objects.Object {
+	t.aggregate("foreach", func(in <-chan *objects.Object) <-chan *objects.Object {
 		out := make(chan *objects.Object)
 		go func() {
 			defer close(out)
@@ -209,26 +445,26 @@ func (t *Traversal) ForEach(f func(n *objects.Node)) *Traversal {
 }
 
 func (t *Traversal) Aggregate(a Step) *Traversal {
-	t.filters = append(t.filters, a)
+	return t.aggregate("aggregate", a)
+}
+
+func (t *Traversal) aggregate(name string, a Step) *Traversal {
+	t.filters = append(t.filters, stage{name, func(*Pipeline, *StepStats) Step { return a }})
 	return t
 }
 
-func (t *Traversal) All() []*objects.Object {
+// All runs the traversal returning the objects found. The traversal is cancelled along with the context.
+func (t *Traversal) All(ctx context.Context) ([]*objects.Object, error) {
 	var root *Traversal
 	if t.root == nil {
 		root = t
 	} else {
 		root = t.root
 	}
-	return t.G.Run(root)
+	return t.G.Run(ctx, root)
 }
 
-func (t *Traversal) Count() int {
-	var root *Traversal
-	if t.root == nil {
-		root = t
-	} else {
-		root = t.root
-	}
-	return len(t.G.Run(root))
+func (t *Traversal) Count(ctx context.Context) (int, error) {
+	res, err := t.All(ctx)
+	return len(res), err
 }
@@ -1,68 +1,339 @@
 package graph
 
 import (
+	"fmt"
 	"github.com/coldog/go-graph/objects"
 	"github.com/coldog/go-graph/store"
 
+	"sort"
+	"strings"
 	"sync"
 )
 
 const workers = 20
 
-func traverse(p *Pipeline, s store.Store, t *Traversal) []*objects.Object {
-	p.AddStep(func(in <-chan *objects.Object) <-chan *objects.Object {
-		debug("adding step", t.NodeType, t.ID, t.Next)
+// matchPage is the least number of keys read at a time when scanning for the root nodes matching the filters.
+const matchPage = 100
 
-		if t.Next == nil {
-			if in == nil {
-				out, err := s.Prefix(
-					concat(t.NodeType, objects.NodeSep, t.ID),
-					t.LimitBy,
-				)
-				if err != nil {
-					panic(err)
+// TraversalError is returned when a traversal is built in a way which cannot be run, eg: a budget set below the
+// root or an unknown aggregation.
+type TraversalError struct {
+	Msg string `json:"message"`
+}
+
+func (e *TraversalError) Error() string {
+	return e.Msg
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &TraversalError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// plan adds the steps running the traversal to the pipeline. Each level of the traversal produces its nodes, filters
+// them and then follows the next hop. The results are then combined with those of any other traversals of set
+// operations, sorted when the traversal is ordered or paged and reduced when it is aggregated.
+func plan(p *Pipeline, g *Graph, t *Traversal) error {
+	if err := planFrom(p, g, t, 0, true); err != nil {
+		return err
+	}
+
+	if err := planSets(p, g, t); err != nil {
+		return err
+	}
+
+	if err := planOrder(p, g, t); err != nil {
+		return err
+	}
+	return planAggregation(p, g, t)
+}
+
+// planFrom adds the steps of the traversal starting at the level. When root is false the first level filters the
+// nodes coming into the steps rather than scanning the store.
+func planFrom(p *Pipeline, g *Graph, t *Traversal, level int, root bool) error {
+	edges := false
+	for ; t != nil; level, root = level+1, false {
+		if err := t.compile(); err != nil {
+			return err
+		}
+
+		// the budget covers the whole traversal, so a budget on any other level would not be enforced.
+		if t.Budget != nil && (!root || p.parent != nil) {
+			return invalidf("level %d sets a budget, only the root of a traversal can", level)
+		}
+
+		mat := !root || t.Next == nil || t.Next.Repeat != nil || len(t.Next.Coalesce) > 0 || p.paths != nil || t.materialize(g)
+		if mat {
+			if !edges {
+				p.add(nodesInfo(g, t, level, root), func(st *StepStats) Step { return nodes(p, st, g, t) })
+			}
+
+			if p.paths == nil {
+				p.add(&StepInfo{Step: "dedupe", Level: level}, func(*StepStats) Step { return dedupe })
+			} else if p.paths.Distinct {
+				p.add(&StepInfo{Step: "dedupe-paths", Level: level}, func(*StepStats) Step { return dedupePaths })
+			}
+
+			if max := p.budget.MaxFrontier; max > 0 {
+				p.add(&StepInfo{Step: "frontier", Level: level, Limit: int(max)}, func(*StepStats) Step { return frontier(p) })
+			}
+
+			if len(t.predicates) > 0 {
+				p.add(&StepInfo{Step: "match", Level: level, Filters: t.Filters}, func(st *StepStats) Step {
+					return match(p, st, g.store, t.predicates)
+				})
+			}
+
+			for _, a := range t.filters {
+				p.add(&StepInfo{Step: a.name, Level: level}, func(st *StepStats) Step { return a.build(p, st) })
+			}
+
+			for _, sub := range t.Optionals {
+				if err := planOptional(p, g, sub, level); err != nil {
+					return err
 				}
+			}
+		}
 
-				return out
-			} else {
-				out := make(chan *objects.Object)
-				go func() {
-					defer close(out)
-					for o := range in {
-						if !o.IsNode() {
-							continue
-						}
+		if t.Next == nil {
+			break
+		}
 
-						n := o.Node()
-						if t.NodeType != "" && t.NodeType != n.Type {
-							continue
-						}
+		if edges != t.Next.Other {
+			if edges {
+				return invalidf("edges at level %d can only be followed to the other node", level)
+			}
+			return invalidf("level %d has no edges to follow to the other node", level)
+		}
 
-						out <- o
-					}
-				}()
+		edges = t.Next.Edges
+		if t.Next.Other {
+			p.add(&StepInfo{Step: "other", Level: level}, func(*StepStats) Step { return others })
 
-				return out
+			t = t.Next.Target
+			continue
+		}
+
+		if t.Next.Repeat != nil {
+			if err := planRepeat(p, g, t.Next.Repeat, level); err != nil {
+				return err
 			}
+
+			t = t.Next.Target
+			continue
 		}
 
-		out := make(chan *objects.Object)
+		if len(t.Next.Coalesce) > 0 {
+			if err := planCoalesce(p, g, t.Next.Coalesce, level); err != nil {
+				return err
+			}
+
+			t = t.Next.Target
+			continue
+		}
+
+		planHop(p, g, t, level, mat)
+		t = t.Next.Target
+	}
+
+	return nil
+}
+
+// planHop adds the steps following the next hop of the traversal from the nodes coming into the steps. When mat is
+// false the hop starts from the root of the traversal instead, see rootStart.
+func planHop(p *Pipeline, g *Graph, t *Traversal, level int, mat bool) {
+	start := concat("<node>", objects.PathSep)
+	if !mat {
+		start = rootStart(t)
+	}
+
+	p.add(&StepInfo{
+		Step:     "expand",
+		Level:    level,
+		Prefixes: edgePrefixes(t.Next, start),
+		Ranges:   rangeStrings(t.Next, start),
+		Limit:    t.Next.LimitBy,
+		Types:    t.Next.Types,
+		Except:   t.Next.ExceptTypes,
+	}, func(st *StepStats) Step { return expand(p, st, g.store, t) })
+
+	// the root nodes are not loaded, their frontier is counted from the edges followed.
+	if max := p.budget.MaxFrontier; !mat && max > 0 {
+		p.add(&StepInfo{Step: "frontier", Level: level, Limit: int(max)}, func(*StepStats) Step { return frontierFrom(p, t.Next) })
+	}
+
+	filters := []string{}
+	if t.Next.Filter != "" {
+		filters = append(filters, t.Next.Filter)
+	}
+	if t.Next.filter != nil {
+		filters = append(filters, "<func>")
+	}
+
+	p.add(&StepInfo{Step: "targets", Level: level, Types: t.Next.Types, Except: t.Next.ExceptTypes, Filters: filters}, func(*StepStats) Step {
+		return targets(t)
+	})
+}
+
+// nodesInfo describes the step producing the nodes at a level of the traversal.
+func nodesInfo(g *Graph, t *Traversal, level int, root bool) *StepInfo {
+	if !root {
+		info := &StepInfo{Step: "nodes", Level: level}
+		if t.NodeType != "" {
+			info.Types = []string{t.NodeType}
+		}
+		return info
+	}
+
+	if idx, vals := g.indexFor(t); idx != nil {
+		prefixes := []string{}
+		for _, val := range vals {
+			prefixes = append(prefixes, idx.valuePrefix(val))
+		}
+		return &StepInfo{Step: "index", Level: level, Index: idx.String(), Values: vals, Prefixes: prefixes, Limit: t.LimitBy}
+	}
+
+	if t.ID != "" && t.NodeType != "" {
+		return &StepInfo{Step: "get", Level: level, Types: []string{t.NodeType}, Values: []interface{}{t.ID}}
+	}
+
+	prefix := concat(t.NodeType, objects.NodeSep, t.ID)
+	if g.seeks(t) {
+		return &StepInfo{Step: "seek", Level: level, Prefixes: []string{prefix}, Limit: t.PageSize + 1}
+	}
+	return &StepInfo{Step: "scan", Level: level, Prefixes: []string{prefix}, Limit: t.LimitBy}
+}
+
+// materialize returns true when the root nodes of a traversal need to be loaded before following the first hop.
+// Otherwise the first hop is answered directly with a prefix query over the edges.
+func (t *Traversal) materialize(g *Graph) bool {
+	if len(t.predicates) > 0 || len(t.filters) > 0 || len(t.Optionals) > 0 {
+		return true
+	}
+
+	idx, _ := g.indexFor(t)
+	return idx != nil
+}
+
+// nodes returns the step producing the nodes at a step of the traversal. The root nodes are read from an index
+// when possible and otherwise by scanning the node type, subsequent steps filter the incoming nodes by type.
+func nodes(p *Pipeline, st *StepStats, g *Graph, t *Traversal) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		debug("adding step", t.NodeType, t.ID, t.Next)
 
 		if in == nil {
-			chans := []<-chan *objects.Object{}
-			if t.ID == "" {
-				chans = append(chans, query(t, s, t.NodeType, objects.NodeSep)...)
+			var out <-chan *objects.Object
+			if idx, vals := g.indexFor(t); idx != nil {
+				out = indexScan(p, st, g.store, t, idx, vals)
+			} else if t.ID != "" && t.NodeType != "" {
+				// the key of the node is read on its own, a prefix would also match the IDs it starts.
+				key := concat(t.NodeType, objects.NodeSep, t.ID)
+				out = p.scanRange(st, g.store, keyRange{key, key + "\x00"}, 1)
+			} else if g.seeks(t) {
+				out = seek(p, st, g.store, t)
+			} else if len(t.predicates) > 0 && t.LimitBy > 0 && t.LimitBy < scanAll {
+				prefix := concat(t.NodeType, objects.NodeSep, t.ID)
+				out = p.scanMatching(st, g.store, keyRange{prefix, after(prefix)}, t.LimitBy, t.predicates)
 			} else {
-				if len(t.Next.Types) == 0 {
-					chans = append(chans, query(t, s, t.NodeType, objects.NodeSep, t.ID, objects.PathSep)...)
+				out = p.prefix(st, g.store, concat(t.NodeType, objects.NodeSep, t.ID), t.LimitBy)
+			}
+
+			if p.paths != nil {
+				return startPaths(out)
+			}
+			return out
+		}
+
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+			for o := range in {
+				if !o.IsNode() {
+					continue
 				}
 
-				for _, nextType := range t.Next.Types {
-					chans = append(chans, query(t, s, t.NodeType, objects.NodeSep, t.ID, objects.PathSep, nextType, objects.PathSep)...)
+				n := o.Node()
+				if t.NodeType != "" && t.NodeType != n.Type {
+					continue
 				}
+
+				out <- o
 			}
+		}()
 
-			merge(out, chans...)
+		return out
+	}
+}
+
+// dedupe removes duplicate nodes.
+func dedupe(in <-chan *objects.Object) <-chan *objects.Object {
+	m := make(map[string]bool)
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+		for o := range in {
+			if m[o.Key] {
+				continue
+			}
+
+			m[o.Key] = true
+			out <- o
+		}
+	}()
+
+	return out
+}
+
+// dedupePaths removes duplicate paths.
+func dedupePaths(in <-chan *objects.Object) <-chan *objects.Object {
+	m := make(map[string]bool)
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+		for o := range in {
+			key := o.PathKey()
+			if m[key] {
+				continue
+			}
+
+			m[key] = true
+			out <- o
+		}
+	}()
+
+	return out
+}
+
+// startPaths starts the path of each of the root nodes.
+func startPaths(in <-chan *objects.Object) <-chan *objects.Object {
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+		for o := range in {
+			o.Path = []*objects.Object{o}
+			out <- o
+		}
+	}()
+	return out
+}
+
+// extend returns a copy of the path with the object appended, or nil when there is no path.
+func extend(path []*objects.Object, o *objects.Object) []*objects.Object {
+	if path == nil {
+		return nil
+	}
+
+	next := make([]*objects.Object, len(path), len(path)+1)
+	copy(next, path)
+	return append(next, o)
+}
+
+// expand returns the step following the next hop of the traversal, producing the edges found.
+func expand(p *Pipeline, st *StepStats, s store.Store, t *Traversal) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+
+		if in == nil {
+			merge(out, query(p, st, t, s, rootStart(t))...)
 
 		} else {
 			mwg := &sync.WaitGroup{}
@@ -70,30 +341,22 @@ func traverse(p *Pipeline, s store.Store, t *Traversal) []*objects.Object {
 			for i := 0; i < workers; i++ {
 				go func() {
 					wg := sync.WaitGroup{}
-					chans := []<-chan *objects.Object{}
 
 					for o := range in {
 						n := o.Node()
-
-						if len(t.Next.Types) == 0 {
-							chans = append(chans, query(t, s, n.Type, objects.NodeSep, n.ID, objects.PathSep)...)
-						}
-
-						for _, nextType := range t.Next.Types {
-							chans = append(chans, query(t, s, n.Type, objects.NodeSep, n.ID, objects.PathSep, nextType, objects.PathSep)...)
-						}
+						path := o.Path
+						chans := query(p, st, t, s, concat(n.Type, objects.NodeSep, n.ID, objects.PathSep))
 
 						for _, ch := range chans {
 							wg.Add(1)
-							go func() {
+							go func(ch <-chan *objects.Object) {
 								for o := range ch {
+									o.Path = extend(path, o)
 									out <- o
 								}
 								wg.Done()
-							}()
+							}(ch)
 						}
-
-						chans = []<-chan *objects.Object{}
 					}
 
 					wg.Wait()
@@ -109,47 +372,145 @@ func traverse(p *Pipeline, s store.Store, t *Traversal) []*objects.Object {
 		}
 
 		return out
-	})
+	}
+}
 
-	p.AddStep(func(in <-chan *objects.Object) <-chan *objects.Object {
+// targets returns the step converting the edges of a hop into the nodes at the other end of the edge, applying the
+// edge filters of the hop. The edges are passed on as they are when the hop returns edges.
+func targets(t *Traversal) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
 		out := make(chan *objects.Object, 100)
 		go func() {
 			defer close(out)
 			for o := range in {
-				if o.IsNode() {
-					out <- o
+				if !o.IsEdge() {
+					continue
 				}
 
-				e := o.Edge()
-				if t.Next != nil && len(t.Next.Types) > 0 && !inArray(e.Type, t.Next.Types) {
+				if !follows(t.Next, o.Edge()) {
 					continue
 				}
 
-				if t.Next != nil && t.Next.filter != nil && !t.Next.filter(e) {
+				if t.Next.Edges {
+					out <- o
 					continue
 				}
 
-				if string(o.Key[0]) == objects.ForwardEdgeKey {
-					out <- e.TargetNode().Object()
-				} else if string(o.Key[0]) == objects.ReverseEdgeKey {
-					out <- e.SourceNode().Object()
+				if next := far(o); next != nil {
+					out <- next
 				}
 			}
 		}()
 		return out
-	})
+	}
+}
+
+// follows returns true when the hop follows the edge, it is of the types of the hop and passes its filters.
+func follows(tp *TraversalPath, e *objects.Edge) bool {
+	if len(tp.Types) > 0 && !inArray(e.Type, tp.Types) {
+		return false
+	}
 
-	t.GroupBy("id")
+	if inArray(e.Type, tp.ExceptTypes) {
+		return false
+	}
 
-	for _, a := range t.filters {
-		p.AddStep(a)
+	if tp.filter != nil && !tp.filter(e) {
+		return false
 	}
+	return tp.where == nil || tp.where.Match(e.Body)
+}
 
-	if t.Next != nil {
-		return traverse(p, s, t.Next.Target)
+// others returns the step converting the incoming edges into the nodes at the other end of the edge.
+func others(in <-chan *objects.Object) <-chan *objects.Object {
+	out := make(chan *objects.Object, 100)
+	go func() {
+		defer close(out)
+		for o := range in {
+			if !o.IsEdge() {
+				continue
+			}
+
+			if next := far(o); next != nil {
+				out <- next
+			}
+		}
+	}()
+	return out
+}
+
+// far returns the node at the other end of an edge found by a hop, the target of a forward edge and the source
+// of a reverse edge, extending the path of the edge.
+func far(o *objects.Object) *objects.Object {
+	var next *objects.Object
+	if string(o.Key[0]) == objects.ForwardEdgeKey {
+		next = o.Edge().TargetNode().Object()
+	} else if string(o.Key[0]) == objects.ReverseEdgeKey {
+		next = o.Edge().SourceNode().Object()
+	} else {
+		return nil
 	}
 
-	return p.Collect()
+	next.Path = extend(o.Path, next)
+	return next
+}
+
+// match returns a step passing along the nodes whose body satisfies all of the predicates.
+func match(p *Pipeline, st *StepStats, s store.Store, preds []Predicate) Step {
+	return func(in <-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+			for o := range in {
+				if o.Val == nil {
+					obj, err := p.get(st, s, o.Key)
+					if err != nil {
+						p.Fail(err)
+						continue
+					}
+
+					if obj != nil {
+						o.Val = obj.Val
+					}
+				}
+
+				if matches(o.Val, preds) {
+					out <- o
+				}
+			}
+		}()
+		return out
+	}
+}
+
+// matches returns true when the body satisfies all of the predicates.
+func matches(body map[string]interface{}, preds []Predicate) bool {
+	for _, pred := range preds {
+		if !pred.Match(body) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexScan returns the nodes pointed to by the index entries for the values.
+func indexScan(p *Pipeline, st *StepStats, s store.Store, t *Traversal, idx *Index, vals []interface{}) <-chan *objects.Object {
+	chans := []<-chan *objects.Object{}
+	for _, val := range vals {
+		chans = append(chans, p.prefix(st, s, idx.valuePrefix(val), t.LimitBy))
+	}
+
+	entries := make(chan *objects.Object)
+	merge(entries, chans...)
+
+	out := make(chan *objects.Object)
+	go func() {
+		defer close(out)
+		for e := range entries {
+			out <- &objects.Object{Key: idx.nodeKey(e)}
+		}
+	}()
+	return out
 }
 
 func debug(args ...interface{}) {
@@ -164,48 +525,120 @@ func concat(arg string, args ...string) string {
 	return arg
 }
 
-func query(t *Traversal, s store.Store, end ...string) []<-chan *objects.Object {
-	switch t.Next.Dir {
-	case objects.Out:
-		res, err := s.Prefix(concat(objects.ForwardEdgeKey, end...), t.Next.LimitBy)
-		if err != nil {
-			panic(err)
+// query runs the scans for the edges of the next hop starting at start, see edgePrefixes and edgeRanges.
+func query(p *Pipeline, st *StepStats, t *Traversal, s store.Store, start string) []<-chan *objects.Object {
+	chans := []<-chan *objects.Object{}
+	for _, prefix := range edgePrefixes(t.Next, start) {
+		ranges := edgeRanges(t.Next, prefix)
+		if ranges == nil {
+			chans = append(chans, p.prefix(st, s, prefix, t.Next.LimitBy))
+			continue
+		}
+
+		for _, r := range ranges {
+			chans = append(chans, p.scanRange(st, s, r, t.Next.LimitBy))
+		}
+	}
+	return chans
+}
+
+// rootStart returns the start of the edges followed from the root of a traversal when the root nodes are not
+// materialized. Without an ID this covers the edges of every node of the type.
+func rootStart(t *Traversal) string {
+	if t.ID == "" {
+		return concat(t.NodeType, objects.NodeSep)
+	}
+	return concat(t.NodeType, objects.NodeSep, t.ID, objects.PathSep)
+}
+
+// edgePrefixes returns the prefixes to scan for the edges of a hop. When start is the key of a node followed by the
+// path separator the scan is narrowed to the edge types of the hop.
+func edgePrefixes(tp *TraversalPath, start string) []string {
+	ends := []string{start}
+	if strings.HasSuffix(start, objects.PathSep) && len(tp.Types) > 0 {
+		ends = []string{}
+		for _, typ := range tp.Types {
+			ends = append(ends, concat(start, typ, objects.PathSep))
 		}
-		return []<-chan *objects.Object{res}
+	}
 
-	case objects.In:
-		res, err := s.Prefix(concat(objects.ReverseEdgeKey, end...), t.Next.LimitBy)
-		if err != nil {
-			panic(err)
+	prefixes := []string{}
+	for _, end := range ends {
+		switch tp.Dir {
+		case objects.Out:
+			prefixes = append(prefixes, concat(objects.ForwardEdgeKey, end))
+		case objects.In:
+			prefixes = append(prefixes, concat(objects.ReverseEdgeKey, end))
+		case objects.Both:
+			prefixes = append(prefixes, concat(objects.ReverseEdgeKey, end), concat(objects.ForwardEdgeKey, end))
 		}
-		return []<-chan *objects.Object{res}
+	}
+	return prefixes
+}
+
+// keyRange is a scan over the keys from start up to but not including end.
+type keyRange struct {
+	start, end string
+}
+
+func (r keyRange) String() string {
+	return "[" + r.start + ", " + r.end + ")"
+}
+
+// edgeRanges returns the ranges of keys to scan for the edges of a hop under the prefix, skipping over the edges of
+// the types the hop excludes. It returns nil when the whole prefix is scanned: when the hop excludes no types or the
+// prefix covers the edges of more than one node, in which case the excluded edges are dropped by targets.
+func edgeRanges(tp *TraversalPath, prefix string) []keyRange {
+	if len(tp.ExceptTypes) == 0 || !strings.HasSuffix(prefix, objects.PathSep) {
+		return nil
+	}
 
-	case objects.Both:
-		res1, err := s.Prefix(concat(objects.ReverseEdgeKey, end...), t.Next.LimitBy)
-		if err != nil {
-			panic(err)
+	skips := []string{}
+	for _, typ := range tp.ExceptTypes {
+		skips = append(skips, concat(prefix, typ, objects.PathSep))
+	}
+	sort.Strings(skips)
+
+	ranges := []keyRange{}
+	start := prefix
+	for _, skip := range skips {
+		if start < skip {
+			ranges = append(ranges, keyRange{start, skip})
 		}
-		res2, err := s.Prefix(concat(objects.ForwardEdgeKey, end...), t.Next.LimitBy)
-		if err != nil {
-			panic(err)
+
+		if next := after(skip); next > start {
+			start = next
 		}
-		return []<-chan *objects.Object{res1, res2}
+	}
+	return append(ranges, keyRange{start, after(prefix)})
+}
 
+// rangeStrings describes the range scans for the edges of a hop starting at start.
+func rangeStrings(tp *TraversalPath, start string) []string {
+	list := []string{}
+	for _, prefix := range edgePrefixes(tp, start) {
+		for _, r := range edgeRanges(tp, prefix) {
+			list = append(list, r.String())
+		}
 	}
+	return list
+}
 
-	return nil
+// after returns the first key after every key starting with the prefix.
+func after(prefix string) string {
+	return prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
 }
 
 func merge(out chan *objects.Object, chans ...<-chan *objects.Object) {
 	wg := &sync.WaitGroup{}
 	wg.Add(len(chans))
 	for _, ch := range chans {
-		go func() {
+		go func(ch <-chan *objects.Object) {
 			for o := range ch {
 				out <- o
 			}
 			wg.Done()
-		}()
+		}(ch)
 	}
 
 	go func() {
@@ -0,0 +1,606 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"sort"
+	"strings"
+)
+
+// ResultChange is sent by Watch when a node or edge enters or leaves the results of a traversal. Op is "enter" or
+// "leave" and Seq is the sequence number of the last change of the feed seen when the results were found.
+type ResultChange struct {
+	Op     string          `json:"op"`
+	Seq    int64           `json:"seq"`
+	Object *objects.Object `json:"object"`
+}
+
+// Watch runs the traversal and then follows the change feed of the graph, sending a ResultChange for each result
+// as it enters the results and once it leaves them, eg: new posts from the users someone follows:
+//
+//	t := g.Traversal()
+//	t.Is("user").Has("id", "1").Out("follows").Out("posts")
+//	res, errc, err := g.Watch(ctx, t)
+//
+// The results found by the first run are sent as entering and results are told apart by key. The nodes found at
+// each level of the traversal are kept, so a committed change only runs the hops it affects: an edge created from a
+// node found at a level runs that hop from the node alone and then the following hops from the nodes it newly
+// reaches, while an edge deleted, or a node which no longer matches the filters of its level, runs the following
+// hops again from the nodes kept at the level. Changes to the nodes of the first step run the traversal again.
+//
+// Traversals with set operations, optional steps or paths, those following repeat, coalesce or edge hops, and those
+// whose first hop from every node of a type is answered by scanning the edges, do not keep their levels and are run
+// again in full when a change touches what their results depend on: the edges of the types they follow, the nodes of
+// their first step and the nodes filtered on their body at later steps. Changes committed close together are handled
+// together.
+//
+// The graph must track changes, see TrackChanges, and aggregated, paged or selecting traversals cannot be watched,
+// which is returned as an error straight away. Both channels are closed once the context is cancelled, or after
+// sending the error when running the traversal fails.
+func (g *Graph) Watch(ctx context.Context, t *Traversal) (<-chan *ResultChange, <-chan error, error) {
+	f := g.tracking()
+	if f == nil {
+		return nil, nil, fmt.Errorf("the graph does not track changes")
+	}
+
+	if t.Aggregation != nil || t.PageSize > 0 || t.Cursor != "" || len(t.Selects) > 0 {
+		return nil, nil, invalidf("aggregated, paged or selecting traversals cannot be watched")
+	}
+
+	if _, err := g.Explain(t); err != nil {
+		return nil, nil, err
+	}
+
+	eval := g.rerun(t)
+	if w := newWatcher(g, t); w != nil {
+		eval = w.evaluate
+	}
+
+	out := make(chan *ResultChange)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+
+		// changes committed while the traversal first runs are seen again, running the hops they affect once more.
+		seq := f.head()
+		current := map[string]*objects.Object{}
+		if err := g.rewatch(ctx, eval, nil, seq, current, out); err != nil {
+			if ctx.Err() == nil {
+				errc <- err
+			}
+			return
+		}
+
+		// the subscription is cancelled on its own when the traversal fails so the changes can be drained.
+		sub, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		changes, cerrc := g.Subscribe(sub, seq)
+		for c := range changes {
+			burst := []*Change{c}
+
+		more:
+			for {
+				select {
+				case next, ok := <-changes:
+					if !ok {
+						break more
+					}
+					burst = append(burst, next)
+				default:
+					break more
+				}
+			}
+
+			seq = burst[len(burst)-1].Seq
+			if err := g.rewatch(ctx, eval, burst, seq, current, out); err != nil {
+				if ctx.Err() == nil {
+					errc <- err
+				}
+
+				cancel()
+				for range changes {
+				}
+				<-cerrc
+				return
+			}
+		}
+
+		if err := <-cerrc; err != nil {
+			errc <- err
+		}
+	}()
+	return out, errc, nil
+}
+
+// evaluation returns the results of a watched traversal once the changes are committed, or false when the changes
+// cannot alter the results. The results are found from scratch when there are no changes.
+type evaluation func(ctx context.Context, changes []*Change) (map[string]*objects.Object, bool, error)
+
+// rerun returns the evaluation running the whole traversal again whenever a change touches what its results depend
+// on, see interest.
+func (g *Graph) rerun(t *Traversal) evaluation {
+	in := newInterest()
+	in.add(t, true)
+
+	return func(ctx context.Context, changes []*Change) (map[string]*objects.Object, bool, error) {
+		affected := changes == nil
+		for _, c := range changes {
+			affected = affected || in.affects(c)
+		}
+
+		if !affected {
+			return nil, false, nil
+		}
+
+		res, err := g.Run(ctx, t)
+		if err != nil {
+			return nil, false, err
+		}
+
+		found := map[string]*objects.Object{}
+		for _, o := range res {
+			found[o.Key] = o
+		}
+		return found, true, nil
+	}
+}
+
+// rewatch evaluates the watched traversal after the changes, sending the results which entered and left since the
+// last evaluation and updating the current results.
+func (g *Graph) rewatch(ctx context.Context, eval evaluation, burst []*Change, seq int64, current map[string]*objects.Object, out chan<- *ResultChange) error {
+	found, changed, err := eval(ctx, burst)
+	if err != nil || !changed {
+		return err
+	}
+
+	changes := []*ResultChange{}
+	for key, o := range current {
+		if found[key] == nil {
+			changes = append(changes, &ResultChange{Op: "leave", Seq: seq, Object: o})
+			delete(current, key)
+		}
+	}
+
+	for key, o := range found {
+		if current[key] == nil {
+			changes = append(changes, &ResultChange{Op: "enter", Seq: seq, Object: o})
+			current[key] = o
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Op != changes[j].Op {
+			return changes[i].Op == "leave"
+		}
+		return changes[i].Object.Key < changes[j].Object.Key
+	})
+
+	for _, c := range changes {
+		select {
+		case out <- c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// watcher keeps the nodes found at each level of a watched traversal following only plain hops, so that a change
+// runs only the hops it affects. Reached holds the nodes reached by the hop into each level before the filters of the
+// level and found the nodes passing the filters, found at the last level being the results.
+type watcher struct {
+	g       *Graph
+	budget  Budget
+	levels  []*Traversal
+	reached []map[string]bool
+	found   []map[string]*objects.Object
+}
+
+// newWatcher returns a watcher for the traversal, or nil when a level of the traversal cannot be run on its own. A
+// first hop from every node of a type answered with a scan of the edges, see materialize, is limited differently
+// than the nodes of the type would be, so the traversal is run again instead.
+func newWatcher(g *Graph, t *Traversal) *watcher {
+	if t.Next != nil && t.ID == "" && !t.materialize(g) {
+		return nil
+	}
+
+	w := &watcher{g: g, budget: g.budgetFor(t)}
+	for l := t; l != nil; {
+		if len(l.Unions) > 0 || len(l.Intersects) > 0 || len(l.Excepts) > 0 || len(l.Optionals) > 0 || l.Paths != nil {
+			return nil
+		}
+		w.levels = append(w.levels, l)
+
+		tp := l.Next
+		if tp == nil {
+			break
+		}
+
+		if tp.Other || tp.Edges || tp.Repeat != nil || len(tp.Coalesce) > 0 {
+			return nil
+		}
+		l = tp.Target
+	}
+	return w
+}
+
+// evaluate is the evaluation of the watcher.
+func (w *watcher) evaluate(ctx context.Context, changes []*Change) (map[string]*objects.Object, bool, error) {
+	last := len(w.levels) - 1
+
+	reset := changes == nil
+	for _, c := range changes {
+		reset = reset || w.rooted(c)
+	}
+
+	if reset {
+		if err := w.reset(ctx); err != nil {
+			return nil, false, err
+		}
+		return w.found[last], true, nil
+	}
+
+	changed := false
+	for _, c := range changes {
+		ok, err := w.change(ctx, c)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = changed || ok
+	}
+	return w.found[last], changed, nil
+}
+
+// rooted returns true when the change can alter the nodes of the first level.
+func (w *watcher) rooted(c *Change) bool {
+	root := w.levels[0]
+	if c.Type != "node" || (c.Op == "update" && !root.filtered()) {
+		return false
+	}
+
+	key := strings.TrimPrefix(c.ResourceID, "node:")
+	if root.ID != "" && root.NodeType != "" {
+		return key == concat(root.NodeType, objects.NodeSep, root.ID)
+	}
+	return root.NodeType == "" || strings.SplitN(key, objects.NodeSep, 2)[0] == root.NodeType
+}
+
+// change runs the hops affected by a change made past the first level, returning true when any were run. An edge
+// created is followed at every level it is a hop of, while deleting or updating it finds every following level again.
+func (w *watcher) change(ctx context.Context, c *Change) (bool, error) {
+	if c.Type == "node" {
+		return w.changeNode(ctx, strings.TrimPrefix(c.ResourceID, "node:"))
+	}
+
+	key, err := resourceKey(c.ResourceID)
+	if err != nil {
+		return false, err
+	}
+	e := (&objects.Object{Key: key}).Edge()
+
+	changed := false
+	for level, l := range w.levels[:len(w.levels)-1] {
+		tp := l.Next
+		if (len(tp.Types) > 0 && !inArray(e.Type, tp.Types)) || inArray(e.Type, tp.ExceptTypes) {
+			continue
+		}
+
+		if c.Op == "update" && tp.where == nil && tp.filter == nil {
+			continue
+		}
+
+		from := []string{}
+		for _, end := range ends(tp.Dir, e) {
+			if w.found[level][end] != nil {
+				from = append(from, end)
+			}
+		}
+
+		if len(from) == 0 {
+			continue
+		}
+
+		if c.Op != "create" {
+			return true, w.rebuild(ctx, level)
+		}
+
+		if err := w.add(ctx, level, from); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// changeNode filters a node reached past the first level again, running the following hops when the node entered or
+// left the nodes found at its level.
+func (w *watcher) changeNode(ctx context.Context, key string) (bool, error) {
+	changed := false
+	for level := 1; level < len(w.levels); level++ {
+		if !w.reached[level][key] || !w.levels[level].filtered() {
+			continue
+		}
+
+		found, err := w.filter(ctx, level, []string{key})
+		if err != nil {
+			return false, err
+		}
+
+		switch o, was := found[key], w.found[level][key] != nil; {
+		case o != nil && !was:
+			w.found[level][key] = o
+			if err := w.add(ctx, level, []string{key}); err != nil {
+				return false, err
+			}
+			changed = true
+		case o == nil && was:
+			delete(w.found[level], key)
+			return true, w.rebuild(ctx, level)
+		}
+	}
+	return changed, nil
+}
+
+// ends returns the keys of the nodes of an edge which a hop in the direction follows the edge from.
+func ends(dir objects.Direction, e *objects.Edge) []string {
+	switch dir {
+	case objects.Out:
+		return []string{e.Source}
+	case objects.In:
+		return []string{e.Target}
+	}
+	return []string{e.Source, e.Target}
+}
+
+// reset finds the nodes of the first level and then of every following level.
+func (w *watcher) reset(ctx context.Context) error {
+	found, err := w.collect(ctx, nil, func(p *Pipeline) error {
+		return planFrom(p, w.g, single(w.levels[0]), 0, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.reached = make([]map[string]bool, len(w.levels))
+	w.found = make([]map[string]*objects.Object, len(w.levels))
+	w.found[0] = found
+	return w.rebuild(ctx, 0)
+}
+
+// rebuild finds the nodes of the levels following the level again from the nodes found at the level.
+func (w *watcher) rebuild(ctx context.Context, level int) error {
+	for ; level < len(w.levels)-1; level++ {
+		keys, err := w.hop(ctx, level, w.keys(level))
+		if err != nil {
+			return err
+		}
+
+		w.reached[level+1] = map[string]bool{}
+		for _, key := range keys {
+			w.reached[level+1][key] = true
+		}
+
+		if w.found[level+1], err = w.filter(ctx, level+1, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add follows the hop of the level from the nodes, adding the nodes newly reached to the following levels.
+func (w *watcher) add(ctx context.Context, level int, keys []string) error {
+	for ; level < len(w.levels)-1 && len(keys) > 0; level++ {
+		reached, err := w.hop(ctx, level, keys)
+		if err != nil {
+			return err
+		}
+
+		fresh := []string{}
+		for _, key := range reached {
+			if !w.reached[level+1][key] {
+				w.reached[level+1][key] = true
+				fresh = append(fresh, key)
+			}
+		}
+
+		found, err := w.filter(ctx, level+1, fresh)
+		if err != nil {
+			return err
+		}
+
+		keys = []string{}
+		for key, o := range found {
+			w.found[level+1][key] = o
+			keys = append(keys, key)
+		}
+	}
+	return nil
+}
+
+// keys returns the keys of the nodes found at the level.
+func (w *watcher) keys(level int) []string {
+	keys := []string{}
+	for key := range w.found[level] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// hop returns the keys of the nodes reached by following the hop of the level from the nodes.
+func (w *watcher) hop(ctx context.Context, level int, keys []string) ([]string, error) {
+	found, err := w.collect(ctx, keys, func(p *Pipeline) error {
+		planHop(p, w.g, w.levels[level], level, true)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reached := []string{}
+	for key := range found {
+		reached = append(reached, key)
+	}
+	return reached, nil
+}
+
+// filter returns the nodes passing the filters of the level.
+func (w *watcher) filter(ctx context.Context, level int, keys []string) (map[string]*objects.Object, error) {
+	if len(keys) == 0 {
+		return map[string]*objects.Object{}, nil
+	}
+
+	return w.collect(ctx, keys, func(p *Pipeline) error {
+		return planFrom(p, w.g, single(w.levels[level]), level, false)
+	})
+}
+
+// collect runs the steps planned from the nodes, or from nothing when keys is nil, under the budget of the traversal
+// returning the objects found by key.
+func (w *watcher) collect(ctx context.Context, keys []string, planned func(p *Pipeline) error) (map[string]*objects.Object, error) {
+	parent := ctx
+	if w.budget.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.budget.Timeout)
+		defer cancel()
+	}
+
+	p := newPipeline(ctx, w.budget)
+	if keys != nil {
+		p.add(&StepInfo{Step: "nodes"}, func(*StepStats) Step { return from(keys) })
+	}
+
+	if err := planned(p); err != nil {
+		p.cancel()
+		return nil, err
+	}
+
+	found := map[string]*objects.Object{}
+	err := p.Each(func(o *objects.Object) error {
+		found[o.Key] = o
+		return nil
+	})
+	if err == context.DeadlineExceeded && parent.Err() == nil {
+		err = &BudgetError{Limit: "timeout", Max: w.budget.Timeout.String()}
+	}
+	return found, err
+}
+
+// from returns a step sending the nodes with the keys.
+func from(keys []string) Step {
+	return func(<-chan *objects.Object) <-chan *objects.Object {
+		out := make(chan *objects.Object)
+		go func() {
+			defer close(out)
+			for _, key := range keys {
+				out <- &objects.Object{Key: key}
+			}
+		}()
+		return out
+	}
+}
+
+// single returns the level of a traversal without its next hop.
+func single(t *Traversal) *Traversal {
+	l := *t
+	l.Next = nil
+	return &l
+}
+
+// head returns the sequence number of the last change committed.
+func (f *changeFeed) head() int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.seq
+}
+
+// interest holds the changes which can alter the results of a watched traversal. Nodes and edges map the node and
+// edge types which matter, where the empty type stands for every type, and keys the single nodes which matter.
+type interest struct {
+	nodes map[string]bool
+	keys  map[string]bool
+	edges map[string]bool
+}
+
+func newInterest() *interest {
+	return &interest{nodes: map[string]bool{}, keys: map[string]bool{}, edges: map[string]bool{}}
+}
+
+// add adds the changes which matter to the traversal. Nodes matter at the first step of a traversal, where they are
+// scanned, and wherever their bodies are filtered, later steps only reach nodes along edges. Filters of steps
+// returning edges apply to the edges.
+func (in *interest) add(t *Traversal, root bool) {
+	edges := false
+	for l := t; l != nil; root = false {
+		switch {
+		case root && l.ID != "" && l.NodeType != "":
+			in.keys[concat(l.NodeType, objects.NodeSep, l.ID)] = true
+		case root || (!edges && l.filtered()):
+			in.nodes[l.NodeType] = true
+		}
+
+		for _, sets := range [][]*Traversal{l.Unions, l.Intersects, l.Excepts} {
+			for _, s := range sets {
+				in.add(s, true)
+			}
+		}
+
+		if l.Next == nil {
+			break
+		}
+
+		tp := l.Next
+		if !tp.Other && tp.Repeat == nil && len(tp.Coalesce) == 0 {
+			if len(tp.Types) == 0 {
+				in.edges[""] = true
+			}
+			for _, typ := range tp.Types {
+				in.edges[typ] = true
+			}
+		}
+
+		if tp.Repeat != nil {
+			if tp.Repeat.Until != "" {
+				in.nodes[""] = true
+			}
+			in.add(tp.Repeat.Body, false)
+		}
+
+		for _, b := range tp.Coalesce {
+			in.add(b, false)
+		}
+		edges = tp.Edges
+		l = tp.Target
+	}
+}
+
+// filtered returns true when the step filters nodes on anything but their key.
+func (t *Traversal) filtered() bool {
+	if len(t.Filters) > 0 {
+		return true
+	}
+
+	for _, s := range t.filters {
+		if s.name != "body" {
+			return true
+		}
+	}
+	return false
+}
+
+// affects returns true when the change can alter the results.
+func (in *interest) affects(c *Change) bool {
+	if c.Type == "edge" {
+		// edge:<type>.<source>.<target>
+		typ := strings.SplitN(strings.TrimPrefix(c.ResourceID, "edge:"), ".", 2)[0]
+		return in.edges[""] || in.edges[typ]
+	}
+
+	// node:<type>_<id>
+	key := strings.TrimPrefix(c.ResourceID, "node:")
+	typ := strings.SplitN(key, objects.NodeSep, 2)[0]
+	return in.nodes[""] || in.nodes[typ] || in.keys[key]
+}
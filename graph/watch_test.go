@@ -0,0 +1,214 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store/bolt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWatch_Interest(t *testing.T) {
+	tr := &Traversal{LimitBy: 100}
+	tr.Is("user").Has("id", "1").Out("follows").Is("user").Where("active == true").OutE("posts").Where("at > 5").OtherV()
+
+	in := newInterest()
+	in.add(tr, true)
+
+	cases := map[string]bool{
+		"node:user_1":                true,
+		"node:user_2":                true,
+		"node:post_1":                false,
+		"edge:follows.user_1.user_2": true,
+		"edge:posts.user_2.post_1":   true,
+		"edge:likes.user_2.post_1":   false,
+	}
+
+	for id, exp := range cases {
+		c := &Change{Type: "node", ResourceID: id}
+		if id[:4] == "edge" {
+			c.Type = "edge"
+		}
+		assert(t, in.affects(c) == exp, "%s: expected %v", id, exp)
+	}
+
+	tr = Sub()
+	tr.Is("user").Out("follows").Union(Sub().Is("group").In())
+
+	in = newInterest()
+	in.add(tr, true)
+	assert(t, in.affects(&Change{Type: "node", ResourceID: "node:group_1"}), "expected the union to match groups")
+	assert(t, in.affects(&Change{Type: "edge", ResourceID: "edge:member.user_1.group_1"}), "expected any edge to match")
+	assert(t, !in.affects(&Change{Type: "node", ResourceID: "node:post_1"}), "expected posts not to match")
+}
+
+func TestWatch_Fails(t *testing.T) {
+	ctx := context.Background()
+	s := bolt.NewBoltStore("test")
+	ok(t, s.Open(ctx))
+	defer s.Close()
+	defer s.Drop()
+
+	g := New(s)
+	ok(t, g.TrackChanges(ctx))
+	g.SetBudget(Budget{MaxScanned: 3})
+
+	tr := g.Traversal()
+	tr.Is("user")
+	res, errc, err := g.Watch(ctx, tr)
+	ok(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := g.CreateNode(ctx, "user", nil)
+		ok(t, err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-res:
+		case <-timeout:
+			t.Fatal("expected the watch to stop once the traversal fails")
+		}
+	}
+
+	_, isBudget := (<-errc).(*BudgetError)
+	assert(t, isBudget, "expected a budget error")
+}
+
+func TestWatch_Hops(t *testing.T) {
+	ctx := context.Background()
+	s := bolt.NewBoltStore("test")
+	ok(t, s.Open(ctx))
+	defer s.Close()
+	defer s.Drop()
+
+	g := New(s)
+	ok(t, g.TrackChanges(ctx))
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		ok(t, g.PutNode(ctx, &objects.Node{Type: "user", ID: id, Body: map[string]interface{}{"active": true}}))
+		ok(t, g.PutNode(ctx, &objects.Node{Type: "post", ID: id}))
+		ok(t, g.PutEdge(ctx, &objects.Edge{Type: "posts", Source: "user_" + id, Target: "post_" + id}))
+	}
+	ok(t, g.PutEdge(ctx, &objects.Edge{Type: "follows", Source: "user_1", Target: "user_2"}))
+
+	tr := g.Traversal()
+	tr.Is("user").Has("id", "1").Out("follows").Is("user").Where("active == true").Out("posts")
+
+	w := newWatcher(g, tr)
+	assert(t, w != nil, "expected the traversal to keep its levels")
+
+	found, changed, err := w.evaluate(ctx, nil)
+	ok(t, err)
+	assert(t, changed, "expected the first evaluation to find the results")
+	equals(t, []string{"post_2"}, sortedKeys(found))
+
+	seq := g.tracking().head()
+	cases := []struct {
+		write   func() error
+		changed bool
+		results []string
+	}{
+		{func() error {
+			return g.PutEdge(ctx, &objects.Edge{Type: "follows", Source: "user_1", Target: "user_3"})
+		}, true, []string{"post_2", "post_3"}},
+		{func() error {
+			return g.PutEdge(ctx, &objects.Edge{Type: "follows", Source: "user_4", Target: "user_3"})
+		}, false, []string{"post_2", "post_3"}},
+		{func() error {
+			return g.PutEdge(ctx, &objects.Edge{Type: "posts", Source: "user_4", Target: "post_1"})
+		}, false, []string{"post_2", "post_3"}},
+		{func() error {
+			return g.PutEdge(ctx, &objects.Edge{Type: "posts", Source: "user_3", Target: "post_1"})
+		}, true, []string{"post_1", "post_2", "post_3"}},
+		{func() error {
+			return g.PutNode(ctx, &objects.Node{Type: "user", ID: "3", Body: map[string]interface{}{"active": false}})
+		}, true, []string{"post_2"}},
+		{func() error {
+			return g.PutNode(ctx, &objects.Node{Type: "user", ID: "4", Body: map[string]interface{}{"active": false}})
+		}, false, []string{"post_2"}},
+		{func() error {
+			return g.DelEdge(ctx, &objects.Edge{Type: "follows", Source: "user_1", Target: "user_2"})
+		}, true, []string{}},
+	}
+
+	for i, c := range cases {
+		ok(t, c.write())
+
+		changes, err := g.Changes(ctx, seq, 100)
+		ok(t, err)
+		seq = changes[len(changes)-1].Seq
+
+		found, changed, err := w.evaluate(ctx, changes)
+		ok(t, err)
+		assert(t, changed == c.changed, "case %d: expected changed to be %v", i, c.changed)
+		equals(t, c.results, sortedKeys(w.found[len(w.levels)-1]))
+
+		if changed {
+			res, err := g.Run(ctx, tr)
+			ok(t, err)
+
+			keys := []string{}
+			for _, o := range res {
+				keys = append(keys, o.Key)
+			}
+			sort.Strings(keys)
+			equals(t, keys, sortedKeys(found))
+		}
+	}
+}
+
+func TestWatch_Roots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := bolt.NewBoltStore("test")
+	ok(t, s.Open(ctx))
+	defer s.Close()
+	defer s.Drop()
+
+	g := New(s)
+	ok(t, g.TrackChanges(ctx))
+
+	// more users follow someone than the limit of the root, which a scan of the follows edges does not apply.
+	ok(t, g.PutNode(ctx, &objects.Node{Type: "user", ID: "0"}))
+	for i := 1; i <= 150; i++ {
+		id := fmt.Sprintf("%03d", i)
+		ok(t, g.PutNode(ctx, &objects.Node{Type: "user", ID: id}))
+		ok(t, g.PutNode(ctx, &objects.Node{Type: "user", ID: "f" + id}))
+		ok(t, g.PutEdge(ctx, &objects.Edge{Type: "follows", Source: "user_" + id, Target: "user_f" + id}))
+	}
+
+	tr := g.Traversal()
+	tr.Is("user").Out("follows")
+	assert(t, newWatcher(g, tr) == nil, "expected a first hop scanning the edges to run again")
+
+	run, err := g.Run(ctx, tr)
+	ok(t, err)
+	equals(t, 150, len(run))
+
+	res, _, err := g.Watch(ctx, tr)
+	ok(t, err)
+
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < len(run); i++ {
+		select {
+		case c := <-res:
+			equals(t, "enter", c.Op)
+		case <-timeout:
+			t.Fatalf("expected %d results to enter got %d", len(run), i)
+		}
+	}
+}
+
+func sortedKeys(m map[string]*objects.Object) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,43 +1,173 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"github.com/coldog/go-graph/analytics"
 	"github.com/coldog/go-graph/graph"
 	"github.com/coldog/go-graph/server"
 	"github.com/coldog/go-graph/store"
 	"github.com/coldog/go-graph/store/bigtable"
 	"github.com/coldog/go-graph/store/bolt"
 	"log"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		analyze(os.Args[2:])
+		return
+	}
+
 	listen := flag.String("listen", ":8231", "listen on")
 	db := flag.String("db", "main", "database name")
 	backend := flag.String("backend", "bolt", "backend to use (bolt, bigtable)")
 	bigtableProject := flag.String("bigtable-project", "", "bigtable project")
 	bigtableInstance := flag.String("bigtable-instance", "", "bigtable instance")
 	bigtableKeyFile := flag.String("bigtable-key-file", "", "bigtable key file")
+	indexes := flag.String("indexes", "", "comma separated property indexes to maintain (user.email,post.slug)")
+	unique := flag.String("unique", "", "comma separated unique property indexes to maintain (user.email)")
+	rebuild := flag.Bool("rebuild-indexes", false, "rebuild the indexes from the nodes in the store")
+	maxQueryTime := flag.Duration("max-query-time", 30*time.Second, "maximum time a traversal may run for (0 for no limit)")
+	maxScanned := flag.Int64("max-scanned", 0, "maximum keys a traversal may scan (0 for no limit)")
+	maxFrontier := flag.Int64("max-frontier", 0, "maximum nodes a traversal may reach at any step (0 for no limit)")
+	changes := flag.Bool("changes", false, "keep a feed of the changes to the graph, served at /v1/changes")
 
 	flag.Parse()
 
+	ctx := context.Background()
+
+	s := openStore(ctx, *backend, *db, *bigtableProject, *bigtableInstance, *bigtableKeyFile)
+	defer s.Close()
+
+	g := graph.New(s)
+	g.SetBudget(graph.Budget{
+		Timeout:     *maxQueryTime,
+		MaxScanned:  *maxScanned,
+		MaxFrontier: *maxFrontier,
+	})
+
+	setup(ctx, g, *indexes, *unique, *rebuild, *changes)
+
+	serve := server.New(g)
+
+	serve.Serve(*listen)
+}
+
+// analyze runs an analytics job over the graph, either writing the results to a property of the nodes or printing
+// them one JSON result per line.
+func analyze(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	db := flags.String("db", "main", "database name")
+	backend := flags.String("backend", "bolt", "backend to use (bolt, bigtable)")
+	bigtableProject := flags.String("bigtable-project", "", "bigtable project")
+	bigtableInstance := flags.String("bigtable-instance", "", "bigtable instance")
+	bigtableKeyFile := flags.String("bigtable-key-file", "", "bigtable key file")
+	algorithm := flags.String("algorithm", "pagerank", "algorithm to run ("+strings.Join(analytics.Names(), ", ")+")")
+	nodeTypes := flags.String("node-types", "", "comma separated node types to include (all when empty)")
+	edgeTypes := flags.String("edge-types", "", "comma separated edge types to include (all when empty)")
+	property := flags.String("property", "", "node property to write the results to (printed when empty)")
+	indexes := flags.String("indexes", "", "comma separated property indexes to maintain when writing the results")
+	unique := flags.String("unique", "", "comma separated unique property indexes to maintain when writing the results")
+	changes := flags.Bool("changes", false, "add the writes of the results to the change feed")
+	iterations := flags.Int("iterations", 0, "pagerank iterations (default 20)")
+	damping := flags.Float64("damping", 0, "pagerank damping factor (default 0.85)")
+
+	flags.Parse(args)
+
+	ctx := context.Background()
+
+	s := openStore(ctx, *backend, *db, *bigtableProject, *bigtableInstance, *bigtableKeyFile)
+	defer s.Close()
+
+	j, err := analytics.NewJob(analytics.Spec{
+		Algorithm: *algorithm,
+		Selection: analytics.Selection{NodeTypes: split(*nodeTypes), EdgeTypes: split(*edgeTypes)},
+		Options:   analytics.Options{Iterations: *iterations, Damping: *damping},
+		Property:  *property,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	g := graph.New(s)
+	setup(ctx, g, *indexes, *unique, false, *changes)
+
+	if err := j.Run(ctx, g); err != nil {
+		log.Fatal("analyze failed: ", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, res := range j.Results() {
+		enc.Encode(res)
+	}
+}
+
+// setup declares the indexes of the graph, rebuilding them when asked, and tracks changes when asked. Every process
+// writing to the store must set up the graph the same way to keep the indexes and change feed complete.
+func setup(ctx context.Context, g *graph.Graph, indexes, unique string, rebuild, changes bool) {
+	for _, spec := range split(indexes) {
+		idx, err := graph.ParseIndex(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = g.CreateIndex(ctx, idx.NodeType, idx.Property)
+		if err != nil {
+			log.Fatal("could not create index: ", err)
+		}
+	}
+
+	for _, spec := range split(unique) {
+		idx, err := graph.ParseIndex(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = g.CreateUniqueIndex(ctx, idx.NodeType, idx.Property)
+		if err != nil {
+			log.Fatal("could not create unique index: ", err)
+		}
+	}
+
+	if rebuild {
+		for _, idx := range g.Indexes() {
+			if err := g.RebuildIndex(ctx, idx.NodeType, idx.Property); err != nil {
+				log.Fatal("could not rebuild index: ", err)
+			}
+		}
+	}
+
+	if changes {
+		if err := g.TrackChanges(ctx); err != nil {
+			log.Fatal("could not track changes: ", err)
+		}
+	}
+}
+
+func openStore(ctx context.Context, backend, db, bigtableProject, bigtableInstance, bigtableKeyFile string) store.Store {
 	var s store.Store
-	if *backend == "bolt" {
-		s = bolt.NewBoltStore(*db)
-	} else if *backend == "bigtable" {
-		s = bigtable.NewBigtableStore(*db, *bigtableProject, *bigtableInstance, *bigtableKeyFile)
+	if backend == "bolt" {
+		s = bolt.NewBoltStore(db)
+	} else if backend == "bigtable" {
+		s = bigtable.NewBigtableStore(db, bigtableProject, bigtableInstance, bigtableKeyFile)
 	} else {
 		log.Fatal("backend not recognized:", backend)
 	}
 
-	err := s.Open()
+	err := s.Open(ctx)
 	if err != nil {
 		log.Fatal("could not start store: ", err)
 	}
+	return s
+}
 
-	defer s.Close()
-
-	g := graph.New(s)
-	serve := server.New(g)
-
-	serve.Serve(*listen)
+func split(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
 }
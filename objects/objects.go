@@ -26,15 +26,28 @@ const (
 	NoneType ObjectType = iota
 	NodeType
 	EdgeType
+	IndexType
+	ChangeType
 )
 
+// Keys starting with 1 to 4 are reserved for forward edges, reverse edges, index entries and changes, every other key
+// is the key of a node. Node types, and so node keys, can therefore not start with any of these prefixes, see
+// Reserved.
 const (
 	ForwardEdgeKey = "1"
 	ReverseEdgeKey = "2"
+	IndexKey       = "3"
+	ChangeKey      = "4"
 	NodeSep        = "_"
 	PathSep        = "/"
 )
 
+// Reserved returns true when the name starts with one of the reserved key prefixes, such a name cannot be used as a
+// node type.
+func Reserved(name string) bool {
+	return name != "" && name[0] >= ForwardEdgeKey[0] && name[0] <= ChangeKey[0]
+}
+
 func concat(args ...string) (buff string) {
 	for _, arg := range args {
 		buff += arg
@@ -65,7 +78,7 @@ func (n *Node) Key() string {
 }
 
 func (n *Node) Object() *Object {
-	return &Object{n.Key(), n.Body}
+	return &Object{Key: n.Key(), Val: n.Body}
 }
 
 func (n *Node) ResourceID() string {
@@ -140,12 +153,33 @@ func (e *Edge) ResourceID() string {
 }
 
 func (e *Edge) Object() *Object {
-	return &Object{e.ForwardKey(), e.Body}
+	return &Object{Key: e.ForwardKey(), Val: e.Body}
 }
 
 type Object struct {
 	Key string
 	Val map[string]interface{}
+
+	// Path is the nodes and edges a traversal followed to reach the object, ending with the object itself. It is
+	// only set when a traversal returns paths.
+	Path []*Object
+
+	// Matches are the objects found by each optional step of a traversal from the object, in the order of the steps.
+	Matches [][]*Object
+}
+
+// PathKey returns a key identifying the nodes and edges of the path, an edge is identified the same way whichever
+// direction it was followed in.
+func (o *Object) PathKey() string {
+	keys := make([]string, 0, len(o.Path))
+	for _, p := range o.Path {
+		if p.IsEdge() {
+			keys = append(keys, p.Edge().ForwardKey())
+		} else {
+			keys = append(keys, p.Key)
+		}
+	}
+	return strings.Join(keys, " ")
 }
 
 func (o *Object) Type() ObjectType {
@@ -157,6 +191,10 @@ func (o *Object) Type() ObjectType {
 		return EdgeType
 	} else if string(o.Key[0]) == ForwardEdgeKey {
 		return EdgeType
+	} else if string(o.Key[0]) == IndexKey {
+		return IndexType
+	} else if string(o.Key[0]) == ChangeKey {
+		return ChangeType
 	} else {
 		return NodeType
 	}
@@ -210,27 +248,40 @@ func (o *Object) Edge() *Edge {
 }
 
 func (o *Object) MarshalJSON() (data []byte, err error) {
+	var path []*pathElem
+	for _, p := range o.Path {
+		path = append(path, (*pathElem)(p))
+	}
+
 	if o.IsNode() {
 		n := o.Node()
 		data, err = json.Marshal(struct {
-			Type       string `json:"type"`
-			ResourceID string `json:"resource_id"`
-			Node       *Node  `json:"node"`
+			Type       string      `json:"type"`
+			ResourceID string      `json:"resource_id"`
+			Node       *Node       `json:"node"`
+			Path       []*pathElem `json:"path,omitempty"`
+			Matches    [][]*Object `json:"matches,omitempty"`
 		}{
 			Type:       "node",
 			Node:       n,
 			ResourceID: n.ResourceID(),
+			Path:       path,
+			Matches:    o.Matches,
 		})
 	} else if o.IsEdge() {
 		e := o.Edge()
 		data, err = json.Marshal(struct {
-			Type       string `json:"type"`
-			ResourceID string `json:"resource_id"`
-			Edge       *Edge  `json:"edge"`
+			Type       string      `json:"type"`
+			ResourceID string      `json:"resource_id"`
+			Edge       *Edge       `json:"edge"`
+			Path       []*pathElem `json:"path,omitempty"`
+			Matches    [][]*Object `json:"matches,omitempty"`
 		}{
 			Type:       "edge",
 			ResourceID: e.ResourceID(),
 			Edge:       e,
+			Path:       path,
+			Matches:    o.Matches,
 		})
 	} else {
 		data = []byte(`{"type": "none"}`)
@@ -238,6 +289,13 @@ func (o *Object) MarshalJSON() (data []byte, err error) {
 	return
 }
 
+// pathElem is an object of a path, written without its own path.
+type pathElem Object
+
+func (p *pathElem) MarshalJSON() ([]byte, error) {
+	return (&Object{Key: p.Key, Val: p.Val}).MarshalJSON()
+}
+
 func GenId() string {
 	r := rand.Int63n(9000000000000000000)
 	return fmt.Sprintf("%vn", r)
@@ -49,3 +49,11 @@ func TestEdge(t *testing.T) {
 	}
 
 }
+
+func TestReserved(t *testing.T) {
+	for name, exp := range map[string]bool{"user": false, "": false, "0": false, "5x": false, "1": true, "3d_model": true, "42": true} {
+		if Reserved(name) != exp {
+			t.Fatalf("expected reserved %v for %q", exp, name)
+		}
+	}
+}
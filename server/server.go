@@ -1,22 +1,36 @@
 package server
 
 import (
+	"github.com/coldog/go-graph/analytics"
 	"github.com/coldog/go-graph/graph"
+	"github.com/coldog/go-graph/objects"
 
 	"github.com/julienschmidt/httprouter"
 
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// maxPaged limits the nodes found by each step of a paged node query.
+const maxPaged = 10000
+
+// maxChanges limits the changes returned by a request to the change feed.
+const maxChanges = 1000
+
 func New(g *graph.Graph) *Server {
-	return &Server{g}
+	return &Server{g: g, jobs: analytics.NewJobs(g)}
 }
 
 type Server struct {
-	g *graph.Graph
+	g    *graph.Graph
+	jobs *analytics.Jobs
 }
 
 func (s *Server) traversalQuery(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
@@ -25,15 +39,122 @@ func (s *Server) traversalQuery(w http.ResponseWriter, r *http.Request, rp httpr
 	t := s.g.Traversal()
 	err := json.NewDecoder(r.Body).Decode(t)
 	if err != nil {
-		w.Write([]byte(`{"error": "JsonErr"}`))
-		w.WriteHeader(400)
+		handleErr(w, 400, err)
+		return
+	}
+
+	s.runTraversal(w, r, t)
+}
+
+// textQuery runs a query written in the text query language, see graph.ParseQuery. The body of the request is the
+// query and the response is that of a traversal.
+func (s *Server) textQuery(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	src, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	t, err := s.g.Query(string(src))
+	if err != nil {
+		handleErr(w, queryStatus(err), err)
+		return
+	}
+
+	s.runTraversal(w, r, t)
+}
+
+// runTraversal runs the traversal writing out the results, or the plan or profile when asked for.
+func (s *Server) runTraversal(w http.ResponseWriter, r *http.Request, t *graph.Traversal) {
+	var err error
+	if r.URL.Query().Get("explain") == "true" {
+		steps, err := s.g.Explain(t)
+		if err != nil {
+			handleErr(w, queryStatus(err), err)
+			return
+		}
+
+		data, err := json.Marshal(map[string]interface{}{
+			"plan": steps,
+		})
+		if err != nil {
+			handleErr(w, 500, err)
+			return
+		}
+
+		w.Write(data)
+		return
+	}
+
+	if streamed(r) && r.URL.Query().Get("profile") != "true" {
+		s.streamTraversal(w, r, t)
+		return
+	}
+
+	var res []*objects.Object
+	out := map[string]interface{}{}
+	if r.URL.Query().Get("profile") == "true" {
+		var steps []*graph.StepProfile
+		res, steps, err = s.g.Profile(r.Context(), t)
+		out["profile"] = steps
+	} else if t.Aggregation != nil {
+		out["value"], err = s.g.Aggregate(r.Context(), t)
+	} else {
+		var cursor string
+		res, cursor, err = s.g.RunPage(r.Context(), t)
+		if cursor != "" {
+			out["cursor"] = cursor
+		}
+	}
+
+	// traversals selecting labelled steps respond with rows and aggregated traversals with the value rather than
+	// results.
+	if err == nil && len(t.Selects) > 0 {
+		out["rows"], err = graph.Rows(t, res)
+	} else if t.Aggregation == nil {
+		out["results"] = res
+	}
+
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Println("[WARN] server: traversal cancelled", err)
+			return
+		}
+
+		handleErr(w, queryStatus(err), err)
+		return
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// putQuery stores the query in the body under the name, see graph.StoredQuery. The query is checked before it is
+// stored.
+func (s *Server) putQuery(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q := &graph.StoredQuery{}
+	if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+		handleErr(w, 400, err)
 		return
 	}
+	q.Name = rp.ByName("name")
 
-	res := s.g.Run(t)
+	if err := s.g.PutQuery(r.Context(), q); err != nil {
+		handleErr(w, 400, err)
+		return
+	}
 
 	data, err := json.Marshal(map[string]interface{}{
-		"results": res,
+		"query": q,
 	})
 	if err != nil {
 		handleErr(w, 500, err)
@@ -43,6 +164,153 @@ func (s *Server) traversalQuery(w http.ResponseWriter, r *http.Request, rp httpr
 	w.Write(data)
 }
 
+func (s *Server) listQueries(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	queries, err := s.g.Queries(r.Context())
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"queries": queries,
+	})
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// getQuery returns a stored query. Deleting a query removes it.
+func (s *Server) getQuery(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q, err := s.g.GetQuery(r.Context(), rp.ByName("name"))
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	if q == nil {
+		handleErr(w, 404, fmt.Errorf("query %s not found", rp.ByName("name")))
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if err := s.g.DeleteQuery(r.Context(), q.Name); err != nil {
+			handleErr(w, 500, err)
+			return
+		}
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"query": q,
+	})
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// runQuery runs a stored query with the parameters in the body. The response is that of a traversal.
+func (s *Server) runQuery(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	t, err := s.g.Stored(r.Context(), rp.ByName("name"), params)
+	if err != nil {
+		handleErr(w, queryStatus(err), err)
+		return
+	}
+
+	if t == nil {
+		handleErr(w, 404, fmt.Errorf("query %s not found", rp.ByName("name")))
+		return
+	}
+
+	s.runTraversal(w, r, t)
+}
+
+// streamTraversal writes each result of the traversal on its own line as soon as it is found, or a row for each
+// result of traversals selecting labelled steps. The last line is a trailer holding the stats of the traversal, see
+// graph.StreamStats, or the error it failed with once results have been written.
+func (s *Server) streamTraversal(w http.ResponseWriter, r *http.Request, t *graph.Traversal) {
+	if len(t.Selects) > 0 {
+		if _, err := graph.Rows(t, nil); err != nil {
+			handleErr(w, queryStatus(err), err)
+			return
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	started := false
+	write := func(v interface{}) error {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	stats, err := s.g.Stream(r.Context(), t, func(o *objects.Object) error {
+		if len(t.Selects) == 0 {
+			return write(o)
+		}
+
+		rows, err := graph.Rows(t, []*objects.Object{o})
+		if err != nil {
+			return err
+		}
+		return write(rows[0])
+	})
+
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Println("[WARN] server: traversal cancelled", err)
+			return
+		}
+
+		if !started {
+			handleErr(w, queryStatus(err), err)
+			return
+		}
+
+		log.Println("[ERROR] server: err", err)
+		write(map[string]interface{}{
+			"error":   err,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	write(map[string]interface{}{
+		"stats": stats,
+	})
+}
+
+// streamed returns true when the client asked for results as newline delimited JSON.
+func streamed(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
 func (s *Server) pathQuery(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -56,19 +324,358 @@ func (s *Server) pathQuery(w http.ResponseWriter, r *http.Request, rp httprouter
 		t.Out(rp.ByName("out"))
 	}
 
-	res := t.All()
+	// paged queries return pages of 50 results sorted by key. The nodes of a type are read a page at a time, the
+	// nodes reached by a hop are paged out of those found and the query fails when the hop hits its limit.
+	q := r.URL.Query()
+	if q.Get("cursor") != "" || q.Get("paged") == "true" {
+		t.Limit(maxPaged).Page(50, q.Get("cursor"))
+	}
+
+	if streamed(r) {
+		s.streamTraversal(w, r, t)
+		return
+	}
+
+	res, cursor, err := s.g.RunPage(r.Context(), t)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Println("[WARN] server: traversal cancelled", err)
+			return
+		}
 
-	data, err := json.Marshal(map[string]interface{}{
+		handleErr(w, queryStatus(err), err)
+		return
+	}
+
+	out := map[string]interface{}{
 		"results": res,
+	}
+	if cursor != "" {
+		out["cursor"] = cursor
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// shortestPath returns the shortest paths between the source and target nodes, see graph.ShortestPath.
+func (s *Server) shortestPath(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req := struct {
+		graph.ShortestPathOptions
+		Source string `json:"source"`
+		Target string `json:"target"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	res, err := s.g.ShortestPath(r.Context(), req.Source, req.Target, req.ShortestPathOptions)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Println("[WARN] server: shortest path cancelled", err)
+			return
+		}
+
+		status := 400
+		if _, ok := err.(*graph.BudgetError); ok {
+			status = 422
+		}
+		handleErr(w, status, err)
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"paths": res,
+	})
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// startJob starts an analytics job in the background, see analytics.Spec.
+func (s *Server) startJob(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	spec := analytics.Spec{}
+	err := json.NewDecoder(r.Body).Decode(&spec)
+	if err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	j, err := s.jobs.Start(spec)
+	if err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"job": j.Status(),
 	})
 	if err != nil {
 		handleErr(w, 500, err)
 		return
 	}
 
+	w.WriteHeader(202)
 	w.Write(data)
 }
 
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	jobs := []analytics.Job{}
+	for _, j := range s.jobs.List() {
+		jobs = append(jobs, j.Status())
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"jobs": jobs,
+	})
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// getJob returns the state and progress of a job. Deleting a job cancels it if it is still running.
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var j *analytics.Job
+	if r.Method == "DELETE" {
+		j = s.jobs.Remove(rp.ByName("id"))
+	} else {
+		j = s.jobs.Get(rp.ByName("id"))
+	}
+
+	if j == nil {
+		handleErr(w, 404, fmt.Errorf("job %s not found", rp.ByName("id")))
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"job": j.Status(),
+	})
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// jobResults streams the results of a finished job which did not write them back, one JSON result per line.
+func (s *Server) jobResults(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	j := s.jobs.Get(rp.ByName("id"))
+	if j == nil {
+		w.Header().Set("Content-Type", "application/json")
+		handleErr(w, 404, fmt.Errorf("job %s not found", rp.ByName("id")))
+		return
+	}
+
+	if st := j.Status(); st.State != analytics.Done || st.Spec.Property != "" {
+		w.Header().Set("Content-Type", "application/json")
+		handleErr(w, 409, fmt.Errorf("job %s has no results to return", j.ID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, res := range j.Results() {
+		if err := enc.Encode(res); err != nil {
+			log.Println("[WARN] server: writing job results", err)
+			return
+		}
+	}
+}
+
+// changes returns up to ?limit= changes to the graph after the sequence number ?since=, see graph.Change. With
+// ?wait= the request waits up to the duration for the next change when there are none yet. Requests accepting
+// text/event-stream are sent each change as an event once it is committed, resuming after the Last-Event-ID.
+func (s *Server) changes(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q := r.URL.Query()
+	since, err := intParam(q.Get("since"), 0)
+	if err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since, err = intParam(id, 0)
+		if err != nil {
+			handleErr(w, 400, err)
+			return
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.changeEvents(w, r, since)
+		return
+	}
+
+	limit, err := intParam(q.Get("limit"), 100)
+	if err != nil || limit <= 0 || limit > maxChanges {
+		handleErr(w, 400, fmt.Errorf("limit must be between 1 and %d", maxChanges))
+		return
+	}
+
+	var list []*graph.Change
+	if q.Get("wait") != "" {
+		wait, perr := time.ParseDuration(q.Get("wait"))
+		if perr != nil {
+			handleErr(w, 400, perr)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		list, err = s.g.Poll(ctx, since, int(limit))
+		cancel()
+	} else {
+		list, err = s.g.Changes(r.Context(), since, int(limit))
+	}
+
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	// seq is the sequence number to pass as since for the following changes.
+	seq := since
+	if len(list) > 0 {
+		seq = list[len(list)-1].Seq
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"changes": list,
+		"seq":     seq,
+	})
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
+// changeEvents sends each change after since as a server sent event until the client goes away.
+func (s *Server) changeEvents(w http.ResponseWriter, r *http.Request, since int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleErr(w, 500, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	res, errc := s.g.Subscribe(r.Context(), since)
+	for c := range res {
+		if err := writeEvent(w, flusher, strconv.FormatInt(c.Seq, 10), "change", c); err != nil {
+			log.Println("[WARN] server: writing change", err)
+		}
+	}
+
+	if err := <-errc; err != nil {
+		log.Println("[ERROR] server: err", err)
+		writeEvent(w, flusher, "", "error", map[string]interface{}{
+			"error":   err,
+			"message": err.Error(),
+		})
+	}
+}
+
+// watchQuery watches the traversal in the body, sending the results entering and leaving its results as server sent
+// events, see graph.Watch.
+func (s *Server) watchQuery(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	t := s.g.Traversal()
+	if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	s.watchTraversal(w, r, t)
+}
+
+// watchStored watches the stored query with the parameters in the body like watchQuery.
+func (s *Server) watchStored(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	t, err := s.g.Stored(r.Context(), rp.ByName("name"), params)
+	if err != nil {
+		handleErr(w, queryStatus(err), err)
+		return
+	}
+
+	if t == nil {
+		handleErr(w, 404, fmt.Errorf("query %s not found", rp.ByName("name")))
+		return
+	}
+
+	s.watchTraversal(w, r, t)
+}
+
+// watchTraversal sends an enter or leave event for each result entering or leaving the results of the traversal
+// until the client goes away. The ID of each event is the sequence number of the change feed it was found at.
+func (s *Server) watchTraversal(w http.ResponseWriter, r *http.Request, t *graph.Traversal) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleErr(w, 500, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	res, errc, err := s.g.Watch(r.Context(), t)
+	if err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	for c := range res {
+		if err := writeEvent(w, flusher, strconv.FormatInt(c.Seq, 10), c.Op, c.Object); err != nil {
+			log.Println("[WARN] server: writing result change", err)
+		}
+	}
+
+	if err := <-errc; err != nil {
+		log.Println("[ERROR] server: err", err)
+		writeEvent(w, flusher, "", "error", map[string]interface{}{
+			"error":   err,
+			"message": err.Error(),
+		})
+	}
+}
+
 func (s *Server) createResource(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -90,9 +697,9 @@ func (s *Server) createResource(w http.ResponseWriter, r *http.Request, rp httpr
 		return
 	}
 
-	res, err := s.g.PutByResourceID(rp.ByName("id"), body)
+	res, err := s.g.PutByResourceID(r.Context(), rp.ByName("id"), body)
 	if err != nil {
-		handleErr(w, 400, err)
+		handleErr(w, writeStatus(err), err)
 		return
 	}
 
@@ -110,7 +717,7 @@ func (s *Server) createResource(w http.ResponseWriter, r *http.Request, rp httpr
 func (s *Server) getResource(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	res, err := s.g.GetByResourceID(rp.ByName("id"))
+	res, err := s.g.GetByResourceID(r.Context(), rp.ByName("id"))
 	if err != nil {
 		handleErr(w, 400, err)
 		return
@@ -130,12 +737,18 @@ func (s *Server) getResource(w http.ResponseWriter, r *http.Request, rp httprout
 func (s *Server) delResource(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	res, err := s.g.DelByResourceID(rp.ByName("id"))
+	mode, err := deleteMode(r.URL.Query().Get("mode"))
 	if err != nil {
 		handleErr(w, 400, err)
 		return
 	}
 
+	res, err := s.g.DelByResourceID(r.Context(), rp.ByName("id"), mode)
+	if err != nil {
+		handleErr(w, writeStatus(err), err)
+		return
+	}
+
 	data, err := json.Marshal(map[string]interface{}{
 		"object": res,
 	})
@@ -147,6 +760,69 @@ func (s *Server) delResource(w http.ResponseWriter, r *http.Request, rp httprout
 	w.Write(data)
 }
 
+type batchOp struct {
+	Op         string                 `json:"op"`
+	ResourceID string                 `json:"resource_id"`
+	Body       map[string]interface{} `json:"body"`
+	Mode       string                 `json:"mode"`
+}
+
+// batch applies a list of put and del operations in order as a single batch. Whether a batch which fails to commit
+// may leave some of the operations written depends on the store, see store.Store.Begin.
+func (s *Server) batch(w http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req := struct {
+		Operations []batchOp `json:"operations"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		handleErr(w, 400, err)
+		return
+	}
+
+	b := s.g.Begin(r.Context())
+	res := []*objects.Object{}
+	for i, op := range req.Operations {
+		var o *objects.Object
+
+		switch op.Op {
+		case "put":
+			o, err = b.PutByResourceID(op.ResourceID, op.Body)
+		case "del":
+			var mode graph.DeleteMode
+			mode, err = deleteMode(op.Mode)
+			if err == nil {
+				o, err = b.DelByResourceID(op.ResourceID, mode)
+			}
+		default:
+			err = fmt.Errorf("unknown op %s", op.Op)
+		}
+
+		if err != nil {
+			handleErr(w, writeStatus(err), fmt.Errorf("operation %d: %v", i, err))
+			return
+		}
+		res = append(res, o)
+	}
+
+	err = b.Commit()
+	if err != nil {
+		handleErr(w, writeStatus(err), err)
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"objects": res,
+	})
+	if err != nil {
+		handleErr(w, 500, err)
+		return
+	}
+
+	w.Write(data)
+}
+
 func (s *Server) Serve(addr string) {
 	router := httprouter.New()
 
@@ -164,6 +840,27 @@ func (s *Server) Serve(addr string) {
 	router.GET("/v1/query/nodes/:type/:id/:out", s.pathQuery)
 
 	router.POST("/v1/traverse", s.traversalQuery)
+	router.POST("/v1/query", s.textQuery)
+	router.POST("/v1/watch", s.watchQuery)
+
+	router.GET("/v1/queries", s.listQueries)
+	router.PUT("/v1/queries/:name", s.putQuery)
+	router.GET("/v1/queries/:name", s.getQuery)
+	router.DELETE("/v1/queries/:name", s.getQuery)
+	router.POST("/v1/queries/:name/run", s.runQuery)
+	router.POST("/v1/queries/:name/watch", s.watchStored)
+
+	router.POST("/v1/paths/shortest", s.shortestPath)
+
+	router.POST("/v1/jobs", s.startJob)
+	router.GET("/v1/jobs", s.listJobs)
+	router.GET("/v1/jobs/:id", s.getJob)
+	router.DELETE("/v1/jobs/:id", s.getJob)
+	router.GET("/v1/jobs/:id/results", s.jobResults)
+
+	router.POST("/v1/batch", s.batch)
+
+	router.GET("/v1/changes", s.changes)
 
 	router.PUT("/v1/resources/:id", s.createResource)
 	router.GET("/v1/resources/:id", s.getResource)
@@ -173,6 +870,67 @@ func (s *Server) Serve(addr string) {
 	log.Fatal(http.ListenAndServe(addr, router))
 }
 
+func deleteMode(mode string) (graph.DeleteMode, error) {
+	switch mode {
+	case "", "cascade":
+		return graph.Cascade, nil
+	case "restrict":
+		return graph.Restrict, nil
+	}
+	return 0, fmt.Errorf("unknown delete mode %s", mode)
+}
+
+// writeEvent writes the value as a server sent event and flushes it to the client.
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, id, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// intParam parses an integer parameter which defaults to def when empty.
+func intParam(v string, def int64) (int64, error) {
+	if v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q", v)
+	}
+	return i, nil
+}
+
+// queryStatus returns the status code for an error returned when running a traversal.
+func queryStatus(err error) int {
+	switch err.(type) {
+	case *graph.SyntaxError, *graph.CursorError, *graph.ParamError, *graph.TraversalError:
+		return 400
+	case *graph.BudgetError, *graph.TruncatedError:
+		return 422
+	}
+	return 500
+}
+
+// writeStatus returns the status code for an error returned when writing to the graph.
+func writeStatus(err error) int {
+	switch err.(type) {
+	case *graph.ConflictError, *graph.HasEdgesError:
+		return 409
+	}
+	return 400
+}
+
 func handleErr(w http.ResponseWriter, status int, err error) {
 	log.Println("[ERROR] server: err", err)
 	data, jerr := json.Marshal(map[string]interface{} {
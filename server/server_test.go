@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/coldog/go-graph/graph"
+	"github.com/coldog/go-graph/store/bolt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraversalQuery_SyntaxError(t *testing.T) {
+	s := New(graph.New(bolt.NewBoltStore("test")))
+
+	r := httptest.NewRequest("POST", "/v1/traverse", strings.NewReader(`{"type": "user", "filters": ["n >"]}`))
+	w := httptest.NewRecorder()
+	s.traversalQuery(w, r, nil)
+
+	if w.Code != 400 {
+		t.Fatalf("expected a 400 got %d: %s", w.Code, w.Body)
+	}
+
+	res := struct {
+		Error graph.SyntaxError `json:"error"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Error.Line != 1 || res.Error.Column != 4 {
+		t.Fatalf("expected the position of the syntax error got %s", w.Body)
+	}
+}
+
+func TestTraversalQuery_Invalid(t *testing.T) {
+	s := New(graph.New(bolt.NewBoltStore("test")))
+
+	for _, body := range []string{
+		`{"type": "user", "next": {"types": ["follows"], "target": {"budget": {"max_scanned": 10}}}}`,
+		`{"type": "user", "next": {"types": ["follows"], "other": true, "target": {}}}`,
+		`{"type": "user", "select": ["a"]}`,
+	} {
+		r := httptest.NewRequest("POST", "/v1/traverse", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.traversalQuery(w, r, nil)
+
+		if w.Code != 400 {
+			t.Fatalf("expected a 400 for %s got %d: %s", body, w.Code, w.Body)
+		}
+	}
+}
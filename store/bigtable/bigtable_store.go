@@ -2,12 +2,13 @@ package bigtable
 
 import (
 	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
 
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/bigtable"
 
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
@@ -55,21 +56,25 @@ func (s *BigTableStore) worker() {
 
 			if len(local) >= queueSize {
 				log.Println("[DEBUG] bigtable-store: inserting", len(local))
-				s.put(local...)
+				if err := s.put(context.Background(), local...); err != nil {
+					log.Println("[ERROR] bigtable-store: insert failed", err)
+				}
 				local = []*objects.Object{}
 			}
 
 		default:
 			if len(local) > 0 {
 				log.Println("[DEBUG] bigtable-store: inserting", len(local))
-				s.put(local...)
+				if err := s.put(context.Background(), local...); err != nil {
+					log.Println("[ERROR] bigtable-store: insert failed", err)
+				}
 				local = []*objects.Object{}
 			}
 		}
 	}
 }
 
-func (s *BigTableStore) Flush() {
+func (s *BigTableStore) Flush(ctx context.Context) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -79,26 +84,26 @@ func (s *BigTableStore) Flush() {
 		select {
 		case obj, ok := <-s.queue:
 			if !ok {
-				return
+				return nil
 			}
 
 			local = append(local, obj)
 			if len(local) >= queueSize {
 				log.Println("[DEBUG] bigtable-store: flush", len(local))
-				s.put(local...)
+				if err := s.put(ctx, local...); err != nil {
+					return err
+				}
+				local = []*objects.Object{}
 			}
 
 		default:
 			log.Println("[DEBUG] bigtable-store: flush", len(local))
-			s.put(local...)
-			return
+			return s.put(ctx, local...)
 		}
 	}
 }
 
-func (db *BigTableStore) Open() error {
-	ctx := context.Background()
-
+func (db *BigTableStore) Open(ctx context.Context) error {
 	jsonKey, err := ioutil.ReadFile(db.keyFile)
 	if err != nil {
 		return err
@@ -124,17 +129,17 @@ func (db *BigTableStore) Open() error {
 		return err
 	}
 
-	_, err = admin.TableInfo(context.Background(), db.tableName)
+	_, err = admin.TableInfo(ctx, db.tableName)
 	if err != nil {
 		log.Println("[INFO] bigtable-store: creating table", db.tableName)
 
-		err := admin.CreateTable(context.Background(), db.tableName)
+		err := admin.CreateTable(ctx, db.tableName)
 		if err != nil {
 			log.Println("[ERROR] bigtable-store: create table failed", err)
 			return err
 		}
 
-		err = admin.CreateColumnFamily(context.Background(), db.tableName, "body")
+		err = admin.CreateColumnFamily(ctx, db.tableName, "body")
 		if err != nil {
 			log.Println("[ERROR] bigtable-store: column failed", err)
 			return err
@@ -150,22 +155,17 @@ func (db *BigTableStore) Open() error {
 	return nil
 }
 
-func (db *BigTableStore) put(objs ...*objects.Object) error {
-	ctx := context.Background()
+func (db *BigTableStore) put(ctx context.Context, objs ...*objects.Object) error {
+	if len(objs) == 0 {
+		return nil
+	}
 
 	keys := []string{}
 	values := []*bigtable.Mutation{}
 
 	for _, obj := range objs {
-		mut := bigtable.NewMutation()
-
-		mut.Set("body", "id", bigtable.Now(), []byte(obj.Key))
-
-		for k, v := range obj.Val {
-			mut.Set("body", k, bigtable.Now(), encode(v))
-		}
 		keys = append(keys, obj.Key)
-		values = append(values, mut)
+		values = append(values, mutation(obj))
 	}
 
 	errs, err := db.table.ApplyBulk(ctx, keys, values)
@@ -180,20 +180,104 @@ func (db *BigTableStore) put(objs ...*objects.Object) error {
 	return nil
 }
 
-func (s *BigTableStore) Put(objs ...*objects.Object) error {
+func mutation(obj *objects.Object) *bigtable.Mutation {
+	return set(bigtable.NewMutation(), obj)
+}
+
+// set adds the cells of the object to the mutation.
+func set(mut *bigtable.Mutation, obj *objects.Object) *bigtable.Mutation {
+	mut.Set("body", "id", bigtable.Now(), []byte(obj.Key))
+
+	for k, v := range obj.Val {
+		mut.Set("body", k, bigtable.Now(), encode(v))
+	}
+	return mut
+}
+
+func (s *BigTableStore) Put(ctx context.Context, objs ...*objects.Object) error {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
 	for _, obj := range objs {
-		s.queue <- obj
+		select {
+		case s.queue <- obj:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Begin starts a batch of writes. Bigtable only guarantees atomicity for the mutations of a single row, so a batch
+// is applied on a best effort basis: every row is written in a single bulk request when the batch is committed but a
+// failed commit may leave some of the rows written. Commit waits for any queued puts to be flushed first so the batch
+// is never overwritten by earlier writes.
+//
+// The rows of a bulk request are applied in no particular order, so the writes to each row are collected into a
+// single mutation of the row which applies them in order.
+func (s *BigTableStore) Begin() store.Batch {
+	return &bigtableBatch{store: s, muts: map[string]*bigtable.Mutation{}}
+}
+
+type bigtableBatch struct {
+	store *BigTableStore
+	keys  []string
+	muts  map[string]*bigtable.Mutation
+}
+
+// row returns the mutation collecting the writes to the row with the key.
+func (b *bigtableBatch) row(key string) *bigtable.Mutation {
+	mut, ok := b.muts[key]
+	if !ok {
+		mut = bigtable.NewMutation()
+		b.muts[key] = mut
+		b.keys = append(b.keys, key)
+	}
+	return mut
+}
+
+func (b *bigtableBatch) Put(objs ...*objects.Object) {
+	for _, obj := range objs {
+		set(b.row(obj.Key), obj)
+	}
+}
+
+func (b *bigtableBatch) Del(objs ...*objects.Object) {
+	for _, obj := range objs {
+		b.row(obj.Key).DeleteRow()
+	}
+}
+
+func (b *bigtableBatch) Commit(ctx context.Context) error {
+	if len(b.keys) == 0 {
+		return nil
+	}
+
+	if err := b.store.Flush(ctx); err != nil {
+		return err
+	}
+
+	muts := make([]*bigtable.Mutation, len(b.keys))
+	for i, key := range b.keys {
+		muts[i] = b.muts[key]
+	}
+
+	errs, err := b.store.table.ApplyBulk(ctx, b.keys, muts)
+	if err != nil {
+		return err
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (s *BigTableStore) Del(objs ...*objects.Object) error {
+func (s *BigTableStore) Del(ctx context.Context, objs ...*objects.Object) error {
 
 	for _, obj := range objs {
-		ctx := context.Background()
 		mut := bigtable.NewMutation()
 		mut.DeleteRow()
 		err := s.table.Apply(ctx, obj.Key, mut)
@@ -220,11 +304,11 @@ func (s *BigTableStore) parseRow(r bigtable.Row) *objects.Object {
 		}
 	}
 
-	return &objects.Object{r.Key(), m}
+	return &objects.Object{Key: r.Key(), Val: m}
 }
 
-func (s *BigTableStore) Get(key string) (*objects.Object, error) {
-	r, err := s.table.ReadRow(context.Background(), key)
+func (s *BigTableStore) Get(ctx context.Context, key string) (*objects.Object, error) {
+	r, err := s.table.ReadRow(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -234,28 +318,41 @@ func (s *BigTableStore) Get(key string) (*objects.Object, error) {
 	return o, nil
 }
 
-func (s *BigTableStore) Drop() {
-	err := s.admin.DeleteTable(context.Background(), s.tableName)
-	if err != nil {
-		log.Println("[ERROR] bigtable-store: failed to drop db", err)
+func (s *BigTableStore) Drop() error {
+	return s.admin.DeleteTable(context.Background(), s.tableName)
+}
+
+func (s *BigTableStore) Prefix(ctx context.Context, prefix string, count int) (<-chan *objects.Object, <-chan error) {
+	log.Println("[DEBUG] bigtable-store: prefix query", prefix)
+	return s.read(ctx, bigtable.PrefixRange(prefix), count)
+}
+
+func (s *BigTableStore) Range(ctx context.Context, start, end string, count int) (<-chan *objects.Object, <-chan error) {
+	log.Println("[DEBUG] bigtable-store: range query", start, end)
+	if end == "" {
+		return s.read(ctx, bigtable.InfiniteRange(start), count)
 	}
+	return s.read(ctx, bigtable.NewRange(start, end), count)
 }
 
-func (s *BigTableStore) Prefix(prefix string, count int) (<-chan *objects.Object, error) {
+// read sends the rows in the range up to count rows.
+func (s *BigTableStore) read(ctx context.Context, rows bigtable.RowSet, count int) (<-chan *objects.Object, <-chan error) {
 	out := make(chan *objects.Object)
-
-	log.Println("[DEBUG] bigtable-store: prefix query", prefix)
+	errc := make(chan error, 1)
 
 	go func() {
-		defer close(out)
-		err := s.table.ReadRows(context.Background(), bigtable.PrefixRange(prefix), func(r bigtable.Row) bool {
+		err := s.table.ReadRows(ctx, rows, func(r bigtable.Row) bool {
 			if r.Key() == "" {
 				return true
 			}
 
 			o := s.parseRow(r)
 
-			out <- o
+			select {
+			case out <- o:
+			case <-ctx.Done():
+				return false
+			}
 
 			count--
 			if count <= 0 {
@@ -265,17 +362,23 @@ func (s *BigTableStore) Prefix(prefix string, count int) (<-chan *objects.Object
 			return true
 		})
 
-		if err != nil {
-			log.Println("[ERROR] bigtable-store: prefix query failed", err)
+		if err == nil {
+			err = ctx.Err()
 		}
 
+		close(out)
+		if err != nil {
+			log.Println("[ERROR] bigtable-store: query failed", err)
+			errc <- err
+		}
+		close(errc)
 	}()
 
-	return out, nil
+	return out, errc
 }
 
-func (s *BigTableStore) Close() {
-	s.Flush()
+func (s *BigTableStore) Close() error {
+	return s.Flush(context.Background())
 }
 
 func (s *BigTableStore) Debug() {}
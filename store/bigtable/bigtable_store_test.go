@@ -3,6 +3,7 @@ package bigtable
 import (
 	"github.com/coldog/go-graph/objects"
 
+	"context"
 	"fmt"
 	"github.com/coldog/go-graph/graph"
 	"path/filepath"
@@ -23,36 +24,38 @@ func TestBigtable_Basics(t *testing.T) {
 		queue:     make(chan *objects.Object, queueSize),
 	}
 
-	err := b.Open()
+	ctx := context.Background()
+
+	err := b.Open(ctx)
 	ok(t, err)
 
 	defer b.Close()
 
 	println("put")
-	err = b.Put(&objects.Object{"test", nil})
+	err = b.Put(ctx, &objects.Object{Key: "test"})
 	ok(t, err)
 
 	println("get")
-	o, err := b.Get("test")
+	o, err := b.Get(ctx, "test")
 	ok(t, err)
 
 	fmt.Printf("%+v\n", o)
 
-	err = b.Put(&objects.Object{"test_1", nil})
+	err = b.Put(ctx, &objects.Object{Key: "test_1"})
 	ok(t, err)
 
-	err = b.Put(&objects.Object{"test_2", nil})
+	err = b.Put(ctx, &objects.Object{Key: "test_2"})
 	ok(t, err)
 
 	time.Sleep(1 * time.Second)
-	out, err := b.Prefix("", 20)
-	ok(t, err)
+	out, errc := b.Prefix(ctx, "", 20)
 
 	for o := range out {
 		fmt.Printf("%+v\n", o)
 	}
+	ok(t, <-errc)
 
-	err = b.Del(&objects.Object{"test", nil})
+	err = b.Del(ctx, &objects.Object{Key: "test"})
 	ok(t, err)
 
 }
@@ -67,26 +70,28 @@ func TestBigtable_Performance(t *testing.T) {
 		lock:      &sync.RWMutex{},
 	}
 
-	err := b.Open()
+	ctx := context.Background()
+
+	err := b.Open(ctx)
 	ok(t, err)
 	defer b.Close()
 	g := graph.New(b)
 
 	t1 := time.Now()
 	for i := 0; i < 50; i++ {
-		g.CreateNode("user", nil)
+		g.CreateNode(ctx, "user", nil)
 	}
 	t2 := time.Now()
 	fmt.Println(float64(t2.UnixNano()) - float64(t1.UnixNano()))
 
-	res, err := b.Prefix("user_", 50)
-	ok(t, err)
+	res, errc := b.Prefix(ctx, "user_", 50)
 
 	c := 0
 	for o := range res {
 		c++
 		fmt.Printf("%+v\n", o)
 	}
+	ok(t, <-errc)
 	equals(t, 50, c)
 }
 
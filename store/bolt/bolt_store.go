@@ -2,15 +2,23 @@ package bolt
 
 import (
 	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
 
 	"github.com/boltdb/bolt"
 
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 )
 
+// prefixBuffer is the largest buffer allocated for the results of a prefix query.
+const prefixBuffer = 1000
+
+// sysBucket holds the records of gq itself, see store.SystemStore.
+var sysBucket = []byte("sys")
+
 func NewBoltStore(name string) *BoltStore {
 	s := &BoltStore{
 		name: name,
@@ -24,7 +32,11 @@ type BoltStore struct {
 	name   string
 }
 
-func (store *BoltStore) Del(objs ...*objects.Object) error {
+func (store *BoltStore) Del(ctx context.Context, objs ...*objects.Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return store.db.Update(func(tx *bolt.Tx) error {
 		for _, obj := range objs {
 			err := tx.Bucket(store.bucket).Delete([]byte(obj.Key))
@@ -36,7 +48,11 @@ func (store *BoltStore) Del(objs ...*objects.Object) error {
 	})
 }
 
-func (store *BoltStore) Put(objs ...*objects.Object) error {
+func (store *BoltStore) Put(ctx context.Context, objs ...*objects.Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return store.db.Update(func(tx *bolt.Tx) error {
 		for _, obj := range objs {
 			err := tx.Bucket(store.bucket).Put([]byte(obj.Key), encode(obj.Val))
@@ -48,11 +64,25 @@ func (store *BoltStore) Put(objs ...*objects.Object) error {
 	})
 }
 
-func (store *BoltStore) Get(key string) (obj *objects.Object, err error) {
-	err = store.db.Update(func(tx *bolt.Tx) error {
+// Begin starts a batch which is committed atomically in a single bolt transaction.
+func (store *BoltStore) Begin() store.Batch {
+	return &boltBatch{store: store}
+}
+
+func (store *BoltStore) Get(ctx context.Context, key string) (obj *objects.Object, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err = store.db.View(func(tx *bolt.Tx) error {
 		data := tx.Bucket(store.bucket).Get([]byte(key))
 		if data != nil {
-			obj = &objects.Object{Key: key, Val: decode(data)}
+			val, err := decode(data)
+			if err != nil {
+				return err
+			}
+
+			obj = &objects.Object{Key: key, Val: val}
 		}
 		return nil
 	})
@@ -60,36 +90,62 @@ func (store *BoltStore) Get(key string) (obj *objects.Object, err error) {
 	return obj, err
 }
 
-func (store *BoltStore) Prefix(prefixStr string, count int) (<-chan *objects.Object, error) {
-	res := make(chan *objects.Object, count)
+func (store *BoltStore) Prefix(ctx context.Context, prefixStr string, count int) (<-chan *objects.Object, <-chan error) {
 	prefix := []byte(prefixStr)
+	return store.scan(ctx, prefix, func(k []byte) bool { return bytes.HasPrefix(k, prefix) }, count)
+}
+
+func (store *BoltStore) Range(ctx context.Context, start, end string, count int) (<-chan *objects.Object, <-chan error) {
+	to := []byte(end)
+	return store.scan(ctx, []byte(start), func(k []byte) bool { return end == "" || bytes.Compare(k, to) < 0 }, count)
+}
+
+// scan sends the objects from the first key at or after seek for as long as the keys are in the query.
+func (store *BoltStore) scan(ctx context.Context, seek []byte, in func(k []byte) bool, count int) (<-chan *objects.Object, <-chan error) {
+	size := count
+	if size > prefixBuffer {
+		size = prefixBuffer
+	}
+
+	res := make(chan *objects.Object, size)
+	errc := make(chan error, 1)
 
 	go func() {
-		defer close(res)
-		i := 0
-		store.db.View(func(tx *bolt.Tx) error {
+		err := store.db.View(func(tx *bolt.Tx) error {
 			c := tx.Bucket(store.bucket).Cursor()
-			for k, v := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			for k, v := c.Seek(seek); k != nil && in(k); k, v = c.Next() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				val, err := decode(v)
+				if err != nil {
+					return err
+				}
 
-				res <- &objects.Object{
-					Key: string(k),
-					Val: decode(v),
+				select {
+				case res <- &objects.Object{Key: string(k), Val: val}:
+				case <-ctx.Done():
+					return ctx.Err()
 				}
 
 				count--
 				if count <= 0 {
 					return nil
 				}
-				i++
 			}
 
 			return nil
 		})
 
-		// fmt.Println("prefix query:", prefixStr, i)
+		close(res)
+		if err != nil {
+			errc <- err
+		}
+		close(errc)
 	}()
 
-	return res, nil
+	return res, errc
 }
 
 func (store *BoltStore) Debug() {
@@ -103,11 +159,11 @@ func (store *BoltStore) Debug() {
 	})
 }
 
-func (store *BoltStore) Close() {
-	store.db.Close()
+func (store *BoltStore) Close() error {
+	return store.db.Close()
 }
 
-func (store *BoltStore) Open() error {
+func (store *BoltStore) Open(ctx context.Context) error {
 	db, err := bolt.Open(store.name+".db", 0600, nil)
 	if err != nil {
 		return err
@@ -118,16 +174,68 @@ func (store *BoltStore) Open() error {
 
 	return db.Update(func(tx *bolt.Tx) error {
 		tx.CreateBucketIfNotExists(store.bucket)
-		tx.CreateBucketIfNotExists([]byte("sys"))
+		tx.CreateBucketIfNotExists(sysBucket)
 		return nil
 	})
 }
 
-func (store *BoltStore) Drop() {
-	os.Remove(store.name + ".db")
+// System returns the store of the reserved sys bucket.
+func (store *BoltStore) System() store.Store {
+	return &BoltStore{db: store.db, bucket: sysBucket, name: store.name}
 }
 
-func (store *BoltStore) Flush() {}
+func (store *BoltStore) Drop() error {
+	return os.Remove(store.name + ".db")
+}
+
+func (store *BoltStore) Flush(ctx context.Context) error {
+	return nil
+}
+
+type boltBatch struct {
+	store *BoltStore
+	ops   []batchOp
+}
+
+type batchOp struct {
+	del bool
+	obj *objects.Object
+}
+
+func (b *boltBatch) Put(objs ...*objects.Object) {
+	for _, obj := range objs {
+		b.ops = append(b.ops, batchOp{obj: obj})
+	}
+}
+
+func (b *boltBatch) Del(objs ...*objects.Object) {
+	for _, obj := range objs {
+		b.ops = append(b.ops, batchOp{del: true, obj: obj})
+	}
+}
+
+func (b *boltBatch) Commit(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return b.store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.store.bucket)
+		for _, op := range b.ops {
+			var err error
+			if op.del {
+				err = bucket.Delete([]byte(op.obj.Key))
+			} else {
+				err = bucket.Put([]byte(op.obj.Key), encode(op.obj.Val))
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
 func encode(m map[string]interface{}) []byte {
 	data, err := json.Marshal(m)
@@ -137,11 +245,8 @@ func encode(m map[string]interface{}) []byte {
 	return data
 }
 
-func decode(val []byte) map[string]interface{} {
+func decode(val []byte) (map[string]interface{}, error) {
 	m := make(map[string]interface{})
 	err := json.Unmarshal(val, &m)
-	if err != nil {
-		panic(err)
-	}
-	return m
+	return m, err
 }
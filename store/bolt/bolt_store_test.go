@@ -1,10 +1,39 @@
 package bolt
 
-import "testing"
+import (
+	"context"
+	"github.com/coldog/go-graph/objects"
+	"testing"
+)
 
 func TestOpen(t *testing.T) {
 	s := NewBoltStore("test")
-	s.Open()
+	if err := s.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
 	s.Close()
 	s.Drop()
 }
+
+func TestSystem(t *testing.T) {
+	ctx := context.Background()
+	s := NewBoltStore("test")
+	if err := s.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Drop()
+	defer s.Close()
+
+	sys := s.System()
+	if err := sys.Put(ctx, &objects.Object{Key: "query_a", Val: map[string]interface{}{"query": "user"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if o, err := sys.Get(ctx, "query_a"); err != nil || o == nil || o.Val["query"] != "user" {
+		t.Fatalf("expected the system record got %v %v", o, err)
+	}
+
+	if o, err := s.Get(ctx, "query_a"); err != nil || o != nil {
+		t.Fatalf("expected the system record to be kept apart from the graph got %v %v", o, err)
+	}
+}
@@ -1,38 +1,73 @@
 package store
 
 import (
+	"context"
+
 	"github.com/coldog/go-graph/objects"
 )
 
 type Store interface {
 
 	// Put an object into storage.
-	Put(obj ...*objects.Object) error
+	Put(ctx context.Context, obj ...*objects.Object) error
 
 	// Delete an object from storage.
-	Del(obj ...*objects.Object) error
+	Del(ctx context.Context, obj ...*objects.Object) error
+
+	// Return an object from storage, or nil if there is no object stored under the key.
+	Get(ctx context.Context, key string) (*objects.Object, error)
 
-	// Return an object from storage.
-	Get(key string) (*objects.Object, error)
+	// Begin starts a batch of writes which are applied together when the batch is committed. Backends which
+	// support transactions must commit a batch atomically, other backends apply the batch on a best effort basis
+	// and should document what a failed commit may leave behind.
+	Begin() Batch
 
-	// This method should run a prefix query on the underlying storage, pushing along the provided channel
+	// This method should run a prefix query on the underlying storage, pushing along the returned channel
 	// the results returned up to the count variable provided. The channel should be closed when finished.
-	Prefix(prefix string, count int) (<-chan *objects.Object, error)
+	//
+	// The error channel receives at most one error and is closed after the results channel. The query must
+	// stop, closing both channels and reporting the context error, when the context is cancelled.
+	Prefix(ctx context.Context, prefix string, count int) (<-chan *objects.Object, <-chan error)
+
+	// Range runs a query over the keys from start up to but not including end, with the same results and channels
+	// as Prefix. An empty end runs the query to the last key.
+	Range(ctx context.Context, start, end string, count int) (<-chan *objects.Object, <-chan error)
 
-	// A backend may choose to implement a
-	Flush()
+	// A backend may choose to implement a buffer for writes, Flush should write out anything buffered.
+	Flush(ctx context.Context) error
 
 	// This is a lifecycle hook that can be implemented to set up the database. If an error
 	// is returned startup of the program will fail.
-	Open() error
+	Open(ctx context.Context) error
 
 	// This is a lifecyle hook that can be implemented by the underlying store. It will be
 	// called at program exit.
-	Close()
+	Close() error
 
 	// Removes the database. Used in testing.
-	Drop()
+	Drop() error
 
 	// Debug is used for testing and should print all of the keys currently in the database
 	Debug()
 }
+
+// A SystemStore keeps the records of gq itself, such as stored queries, apart from the graph. The store returned by
+// System shares the lifecycle of the graph store once it is open: it is only read and written, never opened, closed
+// or dropped.
+type SystemStore interface {
+	System() Store
+}
+
+// A Batch collects puts and deletes which are applied in order when Commit is called. Nothing is written before
+// the batch is committed and a batch which is never committed is discarded.
+type Batch interface {
+
+	// Put objects into storage when the batch is committed.
+	Put(obj ...*objects.Object)
+
+	// Delete objects from storage when the batch is committed.
+	Del(obj ...*objects.Object)
+
+	// Commit applies the writes in the batch.
+	Commit(ctx context.Context) error
+}
@@ -1,22 +1,23 @@
-package store
+package store_test
 
 import (
+	"context"
 	"fmt"
 	"github.com/coldog/go-graph/objects"
+	"github.com/coldog/go-graph/store"
 	"github.com/coldog/go-graph/store/bolt"
 	"testing"
 )
 
-func storeTestSimpleNode(store Store) error {
+func storeTestSimpleNode(store store.Store) error {
+	ctx := context.Background()
+
 	for i := 0; i < 10; i++ {
 		n := objects.NewNode("test")
-		store.Put(&objects.Object{n.Key(), n.Body})
+		store.Put(ctx, &objects.Object{Key: n.Key(), Val: n.Body})
 	}
 
-	ch, err := store.Prefix("test_", 10)
-	if err != nil {
-		return err
-	}
+	ch, errc := store.Prefix(ctx, "test_", 10)
 
 	c := 0
 	for n := range ch {
@@ -26,6 +27,10 @@ func storeTestSimpleNode(store Store) error {
 		c++
 	}
 
+	if err := <-errc; err != nil {
+		return err
+	}
+
 	if c != 10 {
 		return fmt.Errorf("not right count %v", c)
 	}
@@ -33,25 +38,24 @@ func storeTestSimpleNode(store Store) error {
 	return nil
 }
 
-func storeTestRelations(store Store) error {
+func storeTestRelations(store store.Store) error {
+	ctx := context.Background()
+
 	n := objects.NewNode("test1")
 	n.ID = "1234"
 
-	store.Put(&objects.Object{n.Key(), n.Body})
+	store.Put(ctx, &objects.Object{Key: n.Key(), Val: n.Body})
 
 	for i := 0; i < 20; i++ {
 		n2 := objects.NewNode("test2")
 		e := objects.NewEdge("likes", n.Key(), n2.Key())
-		store.Put(
-			&objects.Object{e.ForwardKey(), e.Body},
-			&objects.Object{e.ReverseKey(), e.Body},
+		store.Put(ctx,
+			&objects.Object{Key: e.ForwardKey(), Val: e.Body},
+			&objects.Object{Key: e.ReverseKey(), Val: e.Body},
 		)
 	}
 
-	ch, err := store.Prefix("1test1_1234/likes/", 20)
-	if err != nil {
-		return err
-	}
+	ch, errc := store.Prefix(ctx, "1test1_1234/likes/", 20)
 
 	c := 0
 	for n := range ch {
@@ -61,6 +65,10 @@ func storeTestRelations(store Store) error {
 		c++
 	}
 
+	if err := <-errc; err != nil {
+		return err
+	}
+
 	if c != 20 {
 		return fmt.Errorf("not right count %v", c)
 	}
@@ -68,9 +76,102 @@ func storeTestRelations(store Store) error {
 	return nil
 }
 
+func storeTestBatch(store store.Store) error {
+	ctx := context.Background()
+
+	e := objects.NewEdge("likes", "batch_1", "batch_2")
+
+	b := store.Begin()
+	b.Put(&objects.Object{Key: "batch_1"}, &objects.Object{Key: "batch_2"})
+	b.Put(&objects.Object{Key: e.ForwardKey()}, &objects.Object{Key: e.ReverseKey()})
+	b.Del(&objects.Object{Key: "batch_2"})
+
+	o, err := store.Get(ctx, "batch_1")
+	if err != nil {
+		return err
+	}
+	if o != nil {
+		return fmt.Errorf("batch was written before commit")
+	}
+
+	if err := b.Commit(ctx); err != nil {
+		return err
+	}
+
+	for key, exists := range map[string]bool{"batch_1": true, "batch_2": false, e.ForwardKey(): true, e.ReverseKey(): true} {
+		o, err := store.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if (o != nil) != exists {
+			return fmt.Errorf("expected %s exists to be %v", key, exists)
+		}
+	}
+
+	return nil
+}
+
+func storeTestRange(store store.Store) error {
+	ctx := context.Background()
+
+	for _, key := range []string{"range_a", "range_b", "range_c", "range_d"} {
+		store.Put(ctx, &objects.Object{Key: key})
+	}
+
+	for _, tc := range []struct {
+		start, end string
+		count      int
+		expected   []string
+	}{
+		{"range_b", "range_d", 10, []string{"range_b", "range_c"}},
+		{"range_b", "range_d", 1, []string{"range_b"}},
+		{"range_c", "", 2, []string{"range_c", "range_d"}},
+		{"range_a0", "range_b", 10, []string{}},
+	} {
+		ch, errc := store.Range(ctx, tc.start, tc.end, tc.count)
+
+		keys := []string{}
+		for o := range ch {
+			keys = append(keys, o.Key)
+		}
+
+		if err := <-errc; err != nil {
+			return err
+		}
+
+		if fmt.Sprint(keys) != fmt.Sprint(tc.expected) {
+			return fmt.Errorf("range %s to %s: expected %v got %v", tc.start, tc.end, tc.expected, keys)
+		}
+	}
+
+	return nil
+}
+
+func storeTestCancel(store store.Store) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ch, errc := store.Prefix(ctx, "test_", 10)
+	for range ch {
+	}
+
+	if err := <-errc; err != context.Canceled {
+		return fmt.Errorf("expected the prefix query to be cancelled got %v", err)
+	}
+
+	if _, err := store.Get(ctx, "test_1"); err != context.Canceled {
+		return fmt.Errorf("expected get to be cancelled got %v", err)
+	}
+
+	return nil
+}
+
 func TestBoltStore(t *testing.T) {
 	store := bolt.NewBoltStore("test")
-	store.Open()
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
 	defer store.Close()
 	defer store.Drop()
 
@@ -85,5 +186,20 @@ func TestBoltStore(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	err = storeTestBatch(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storeTestRange(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storeTestCancel(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	store.Debug()
 }
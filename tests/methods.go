@@ -2,6 +2,8 @@ package tests
 
 import (
 	"fmt"
+	"github.com/coldog/go-graph/graph"
+	"github.com/coldog/go-graph/objects"
 	"path/filepath"
 	"reflect"
 	"runtime"
@@ -34,3 +36,25 @@ func equals(tb testing.TB, exp, act interface{}) {
 		tb.Fail()
 	}
 }
+
+// all runs the traversal failing the test if it returns an error.
+func all(tb testing.TB, tr *graph.Traversal) []*objects.Object {
+	list, err := tr.All(ctx)
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.Fail()
+	}
+	return list
+}
+
+// count counts the results of the traversal failing the test if it returns an error.
+func count(tb testing.TB, tr *graph.Traversal) int {
+	c, err := tr.Count(ctx)
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.Fail()
+	}
+	return c
+}
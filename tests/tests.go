@@ -1,43 +1,105 @@
 package tests
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/coldog/go-graph/analytics"
 	"github.com/coldog/go-graph/graph"
 	"github.com/coldog/go-graph/objects"
 	"github.com/coldog/go-graph/store"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
 
+// ctx is the context scenarios run the graph under.
+var ctx = context.Background()
+
 type scenario func(t *testing.T, g *graph.Graph)
 
 var scenarios = map[string]scenario{
-	"simple":             simple,
-	"social-graph:posts": socialGraphPosts,
-	//"social-graph:multiple": socialGraphMultipleRelations,
-	"social-graph:likes":           socialGraphLikes,
-	"social-graph:likes-back":      socialGraphLikesBack,
-	"social-graph:filter":          socialGraphFilter,
-	"social-graph:post-serialized": socialGraphPostsSerialized,
-	"social-graph:post-body":       socialGraphPostsWithBody,
+	"simple":                        simple,
+	"social-graph:posts":            socialGraphPosts,
+	"social-graph:multiple":         socialGraphMultipleRelations,
+	"social-graph:both":             socialGraphBoth,
+	"social-graph:except":           socialGraphExcept,
+	"social-graph:likes":            socialGraphLikes,
+	"social-graph:likes-back":       socialGraphLikesBack,
+	"social-graph:filter":           socialGraphFilter,
+	"social-graph:post-serialized":  socialGraphPostsSerialized,
+	"social-graph:post-body":        socialGraphPostsWithBody,
+	"social-graph:where":            socialGraphWhere,
+	"social-graph:where-serialized": socialGraphWhereSerialized,
+	"social-graph:has":              socialGraphHas,
+	"social-graph:index":            socialGraphIndex,
+	"unique":                        unique,
+	"delete":                        deleteNodes,
+	"batch":                         batch,
+	"cancel":                        cancel,
+	"budget":                        budget,
+	"explain":                       explain,
+	"paths":                         paths,
+	"select":                        selectRows,
+	"repeat":                        repeat,
+	"shortest-path":                 shortestPath,
+	"analytics":                     analyze,
+	"order":                         orderResults,
+	"aggregate":                     aggregate,
+	"sets":                          sets,
+	"edges":                         edges,
+	"optional":                      optionalSteps,
+	"query":                         textQuery,
+	"stored":                        storedQueries,
+	"stream":                        stream,
+	"changes":                       changes,
+	"watch":                         watch,
 }
 
 var order = []string{
 	"simple",
 	"social-graph:posts",
+	"social-graph:multiple",
+	"social-graph:both",
+	"social-graph:except",
 	"social-graph:likes",
 	"social-graph:likes-back",
 	"social-graph:filter",
 	"social-graph:post-serialized",
 	"social-graph:post-body",
+	"social-graph:where",
+	"social-graph:where-serialized",
+	"social-graph:has",
+	"social-graph:index",
+	"unique",
+	"delete",
+	"batch",
+	"cancel",
+	"budget",
+	"explain",
+	"paths",
+	"select",
+	"repeat",
+	"shortest-path",
+	"analytics",
+	"order",
+	"aggregate",
+	"sets",
+	"edges",
+	"optional",
+	"query",
+	"stored",
+	"stream",
+	"changes",
+	"watch",
 }
 
 func RunTest(t *testing.T, s store.Store, name string) {
 	g := graph.New(s)
 
 	scen := scenarios[name]
-	ok(t, s.Open())
+	ok(t, s.Open(ctx))
 
 	t1 := time.Now()
 	fmt.Println("---> running:", name)
@@ -65,19 +127,19 @@ func RunTests(t *testing.T, s store.Store) {
 }
 
 func simple(t *testing.T, g *graph.Graph) {
-	n, err := g.CreateNode("test", nil)
+	n, err := g.CreateNode(ctx, "test", nil)
 	ok(t, err)
 
 	for i := 0; i < 20; i++ {
-		n2, err := g.CreateNode("test", nil)
+		n2, err := g.CreateNode(ctx, "test", nil)
 		ok(t, err)
-		g.CreateEdge("likes", n.Key(), n2.Key(), nil)
+		g.CreateEdge(ctx, "likes", n.Key(), n2.Key(), nil)
 	}
 
-	g.Flush()
+	ok(t, g.Flush(ctx))
 
 	tr := g.Traversal()
-	s := tr.Is("test").Out("likes").Count()
+	s := count(t, tr.Is("test").Out("likes"))
 
 	//out, err := json.MarshalIndent(tr, " ", " ")
 	//ok(t, err)
@@ -85,6 +147,13 @@ func simple(t *testing.T, g *graph.Graph) {
 	//fmt.Printf("\n%s\n", out)
 
 	equals(t, 20, s)
+
+	// node types cannot start with the reserved key prefixes.
+	_, err = g.CreateNode(ctx, "3d_model", nil)
+	assert(t, err != nil, "expected an error for a reserved node type")
+	_, err = g.CreateEdge(ctx, "likes", n.Key(), "42_1", nil)
+	assert(t, err != nil, "expected an error for an edge to a reserved node type")
+	equals(t, 21, count(t, g.Traversal().Is("test").Limit(100)))
 }
 
 func socialGraphPosts(t *testing.T, g *graph.Graph) {
@@ -92,7 +161,7 @@ func socialGraphPosts(t *testing.T, g *graph.Graph) {
 
 	tr := g.Traversal()
 	tr.Is("user").Out("follows").Out("posts")
-	list := tr.All()
+	list := all(t, tr)
 	for _, o := range list {
 		equals(t, "post", o.Node().Type)
 	}
@@ -108,24 +177,83 @@ func socialGraphPosts(t *testing.T, g *graph.Graph) {
 func socialGraphLikes(t *testing.T, g *graph.Graph) {
 	seedSocial(t, g)
 
-	list := g.Traversal().Is("user").Out("follows").Out("likes").All()
+	list := all(t, g.Traversal().Is("user").Out("follows").Out("likes"))
 	for _, o := range list {
 		equals(t, "post", o.Node().Type)
 	}
 	equals(t, 95, len(list))
 }
 
-//func socialGraphMultipleRelations(t *testing.T, g *graph.Graph) {
-//	seedSocial(t, g)
-//
-//	list := g.Traversal().Is("user").Out("follows", "likes").All()
-//	equals(t, 95, len(list))
-//}
+func socialGraphMultipleRelations(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	// the 20 users followed by main and the 95 posts liked by users 15 to 19.
+	list := all(t, g.Traversal().Is("user").Out("follows", "likes"))
+	equals(t, 115, len(list))
+
+	// user 15 likes the 75 posts of users 0 to 14 and has 5 posts of its own.
+	list = all(t, g.Traversal().Is("user").Where("n == 15").Out("likes", "posts"))
+	equals(t, 80, len(list))
+}
+
+func socialGraphBoth(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	// user 15 is followed by main and has 5 posts.
+	list := all(t, g.Traversal().Is("user").Where("n == 15").Both("follows", "posts"))
+	equals(t, 6, len(list))
+
+	// the posts of user 0 are liked by users 15 to 19 and posted by user 0.
+	list = all(t, g.Traversal().Is("user").Where("n == 0").Out("posts").Both("likes", "posts"))
+	equals(t, 6, len(list))
+}
+
+func socialGraphExcept(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	user := func() *graph.Traversal { return g.Traversal().Is("user").Where("n == 15") }
+
+	equals(t, 80, count(t, user().OutExcept("dislike")))
+	equals(t, 5, count(t, user().OutExcept("dislike", "likes")))
+	equals(t, 1, count(t, user().InExcept("dislike")))
+	equals(t, 81, count(t, user().BothExcept("dislike")))
+
+	// without an ID the edges of every user are scanned and the excluded types dropped.
+	equals(t, 120, count(t, g.Traversal().Is("user").OutExcept("dislike")))
+
+	// the dislikes of the user are skipped over rather than scanned.
+	tr := user()
+	tr.OutExcept("dislike")
+
+	plan, err := g.Explain(tr)
+	ok(t, err)
+	equals(t, "expand", plan[3].Step)
+	equals(t, []string{"[1<node>/, 1<node>/dislike/)", "[1<node>/dislike0, 1<node>0)"}, plan[3].Ranges)
+
+	_, profile, err := g.Profile(ctx, tr)
+	ok(t, err)
+	equals(t, int64(80), profile[3].Scanned)
+
+	tr = g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "user",
+	  "limit": 100,
+	  "filters": ["n == 15"],
+	  "next": {"except_types": ["dislike", "likes"], "direction": 0, "limit": 2000, "target": {"limit": 2000}}
+	}`), tr))
+
+	res, err := g.Run(ctx, tr)
+	ok(t, err)
+	equals(t, 5, len(res))
+
+	err = json.Unmarshal([]byte(`{"type": "user", "next": {"types": ["likes"], "except_types": ["likes"], "target": {}}}`), g.Traversal())
+	assert(t, err != nil, "expected an error for types and except types")
+}
 
 func socialGraphLikesBack(t *testing.T, g *graph.Graph) {
 	seedSocial(t, g)
 
-	list := g.Traversal().Is("user").Out("follows").Out("likes").In("posts").All()
+	list := all(t, g.Traversal().Is("user").Out("follows").Out("likes").In("posts"))
 	for _, o := range list {
 		equals(t, "user", o.Node().Type)
 	}
@@ -135,7 +263,7 @@ func socialGraphLikesBack(t *testing.T, g *graph.Graph) {
 func socialGraphFilter(t *testing.T, g *graph.Graph) {
 	seedSocial(t, g)
 
-	list := g.Traversal().Is("user").OutFilter(func(e *objects.Edge) bool { return false }).All()
+	list := all(t, g.Traversal().Is("user").OutFilter(func(e *objects.Edge) bool { return false }))
 	equals(t, 0, len(list))
 }
 
@@ -175,22 +303,1566 @@ func socialGraphPostsSerialized(t *testing.T, g *graph.Graph) {
 	err := json.Unmarshal([]byte(q), tr)
 	ok(t, err)
 
-	list := tr.All()
+	list := all(t, tr)
 	equals(t, 20*5, len(list))
 }
 
 func socialGraphPostsWithBody(t *testing.T, g *graph.Graph) {
 	seedSocial(t, g)
 
-	list := g.Traversal().Is("user").Out("follows").Out("posts").ForEach(func(n *objects.Node) {
+	list := all(t, g.Traversal().Is("user").Out("follows").Out("posts").ForEach(func(n *objects.Node) {
 		n.Body = map[string]interface{}{"Abc": "Def"}
-	}).WithBody().All()
+	}).WithBody())
 	equals(t, 20*5, len(list))
 }
 
+func socialGraphWhere(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	list := all(t, g.Traversal().Is("user").Out("follows").Where("n >= 10 and n < 15"))
+	for _, o := range list {
+		equals(t, "user", o.Node().Type)
+	}
+	equals(t, 5, len(list))
+
+	list = all(t, g.Traversal().Is("user").Out("follows").Out("posts").Where(`n == 0 or n == 4`))
+	equals(t, 20*2, len(list))
+}
+
+func socialGraphWhereSerialized(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	q := `{
+	  "type": "user",
+	  "limit": 100,
+	  "next": {
+	    "types": ["follows"],
+	    "direction": 0,
+	    "limit": 2000,
+	    "filter": "n < 10",
+	    "target": {
+	      "limit": 2000,
+	      "filters": ["n exists", "n prefix \"x\" or n > 4"]
+	    }
+	  }
+	}`
+
+	tr := g.Traversal()
+	err := json.Unmarshal([]byte(q), tr)
+	ok(t, err)
+	equals(t, 5, len(all(t, tr)))
+
+	err = json.Unmarshal([]byte(`{"type": "user", "filters": ["n >"]}`), g.Traversal())
+	assert(t, err != nil, "expected a syntax error")
+
+	// a malformed expression fails the traversal when it is run.
+	_, err = g.Traversal().Is("user").Where("n >").Has("n", 3).All(ctx)
+	_, isSyntax := err.(*graph.SyntaxError)
+	assert(t, isSyntax, "expected a syntax error, got %v", err)
+
+	tr = g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{"type": "post", "limit": 200, "group_by": "n"}`), tr))
+	equals(t, 5, len(all(t, tr)))
+}
+
+func socialGraphHas(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	equals(t, 1, count(t, g.Traversal().Is("user").Out("follows").Has("n", 3)))
+	equals(t, 3, count(t, g.Traversal().Is("user").Out("follows").HasIn("n", 1, 2, 3, 40)))
+	equals(t, 20*2, count(t, g.Traversal().Is("user").Out("follows").Out("posts").HasRange("n", 1, 3)))
+	equals(t, 0, count(t, g.Traversal().Is("user").Out("follows").HasNot("n")))
+
+	// the limit of the root step applies to the nodes matching, however many nodes are scanned to find them.
+	equals(t, 1, count(t, g.Traversal().Is("user").Limit(1).Has("n", 15)))
+	equals(t, 3, count(t, g.Traversal().Is("user").Limit(5).HasRange("n", 17, 20)))
+	equals(t, 20, count(t, g.Traversal().Is("post").Limit(20).Has("n", 4)))
+
+	// any attribute and value can be matched, even those the filter language cannot express.
+	_, err := g.CreateNode(ctx, "tag", map[string]interface{}{"in": 1})
+	ok(t, err)
+	equals(t, 1, count(t, g.Traversal().Is("tag").Has("in", 1)))
+	equals(t, 0, count(t, g.Traversal().Is("tag").Has("in", map[string]interface{}{"a": 1})))
+
+	// has steps are sent over the wire as filters.
+	tr := g.Traversal().Is("user")
+	tr.Out("follows").Has("n", 3)
+
+	data, err := json.Marshal(tr)
+	ok(t, err)
+
+	tr = g.Traversal()
+	ok(t, json.Unmarshal(data, tr))
+	equals(t, 1, count(t, tr))
+
+	// attributes which are not identifiers are quoted so they read back.
+	_, err = g.CreateNode(ctx, "tag", map[string]interface{}{"first-name": "a b"})
+	ok(t, err)
+
+	for _, tr := range []*graph.Traversal{
+		g.Traversal().Is("tag").Has("in", 1),
+		g.Traversal().Is("tag").Has("first-name", "a b"),
+		g.Traversal().Is("tag").HasIn("first-name", "a b"),
+	} {
+		data, err := json.Marshal(tr)
+		ok(t, err)
+
+		tr = g.Traversal()
+		ok(t, json.Unmarshal(data, tr))
+		equals(t, 1, count(t, tr))
+	}
+	equals(t, 1, count(t, g.Traversal().Is("tag").Where(`"first-name" == "a b"`)))
+}
+
+func socialGraphIndex(t *testing.T, g *graph.Graph) {
+	ok(t, g.CreateIndex(ctx, "post", "n"))
+	seedSocial(t, g)
+
+	// user indexes are built from the existing nodes.
+	ok(t, g.CreateIndex(ctx, "user", "n"))
+
+	// the root scan is limited to 5 users, the index finds the user regardless.
+	list := all(t, g.Traversal().Is("user").Limit(5).Has("n", 15))
+	equals(t, 1, len(list))
+	equals(t, float64(15), list[0].Val["n"])
+
+	equals(t, 5, count(t, g.Traversal().Is("user").Limit(5).Has("n", 15).Out("posts")))
+	equals(t, 2, count(t, g.Traversal().Is("user").Limit(5).HasIn("n", 3, 4)))
+	equals(t, 20, count(t, g.Traversal().Is("post").Has("n", 2)))
+
+	n := list[0].Node()
+	n.Body["n"] = 99
+	ok(t, g.PutNode(ctx, n))
+
+	equals(t, 0, count(t, g.Traversal().Is("user").Limit(5).Has("n", 15)))
+	equals(t, 1, count(t, g.Traversal().Is("user").Limit(5).Has("n", 99)))
+
+	ok(t, g.DelNode(ctx, n))
+	equals(t, 0, count(t, g.Traversal().Is("user").Limit(5).Has("n", 99)))
+
+	// a node ID is matched exactly rather than as the prefix of longer IDs.
+	for _, id := range []string{"x1", "x10", "x11"} {
+		ok(t, g.PutNode(ctx, &objects.Node{Type: "user", ID: id, Body: map[string]interface{}{"n": 100}}))
+	}
+	equals(t, 1, count(t, g.Traversal().Is("user").Has("id", "x1").Has("n", 100)))
+	equals(t, 1, count(t, g.Traversal().Is("user").Has("id", "x1").WithBody()))
+
+	// a restarted graph finds the index built and does not scan the nodes again, nodes written without the index
+	// are only found once it is rebuilt.
+	ok(t, g.Store().Put(ctx, &objects.Object{Key: "user_x2", Val: map[string]interface{}{"n": 101.0}}))
+
+	restarted := graph.New(g.Store())
+	ok(t, restarted.CreateIndex(ctx, "user", "n"))
+	equals(t, 0, count(t, restarted.Traversal().Is("user").Has("n", 101)))
+
+	ok(t, restarted.RebuildIndex(ctx, "user", "n"))
+	equals(t, 1, count(t, restarted.Traversal().Is("user").Has("n", 101)))
+	equals(t, 3, count(t, restarted.Traversal().Is("user").Has("n", 100)))
+	assert(t, restarted.RebuildIndex(ctx, "user", "missing") != nil, "expected an error rebuilding a missing index")
+}
+
+func unique(t *testing.T, g *graph.Graph) {
+	a, err := g.CreateNode(ctx, "user", map[string]interface{}{"email": "a@example.com"})
+	ok(t, err)
+	_, err = g.CreateNode(ctx, "user", map[string]interface{}{"email": "a@example.com"})
+	ok(t, err)
+
+	// existing duplicates prevent the index from being created.
+	_, isConflict := g.CreateUniqueIndex(ctx, "user", "email").(*graph.ConflictError)
+	assert(t, isConflict, "expected a conflict creating the index")
+
+	_, err = g.DelByResourceID(ctx, a.ResourceID(), graph.Cascade)
+	ok(t, err)
+	ok(t, g.CreateUniqueIndex(ctx, "user", "email"))
+
+	_, err = g.CreateNode(ctx, "user", map[string]interface{}{"email": "a@example.com"})
+	conflict, isConflict := err.(*graph.ConflictError)
+	assert(t, isConflict, "expected a conflict got %v", err)
+	equals(t, "user.email", conflict.Index)
+	equals(t, "a@example.com", conflict.Value)
+
+	b, err := g.CreateNode(ctx, "user", map[string]interface{}{"email": "b@example.com"})
+	ok(t, err)
+
+	// rewriting a node with its own value is not a conflict.
+	_, err = g.PutByResourceID(ctx, b.ResourceID(), map[string]interface{}{"email": "b@example.com", "name": "b"})
+	ok(t, err)
+
+	_, err = g.PutByResourceID(ctx, b.ResourceID(), map[string]interface{}{"email": "a@example.com"})
+	_, isConflict = err.(*graph.ConflictError)
+	assert(t, isConflict, "expected a conflict got %v", err)
+
+	// concurrent writers of the same value, only one may win.
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := g.CreateNode(ctx, "user", map[string]interface{}{"email": "c@example.com"})
+			errs <- err
+		}()
+	}
+
+	written := 0
+	for i := 0; i < 10; i++ {
+		if <-errs == nil {
+			written++
+		}
+	}
+	equals(t, 1, written)
+	equals(t, 1, count(t, g.Traversal().Is("user").Has("email", "c@example.com")))
+
+	// concurrent writers changing the value of the same node leave a single index entry behind.
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			errs <- g.PutNode(ctx, &objects.Node{Type: b.Type, ID: b.ID, Body: map[string]interface{}{"email": fmt.Sprintf("d%d@example.com", i)}})
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		ok(t, <-errs)
+	}
+
+	res, errc := g.Store().Prefix(ctx, objects.IndexKey+"user/email/", 100)
+	entries := 0
+	for o := range res {
+		if strings.HasSuffix(o.Key, "/"+b.Key()) {
+			entries++
+		}
+	}
+	ok(t, <-errc)
+	equals(t, 1, entries)
+}
+
+func deleteNodes(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	list := all(t, g.Traversal().Is("user").Out("follows").Has("n", 19))
+	equals(t, 1, len(list))
+	u := list[0].Node()
+
+	// the user follows nobody so is only on the reverse side of the follows edge.
+	equals(t, 5, count(t, g.Traversal().Is("user").Out("follows").Has("n", 19).Out("posts")))
+	equals(t, 95, count(t, g.Traversal().Is("user").Out("follows").Has("n", 19).Out("likes")))
+
+	_, err := g.DelByResourceID(ctx, u.ResourceID(), graph.Restrict)
+	_, isRestricted := err.(*graph.HasEdgesError)
+	assert(t, isRestricted, "expected the delete to be restricted got %v", err)
+	equals(t, 20, count(t, g.Traversal().Is("user").Out("follows")))
+
+	_, err = g.DelByResourceID(ctx, u.ResourceID(), graph.Cascade)
+	ok(t, err)
+
+	// no dangling edges are left behind in either direction.
+	equals(t, 19, count(t, g.Traversal().Is("user").Out("follows")))
+	equals(t, 0, count(t, g.Traversal().Is("user").Has("id", u.ID).Out()))
+	equals(t, 0, count(t, g.Traversal().Is("user").Has("id", u.ID).In()))
+	equals(t, 19, count(t, g.Traversal().Is("post").In("posts")))
+	equals(t, 95, count(t, g.Traversal().Is("user").Out("posts")))
+
+	// a node without edges can be deleted in restrict mode.
+	n, err := g.CreateNode(ctx, "user", nil)
+	ok(t, err)
+	_, err = g.DelByResourceID(ctx, n.ResourceID(), graph.Restrict)
+	ok(t, err)
+}
+
+func batch(t *testing.T, g *graph.Graph) {
+	ok(t, g.CreateUniqueIndex(ctx, "user", "email"))
+
+	b := g.Begin(ctx)
+	_, err := b.PutByResourceID("node:user_a", map[string]interface{}{"email": "a@example.com"})
+	ok(t, err)
+	_, err = b.PutByResourceID("node:user_b", map[string]interface{}{"email": "b@example.com"})
+	ok(t, err)
+	_, err = b.PutByResourceID("edge:follows.user_a.user_b", nil)
+	ok(t, err)
+
+	// nothing is visible before the commit.
+	equals(t, 0, count(t, g.Traversal().Is("user")))
+	ok(t, b.Commit())
+
+	equals(t, 1, count(t, g.Traversal().Is("user").Has("id", "a").Out("follows").Has("email", "b@example.com")))
+
+	// a batch conflicting with itself writes nothing.
+	b = g.Begin(ctx)
+	_, err = b.PutByResourceID("node:user_c", map[string]interface{}{"email": "c@example.com"})
+	ok(t, err)
+	_, err = b.PutByResourceID("node:user_d", map[string]interface{}{"email": "c@example.com"})
+	ok(t, err)
+	_, isConflict := b.Commit().(*graph.ConflictError)
+	assert(t, isConflict, "expected a conflict")
+	equals(t, 2, count(t, g.Traversal().Is("user")))
+
+	// values may be swapped between nodes in a single batch.
+	b = g.Begin(ctx)
+	_, err = b.PutByResourceID("node:user_a", map[string]interface{}{"email": "b@example.com"})
+	ok(t, err)
+	_, err = b.PutByResourceID("node:user_b", map[string]interface{}{"email": "a@example.com"})
+	ok(t, err)
+	ok(t, b.Commit())
+	equals(t, 1, count(t, g.Traversal().Is("user").Has("email", "a@example.com").Has("id", "b")))
+
+	// deletes in a batch cascade to the edges.
+	b = g.Begin(ctx)
+	_, err = b.DelByResourceID("node:user_a", graph.Cascade)
+	ok(t, err)
+	ok(t, b.Commit())
+	equals(t, 0, count(t, g.Traversal().Is("user").In("follows")))
+
+	// edges put earlier in the batch are deleted along with the node.
+	b = g.Begin(ctx)
+	_, err = b.PutByResourceID("node:user_e", nil)
+	ok(t, err)
+	_, err = b.PutByResourceID("edge:follows.user_e.user_b", nil)
+	ok(t, err)
+	_, err = b.DelByResourceID("node:user_e", graph.Cascade)
+	ok(t, err)
+	ok(t, b.Commit())
+	equals(t, 0, count(t, g.Traversal().Is("user").In("follows")))
+
+	// edges deleted earlier in the batch do not restrict deleting the node.
+	_, err = g.CreateEdge(ctx, "follows", "user_b", "user_b", nil)
+	ok(t, err)
+	b = g.Begin(ctx)
+	_, err = b.DelByResourceID("edge:follows.user_b.user_b", graph.Cascade)
+	ok(t, err)
+	_, err = b.DelByResourceID("node:user_b", graph.Restrict)
+	ok(t, err)
+	ok(t, b.Commit())
+	equals(t, 0, count(t, g.Traversal().Is("user")))
+}
+
+func cancel(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	c, stop := context.WithCancel(ctx)
+	stop()
+
+	_, err := g.Traversal().Is("user").Out("follows").Out("posts").All(c)
+	equals(t, context.Canceled, err)
+
+	_, err = g.Traversal().Is("user").Out("follows").Where("n > 2").All(c)
+	equals(t, context.Canceled, err)
+
+	_, err = g.CreateNode(c, "user", nil)
+	equals(t, context.Canceled, err)
+
+	// a deadline hit while the traversal is running stops it.
+	c, stop = context.WithTimeout(ctx, time.Nanosecond)
+	defer stop()
+
+	_, err = g.Traversal().Is("user").Out("follows").Out("likes").WithBody().All(c)
+	equals(t, context.DeadlineExceeded, err)
+}
+
+func budget(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	_, err := g.Traversal().Is("user").Out("follows").Out("likes").WithBudget(graph.Budget{MaxScanned: 10}).All(ctx)
+	equals(t, &graph.BudgetError{Limit: "scanned", Max: "10"}, err)
+
+	_, err = g.Traversal().Is("user").Out("follows").WithBudget(graph.Budget{MaxFrontier: 10}).All(ctx)
+	equals(t, &graph.BudgetError{Limit: "frontier", Max: "10"}, err)
+
+	equals(t, 20, count(t, g.Traversal().Is("user").Out("follows").WithBudget(graph.Budget{MaxFrontier: 20})))
+
+	_, err = g.Traversal().Is("user").Out("follows").Out("likes").WithBudget(graph.Budget{Timeout: time.Nanosecond}).All(ctx)
+	equals(t, &graph.BudgetError{Limit: "timeout", Max: "1ns"}, err)
+
+	// budgets are sent over the wire with the root of the traversal.
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "user",
+	  "budget": {"timeout": "10s", "max_frontier": 10},
+	  "next": {"types": ["follows"], "direction": 0, "limit": 2000, "target": {"limit": 2000}}
+	}`), tr))
+	equals(t, 10*time.Second, tr.Budget.Timeout)
+
+	_, err = tr.All(ctx)
+	equals(t, &graph.BudgetError{Limit: "frontier", Max: "10"}, err)
+
+	// a budget on any other level is rejected rather than ignored.
+	tr = g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "user",
+	  "next": {"types": ["follows"], "direction": 0, "limit": 2000, "target": {"limit": 2000, "budget": {"max_frontier": 10}}}
+	}`), tr))
+	_, err = tr.All(ctx)
+	assert(t, err != nil, "expected an error for a budget on a level other than the root")
+
+	// the 100 root posts are counted from the edges followed to the 20 users posting them.
+	_, err = g.Traversal().Is("post").In("posts").WithBudget(graph.Budget{MaxFrontier: 50}).All(ctx)
+	equals(t, &graph.BudgetError{Limit: "frontier", Max: "50"}, err)
+	equals(t, 20, count(t, g.Traversal().Is("post").In("posts").WithBudget(graph.Budget{MaxFrontier: 100})))
+
+	// with paths the 95 posts liked are reached along 425 paths but count once each.
+	equals(t, 425, count(t, g.Traversal().Is("user").Out("follows").Out("likes").Path().WithBudget(graph.Budget{MaxFrontier: 100})))
+	_, err = g.Traversal().Is("user").Out("follows").Out("likes").Path().WithBudget(graph.Budget{MaxFrontier: 90}).All(ctx)
+	equals(t, &graph.BudgetError{Limit: "frontier", Max: "90"}, err)
+
+	// the budget of the graph caps the budget of a traversal.
+	g.SetBudget(graph.Budget{MaxFrontier: 5})
+	defer g.SetBudget(graph.Budget{})
+
+	_, err = g.Traversal().Is("user").Out("follows").WithBudget(graph.Budget{MaxFrontier: 100}).All(ctx)
+	equals(t, &graph.BudgetError{Limit: "frontier", Max: "5"}, err)
+
+	_, err = g.Traversal().Is("user").Out("follows").All(ctx)
+	equals(t, &graph.BudgetError{Limit: "frontier", Max: "5"}, err)
+}
+
+func explain(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	tr := g.Traversal().Is("user")
+	tr.Out("follows").Out("posts")
+
+	plan, err := g.Explain(tr)
+	ok(t, err)
+
+	steps := []string{}
+	for _, s := range plan {
+		steps = append(steps, s.Step)
+	}
+	equals(t, []string{"expand", "targets", "nodes", "dedupe", "expand", "targets", "nodes", "dedupe"}, steps)
+	equals(t, []string{"1user_"}, plan[0].Prefixes)
+	equals(t, []string{"1<node>/posts/"}, plan[4].Prefixes)
+	equals(t, 1, plan[4].Level)
+
+	res, profile, err := g.Profile(ctx, tr)
+	ok(t, err)
+	equals(t, 100, len(res))
+	equals(t, len(plan), len(profile))
+
+	// the follows are found with a single scan over the edges of every user, the posts with a scan per user.
+	equals(t, int64(1), profile[0].Calls)
+	equals(t, int64(20), profile[1].Out)
+	equals(t, int64(20), profile[4].Calls)
+	equals(t, int64(100), profile[4].Scanned)
+	equals(t, int64(0), profile[4].Truncated)
+	equals(t, int64(100), profile[7].Out)
+
+	// a limited hop shows up as truncated scans.
+	tr = g.Traversal().Is("user")
+	follows := tr.Out("follows")
+	follows.Out("posts")
+	follows.Next.LimitBy = 2
+
+	_, profile, err = g.Profile(ctx, tr)
+	ok(t, err)
+	equals(t, int64(20), profile[4].Truncated)
+	equals(t, int64(40), profile[7].Out)
+
+	// a scan finding exactly as many keys as its limit is not truncated.
+	follows.Next.LimitBy = 5
+
+	_, profile, err = g.Profile(ctx, tr)
+	ok(t, err)
+	equals(t, int64(0), profile[4].Truncated)
+	equals(t, int64(100), profile[4].Scanned)
+	equals(t, int64(100), profile[7].Out)
+}
+
+func paths(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	list := all(t, g.Traversal().Is("user").Out("follows").Out("posts").Path())
+	equals(t, 100, len(list))
+	for _, o := range list {
+		equals(t, 5, len(o.Path))
+		equals(t, o, o.Path[4])
+		equals(t, "follows", o.Path[1].Edge().Type)
+		equals(t, o.Path[2].Key, o.Path[1].Edge().Target)
+		equals(t, o.Path[2].Key, o.Path[3].Edge().Source)
+	}
+
+	// the edge bodies are returned with the path.
+	n := list[0].Path[1].Val["n"]
+	assert(t, n != nil, "expected an edge body")
+
+	data, err := json.Marshal(list[0])
+	ok(t, err)
+
+	res := struct {
+		Path []struct {
+			Type string `json:"type"`
+			Edge struct {
+				Body map[string]interface{} `json:"body"`
+			} `json:"edge"`
+		} `json:"path"`
+	}{}
+	ok(t, json.Unmarshal(data, &res))
+	equals(t, 5, len(res.Path))
+	equals(t, "edge", res.Path[1].Type)
+	equals(t, n, res.Path[1].Edge.Body["n"])
+
+	// a node reached along several paths is returned once per path.
+	equals(t, 1, count(t, g.Traversal().Is("user").Out("follows").In("follows")))
+	equals(t, 20, count(t, g.Traversal().Is("user").Out("follows").In("follows").Path()))
+
+	// a root node found twice by an index lookup starts the same paths twice.
+	ok(t, g.CreateIndex(ctx, "user", "n"))
+	equals(t, 10, count(t, g.Traversal().Is("user").HasIn("n", 3, 3).Out("posts").Path()))
+	equals(t, 5, count(t, g.Traversal().Is("user").HasIn("n", 3, 3).Out("posts").DistinctPath()))
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "user",
+	  "filters": ["n in [3, 3]"],
+	  "path": {"distinct": true},
+	  "next": {"types": ["posts"], "direction": 0, "limit": 2000, "target": {"limit": 2000}}
+	}`), tr))
+	equals(t, 5, count(t, tr))
+}
+
+func selectRows(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	rows, err := g.Traversal().Is("user").Out("follows").As("u").WithBody().Out("posts").As("p").Select("u", "p").Rows(ctx)
+	ok(t, err)
+	equals(t, 100, len(rows))
+
+	posts := map[string]int{}
+	for _, row := range rows {
+		equals(t, 2, len(row))
+		equals(t, "user", row["u"].Node().Type)
+		equals(t, "post", row["p"].Node().Type)
+		assert(t, row["u"].Val["n"] != nil, "expected the body of the user")
+		posts[row["u"].Key]++
+	}
+
+	equals(t, 20, len(posts))
+	for _, c := range posts {
+		equals(t, 5, c)
+	}
+
+	_, err = g.Traversal().Is("user").As("u").Out("follows").As("u").Select("u").Rows(ctx)
+	assert(t, err != nil, "expected an error for a duplicate label")
+
+	_, err = g.Traversal().Is("user").As("u").Out("follows").Select("v").Rows(ctx)
+	assert(t, err != nil, "expected an error for an unknown label")
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "user",
+	  "select": ["u", "f"],
+	  "as": "u",
+	  "next": {"types": ["follows"], "direction": 0, "limit": 2000, "target": {"as": "f", "limit": 2000}}
+	}`), tr))
+
+	rows, err = g.Select(ctx, tr)
+	ok(t, err)
+	equals(t, 20, len(rows))
+	for _, row := range rows {
+		equals(t, "user", row["f"].Node().Type)
+		assert(t, row["u"].Key != row["f"].Key, "expected the follower and followed to differ")
+	}
+
+	err = json.Unmarshal([]byte(`{"type": "user", "select": ["x"]}`), g.Traversal())
+	assert(t, err != nil, "expected an error for an unknown label")
+}
+
+func repeat(t *testing.T, g *graph.Graph) {
+	// a reporting chain 0 -> 1 -> ... -> 5 which loops back to 0.
+	emps := []*objects.Node{}
+	for i := 0; i < 6; i++ {
+		e, err := g.CreateNode(ctx, "emp", map[string]interface{}{"n": i})
+		ok(t, err)
+		emps = append(emps, e)
+	}
+
+	for i, e := range emps {
+		_, err := g.CreateEdge(ctx, "manages", e.Key(), emps[(i+1)%len(emps)].Key(), nil)
+		ok(t, err)
+	}
+	ok(t, g.Flush(ctx))
+
+	from := func() *graph.Traversal {
+		return g.Traversal().Is("emp").Has("id", emps[0].ID)
+	}
+
+	res := all(t, from().Repeat(graph.Sub().Out("manages")).Times(1))
+	equals(t, 1, len(res))
+	equals(t, emps[1].Key(), res[0].Key)
+
+	res = all(t, from().Repeat(graph.Sub().Out("manages")).Times(3))
+	equals(t, 1, len(res))
+	equals(t, emps[3].Key(), res[0].Key)
+
+	// the chain loops back to the start which is not followed twice.
+	equals(t, 5, count(t, from().Repeat(graph.Sub().Out("manages")).Emit()))
+	equals(t, 0, count(t, from().Repeat(graph.Sub().Out("manages")).Times(6)))
+	equals(t, 2, count(t, from().Repeat(graph.Sub().Out("manages")).Emit().MaxDepth(2)))
+
+	res = all(t, from().Repeat(graph.Sub().Out("manages")).Until("n == 4"))
+	equals(t, 1, len(res))
+	equals(t, emps[4].Key(), res[0].Key)
+
+	equals(t, 0, count(t, from().Repeat(graph.Sub().Out("manages")).Until("n == 9")))
+
+	// the steps following a repeat start from the nodes it emits.
+	res = all(t, from().Repeat(graph.Sub().Out("manages")).Times(2).Out("manages"))
+	equals(t, 1, len(res))
+	equals(t, emps[3].Key(), res[0].Key)
+
+	// with paths each result carries the hops of the repeat.
+	res = all(t, from().Repeat(graph.Sub().Out("manages")).Times(2).Path())
+	equals(t, 1, len(res))
+	equals(t, 5, len(res[0].Path))
+
+	_, err := from().Repeat(graph.Sub().Out("manages")).All(ctx)
+	assert(t, err != nil, "expected an error for a repeat without times, until or emit")
+
+	_, err = from().Repeat(graph.Sub().Out("manages")).Times(20).All(ctx)
+	assert(t, err != nil, "expected an error for times over the max depth")
+
+	_, err = from().As("a").Repeat(graph.Sub().Out("manages")).Times(1).As("b").Select("a", "b").Rows(ctx)
+	assert(t, err != nil, "expected an error for a label following a repeat")
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(fmt.Sprintf(`{
+	  "type": "emp",
+	  "id": %q,
+	  "next": {
+	    "repeat": {"body": {"next": {"types": ["manages"], "direction": 0, "limit": 2000, "target": {"limit": 2000}}}, "until": "n >= 3"},
+	    "target": {"limit": 2000}
+	  }
+	}`, emps[0].ID)), tr))
+
+	res, err = g.Run(ctx, tr)
+	ok(t, err)
+	equals(t, 1, len(res))
+	equals(t, emps[3].Key(), res[0].Key)
+
+	err = json.Unmarshal([]byte(`{"type": "emp", "next": {"repeat": {"body": {}}, "target": {}}}`), g.Traversal())
+	assert(t, err != nil, "expected an error for a repeat without times, until or emit")
+}
+
+func shortestPath(t *testing.T, g *graph.Graph) {
+	// a line of cities 0 -> 1 -> ... -> 7 with 1km roads and a 10km road from 0 to 3.
+	cities := []*objects.Node{}
+	for i := 0; i < 8; i++ {
+		c, err := g.CreateNode(ctx, "city", map[string]interface{}{"n": i})
+		ok(t, err)
+		cities = append(cities, c)
+
+		if i > 0 {
+			_, err = g.CreateEdge(ctx, "road", cities[i-1].Key(), c.Key(), map[string]interface{}{"km": 1})
+			ok(t, err)
+		}
+	}
+
+	_, err := g.CreateEdge(ctx, "road", cities[0].Key(), cities[3].Key(), map[string]interface{}{"km": 10})
+	ok(t, err)
+	ok(t, g.Flush(ctx))
+
+	key := func(i int) string { return cities[i].Key() }
+
+	paths, err := g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{})
+	ok(t, err)
+	equals(t, 1, len(paths))
+	equals(t, 11, len(paths[0].Objects))
+	equals(t, 5.0, paths[0].Cost)
+	equals(t, key(0), paths[0].Objects[0].Key)
+	equals(t, key(3), paths[0].Objects[2].Key)
+	equals(t, key(7), paths[0].Objects[10].Key)
+
+	for i := 1; i < len(paths[0].Objects); i += 2 {
+		assert(t, paths[0].Objects[i].IsEdge(), "expected an edge at %d", i)
+	}
+
+	// edges are only followed out of the source by default.
+	paths, err = g.ShortestPath(ctx, key(7), key(0), graph.ShortestPathOptions{})
+	ok(t, err)
+	equals(t, 0, len(paths))
+
+	paths, err = g.ShortestPath(ctx, key(7), key(0), graph.ShortestPathOptions{Dir: objects.In})
+	ok(t, err)
+	equals(t, 1, len(paths))
+	equals(t, 5.0, paths[0].Cost)
+
+	paths, err = g.ShortestPath(ctx, key(7), key(2), graph.ShortestPathOptions{Dir: objects.Both, Types: []string{"road"}})
+	ok(t, err)
+	equals(t, 1, len(paths))
+	equals(t, 5.0, paths[0].Cost)
+
+	paths, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{MaxDepth: 4})
+	ok(t, err)
+	equals(t, 0, len(paths))
+
+	paths, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{Types: []string{"rail"}})
+	ok(t, err)
+	equals(t, 0, len(paths))
+
+	paths, err = g.ShortestPath(ctx, key(2), key(2), graph.ShortestPathOptions{})
+	ok(t, err)
+	equals(t, 1, len(paths))
+	equals(t, 1, len(paths[0].Objects))
+
+	// weighted paths avoid the long road.
+	paths, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{Weight: "km"})
+	ok(t, err)
+	equals(t, 1, len(paths))
+	equals(t, 7.0, paths[0].Cost)
+	equals(t, 15, len(paths[0].Objects))
+
+	paths, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{Weight: "km", K: 3})
+	ok(t, err)
+	equals(t, 2, len(paths))
+	equals(t, 7.0, paths[0].Cost)
+	equals(t, 14.0, paths[1].Cost)
+
+	paths, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{K: 2})
+	ok(t, err)
+	equals(t, 2, len(paths))
+	equals(t, 5.0, paths[0].Cost)
+	equals(t, 7.0, paths[1].Cost)
+
+	_, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{Weight: "minutes"})
+	assert(t, err != nil, "expected an error for a missing weight")
+
+	// weights may be nested and of any numeric type, but must be non-negative numbers.
+	ferry, err := g.CreateEdge(ctx, "ferry", key(0), key(7), map[string]interface{}{"cost": map[string]interface{}{"km": int64(3)}})
+	ok(t, err)
+
+	paths, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{Weight: "cost.km", Types: []string{"ferry"}})
+	ok(t, err)
+	equals(t, 1, len(paths))
+	equals(t, 3.0, paths[0].Cost)
+
+	for _, km := range []interface{}{"far", -1} {
+		_, err = g.CreateEdge(ctx, "ferry", key(0), key(7), map[string]interface{}{"cost": map[string]interface{}{"km": km}})
+		ok(t, err)
+
+		_, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{Weight: "cost.km", Types: []string{"ferry"}})
+		assert(t, err != nil, "expected an error for a weight of %v", km)
+	}
+	ok(t, g.DelEdge(ctx, ferry))
+
+	_, err = g.ShortestPath(ctx, key(0), "city_missing", graph.ShortestPathOptions{})
+	assert(t, err != nil, "expected an error for a missing node")
+
+	g.SetBudget(graph.Budget{MaxScanned: 3})
+	_, err = g.ShortestPath(ctx, key(0), key(7), graph.ShortestPathOptions{})
+	_, isBudget := err.(*graph.BudgetError)
+	assert(t, isBudget, "expected a budget error, got %v", err)
+	g.SetBudget(graph.Budget{})
+}
+
+func analyze(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	// the main user follows the 20 others who have 5 posts each.
+	j, err := analytics.NewJob(analytics.Spec{
+		Algorithm: "degree",
+		Selection: analytics.Selection{NodeTypes: []string{"user"}, EdgeTypes: []string{"follows"}},
+	})
+	ok(t, err)
+	ok(t, j.Run(ctx, g))
+
+	st := j.Status()
+	equals(t, analytics.Done, st.State)
+	equals(t, 21, st.Nodes)
+	equals(t, 20, st.Edges)
+
+	res := j.Results()
+	equals(t, 21, len(res))
+
+	max := res[0]
+	for _, r := range res {
+		if r.Value.(float64) > max.Value.(float64) {
+			max = r
+		}
+	}
+	equals(t, 1.0, max.Value)
+
+	// components over every node, each user and their posts is connected through the main user.
+	j, err = analytics.NewJob(analytics.Spec{
+		Algorithm: "wcc",
+		Selection: analytics.Selection{EdgeTypes: []string{"follows", "posts"}},
+		Property:  "component",
+	})
+	ok(t, err)
+	ok(t, j.Run(ctx, g))
+	equals(t, 121, j.Status().Nodes)
+	equals(t, 0, len(j.Results()))
+
+	equals(t, 21, count(t, g.Traversal().Limit(500).Is("user").Where("component == 0")))
+	equals(t, 100, count(t, g.Traversal().Limit(500).Is("post").Where("component == 0")))
+
+	jobs := analytics.NewJobs(g)
+	j, err = jobs.Start(analytics.Spec{Algorithm: "pagerank", Selection: analytics.Selection{NodeTypes: []string{"user"}}})
+	ok(t, err)
+
+	for i := 0; i < 100 && j.Status().State != analytics.Done; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	equals(t, analytics.Done, j.Status().State)
+	equals(t, 1, len(jobs.List()))
+	equals(t, 21, len(j.Results()))
+
+	equals(t, j, jobs.Remove(j.ID))
+	equals(t, 0, len(jobs.List()))
+
+	// a job removed as soon as it is started is cancelled.
+	j, err = jobs.Start(analytics.Spec{Algorithm: "pagerank", Selection: analytics.Selection{NodeTypes: []string{"user"}}})
+	ok(t, err)
+	jobs.Remove(j.ID)
+
+	for i := 0; i < 100 && j.Status().Finished.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	equals(t, analytics.Cancelled, j.Status().State)
+
+	// without node types only the node keys and the forward edges are scanned.
+	edges := 0
+	fwd, errc := g.Store().Prefix(ctx, objects.ForwardEdgeKey, 100000)
+	for range fwd {
+		edges++
+	}
+	ok(t, <-errc)
+
+	scanned := 0
+	snap, err := analytics.Load(ctx, g.Store(), analytics.Selection{}, func(n int) { scanned = n })
+	ok(t, err)
+	equals(t, 121, snap.Len())
+	equals(t, 121+edges, scanned)
+
+	_, err = jobs.Start(analytics.Spec{Algorithm: "unknown"})
+	assert(t, err != nil, "expected an error for an unknown algorithm")
+}
+
+func orderResults(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	// the main user has no n and sorts before the others.
+	res := all(t, g.Traversal().Is("user").WithBody().Order("n", false))
+	equals(t, 21, len(res))
+	equals(t, nil, res[0].Val["n"])
+	for i, o := range res[1:] {
+		equals(t, float64(i), o.Val["n"])
+	}
+
+	res = all(t, g.Traversal().Is("user").WithBody().Order("n", true))
+	equals(t, 19.0, res[0].Val["n"])
+	equals(t, nil, res[20].Val["n"])
+
+	// every post has an n from 0 to 4, posts with the same n are sorted by key. Bodies are only loaded to sort.
+	res = all(t, g.Traversal().Is("user").Out("posts").Order("n", true))
+	equals(t, 100, len(res))
+	assert(t, res[0].Val == nil, "expected no body")
+	for i := 1; i < len(res); i++ {
+		if res[i-1].Key > res[i].Key {
+			body, err := g.GetBody(ctx, res[i].Key)
+			ok(t, err)
+			prev, err := g.GetBody(ctx, res[i-1].Key)
+			ok(t, err)
+			assert(t, prev["n"].(float64) > body["n"].(float64), "expected posts sorted by n then key")
+		}
+	}
+
+	full := all(t, g.Traversal().Is("user").Order("n", true))
+
+	pages := []*objects.Object{}
+	cursor := ""
+	for i := 0; i < 10; i++ {
+		page, next, err := g.RunPage(ctx, g.Traversal().Is("user").Order("n", true).Page(8, cursor))
+		ok(t, err)
+		pages = append(pages, page...)
+
+		if next == "" {
+			equals(t, 5, len(page))
+			break
+		}
+
+		equals(t, 8, len(page))
+		cursor = next
+	}
+
+	equals(t, len(full), len(pages))
+	for i := range full {
+		equals(t, full[i].Key, pages[i].Key)
+	}
+
+	// without an order pages are sorted by key.
+	page, next, err := g.RunPage(ctx, g.Traversal().Is("user").Page(10, ""))
+	ok(t, err)
+	equals(t, 10, len(page))
+	assert(t, next != "", "expected a cursor")
+	for i := 1; i < len(page); i++ {
+		assert(t, page[i-1].Key < page[i].Key, "expected keys in order")
+	}
+
+	_, _, err = g.RunPage(ctx, g.Traversal().Is("user").Order("n", false).Page(10, next))
+	_, isCursor := err.(*graph.CursorError)
+	assert(t, isCursor, "expected a cursor error for a cursor of another order, got %v", err)
+
+	_, _, err = g.RunPage(ctx, g.Traversal().Is("user").Page(10, "not a cursor"))
+	_, isCursor = err.(*graph.CursorError)
+	assert(t, isCursor, "expected a cursor error, got %v", err)
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{"type": "user", "limit": 100, "order": [{"by": "n", "desc": true}], "page_size": 5}`), tr))
+	page, next, err = g.RunPage(ctx, tr)
+	ok(t, err)
+	equals(t, 5, len(page))
+	equals(t, full[0].Key, page[0].Key)
+
+	tr.Cursor = next
+	page, _, err = g.RunPage(ctx, tr)
+	ok(t, err)
+	equals(t, full[5].Key, page[0].Key)
+
+	// pages by key read the nodes from the cursor on, past the limit of the root.
+	keys := []string{}
+	cursor = ""
+	for i := 0; i < 10; i++ {
+		page, next, err := g.RunPage(ctx, g.Traversal().Is("user").Limit(5).Page(4, cursor))
+		ok(t, err)
+		for _, o := range page {
+			keys = append(keys, o.Key)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	equals(t, 21, len(keys))
+	for i := 1; i < len(keys); i++ {
+		assert(t, keys[i-1] < keys[i], "expected keys in order")
+	}
+
+	// sorted pages cannot be cut from a scan which hit its limit.
+	_, _, err = g.RunPage(ctx, g.Traversal().Is("user").Limit(5).Order("n", true).Page(3, ""))
+	_, isTruncated := err.(*graph.TruncatedError)
+	assert(t, isTruncated, "expected a truncated error, got %v", err)
+
+	tr, err = g.Query("user -posts limit 2-> post")
+	ok(t, err)
+	_, _, err = g.RunPage(ctx, tr.Page(3, ""))
+	_, isTruncated = err.(*graph.TruncatedError)
+	assert(t, isTruncated, "expected a truncated error, got %v", err)
+}
+
+func aggregate(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	result := func(tr *graph.Traversal) interface{} {
+		v, err := tr.Result(ctx)
+		ok(t, err)
+		return v
+	}
+
+	// users are numbered 0 to 19 apart from the main user.
+	equals(t, 190.0, result(g.Traversal().Is("user").Sum("n")))
+	equals(t, 9.5, result(g.Traversal().Is("user").Mean("n")))
+	equals(t, 0.0, result(g.Traversal().Is("user").Min("n")))
+	equals(t, 19.0, result(g.Traversal().Is("user").Max("n")))
+	equals(t, 20, result(g.Traversal().Is("user").CountDistinct("n")))
+	equals(t, 21, result(g.Traversal().Is("user").CountDistinct("")))
+	equals(t, nil, result(g.Traversal().Is("user").Mean("missing")))
+
+	// every user has posts numbered 0 to 4.
+	groups := result(g.Traversal().Is("user").Out("posts").GroupCount("n")).(map[string]interface{})
+	equals(t, 5, len(groups))
+	equals(t, 20, groups["3"])
+
+	groups = result(g.Traversal().Is("post").Limit(500).Group("n").By("sum", "n")).(map[string]interface{})
+	equals(t, 5, len(groups))
+	equals(t, 0.0, groups["0"])
+	equals(t, 80.0, groups["4"])
+
+	// likes per post among the people the main user follows, users 15 to 19 like the posts of the users before them.
+	likes := result(g.Traversal().Is("user").HasNot("n").Out("follows").Out("likes").Path().GroupCount("id")).(map[string]interface{})
+	equals(t, 95, len(likes))
+
+	total := 0
+	for _, c := range likes {
+		total += c.(int)
+	}
+	equals(t, 425, total)
+
+	equals(t, 5, count(t, g.Traversal().Is("user").Out("posts").GroupBy("n")))
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "post",
+	  "limit": 500,
+	  "aggregate": {"op": "group", "property": "n", "by": {"op": "mean", "property": "n"}}
+	}`), tr))
+
+	v, err := g.Aggregate(ctx, tr)
+	ok(t, err)
+	equals(t, 2.0, v.(map[string]interface{})["2"])
+
+	err = json.Unmarshal([]byte(`{"type": "post", "aggregate": {"op": "median", "property": "n"}}`), g.Traversal())
+	assert(t, err != nil, "expected an error for an unknown aggregation")
+
+	_, err = g.Aggregate(ctx, g.Traversal().Is("post"))
+	assert(t, err != nil, "expected an error for a traversal without an aggregation")
+
+	_, err = g.Traversal().Is("post").Group("n").By("median", "n").Result(ctx)
+	assert(t, err != nil, "expected an error for an unknown by aggregation")
+
+	_, err = g.Traversal().Is("post").Sum("n").By("sum", "n").Result(ctx)
+	assert(t, err != nil, "expected an error for by without a group")
+
+	// values of different types are grouped apart.
+	for _, v := range []map[string]interface{}{{"v": "1"}, {"v": 1}, {"v": "null"}, {}} {
+		_, err = g.CreateNode(ctx, "tag", v)
+		ok(t, err)
+	}
+
+	groups = result(g.Traversal().Is("tag").GroupCount("v")).(map[string]interface{})
+	equals(t, map[string]interface{}{`"1"`: 1, "1": 1, `"null"`: 1, "null": 1}, groups)
+}
+
+func sets(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	posts := func(where string) *graph.Traversal {
+		return g.Traversal().Is("user").Where(where).Out("posts")
+	}
+
+	liked := func(where string) *graph.Traversal {
+		return g.Traversal().Is("user").Where(where).Out("likes")
+	}
+
+	equals(t, 10, count(t, posts("n == 0").Union(posts("n == 1"))))
+	equals(t, 10, count(t, posts("n <= 1").Union(posts("n == 1"))))
+	equals(t, 15, count(t, posts("n == 0").Union(posts("n == 1"), posts("n == 2"))))
+
+	// users 15 to 19 like the posts of every user before them.
+	equals(t, 95, count(t, liked("n == 19")))
+	equals(t, 25, count(t, liked("n == 19").Intersect(posts("n < 5"))))
+	equals(t, 5, count(t, liked("n == 19").Intersect(posts("n < 5"), posts("n == 2"))))
+
+	// posts liked by users 15 to 19 except those already liked by user 15.
+	equals(t, 20, count(t, liked("n >= 15").Except(liked("n == 15"))))
+	equals(t, 15, count(t, liked("n >= 15").Except(liked("n == 15"), posts("n == 18"))))
+
+	// set operations apply before ordering and aggregation.
+	res := all(t, posts("n == 0").Union(posts("n == 1")).Order("id", false))
+	equals(t, 10, len(res))
+	for i := 1; i < len(res); i++ {
+		assert(t, res[i-1].Node().ID < res[i].Node().ID, "expected ids in order")
+	}
+
+	v, err := posts("n == 0").Union(posts("n == 1")).GroupCount("n").Result(ctx)
+	ok(t, err)
+	equals(t, 2, v.(map[string]interface{})["4"])
+
+	_, err = posts("n == 0").Union(posts("n == 1").Sum("n")).All(ctx)
+	assert(t, err != nil, "expected an error for an aggregated union")
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "user",
+	  "limit": 100,
+	  "filters": ["n >= 15"],
+	  "next": {"types": ["likes"], "direction": 0, "limit": 2000, "target": {"limit": 2000}},
+	  "except": [{
+	    "type": "user",
+	    "limit": 100,
+	    "filters": ["n == 15"],
+	    "next": {"types": ["likes"], "direction": 0, "limit": 2000, "target": {"limit": 2000}}
+	  }]
+	}`), tr))
+
+	steps, err := g.Explain(tr)
+	ok(t, err)
+	equals(t, "except", steps[len(steps)-1].Step)
+	assert(t, len(steps[len(steps)-1].Body) > 0, "expected the plan of the except traversal")
+
+	res, err = g.Run(ctx, tr)
+	ok(t, err)
+	equals(t, 20, len(res))
+}
+
+func edges(t *testing.T, g *graph.Graph) {
+	a, err := g.CreateNode(ctx, "user", nil)
+	ok(t, err)
+	b, err := g.CreateNode(ctx, "user", nil)
+	ok(t, err)
+
+	// a likes posts 0 to 4 at times 0 to 4, b likes post 0 at time 10.
+	posts := []*objects.Node{}
+	for i := 0; i < 5; i++ {
+		p, err := g.CreateNode(ctx, "post", map[string]interface{}{"n": i})
+		ok(t, err)
+		_, err = g.CreateEdge(ctx, "likes", a.Key(), p.Key(), map[string]interface{}{"at": i})
+		ok(t, err)
+		posts = append(posts, p)
+	}
+	_, err = g.CreateEdge(ctx, "likes", b.Key(), posts[0].Key(), map[string]interface{}{"at": 10})
+	ok(t, err)
+	ok(t, g.Flush(ctx))
+
+	user := func(n *objects.Node) *graph.Traversal {
+		return g.Traversal().Is(n.Type).Has("id", n.ID)
+	}
+
+	res := all(t, user(a).OutE("likes"))
+	equals(t, 5, len(res))
+	for _, o := range res {
+		assert(t, o.IsEdge(), "expected an edge")
+		e := o.Edge()
+		equals(t, a.Key(), e.Source)
+		_, found := e.Body["at"]
+		assert(t, found, "expected the edge body")
+	}
+
+	equals(t, 2, count(t, user(a).OutE("likes").Where("at >= 3")))
+	for _, o := range all(t, user(a).OutE("likes").Where("at >= 3").OtherV()) {
+		assert(t, o.IsNode(), "expected a node")
+		equals(t, "post", o.Node().Type)
+	}
+
+	post := g.Traversal().Is("post").Has("id", posts[0].ID)
+	res = all(t, post.InE("likes").Where("at > 5").OtherV())
+	equals(t, 1, len(res))
+	equals(t, b.Key(), res[0].Key)
+	equals(t, 2, count(t, g.Traversal().Is("post").Has("id", posts[0].ID).BothE("likes").OtherV().Is("user")))
+
+	// edges can be ordered, aggregated and selected like nodes.
+	res = all(t, user(a).OutE("likes").Order("at", true))
+	equals(t, 4.0, res[0].Edge().Body["at"])
+
+	v, err := user(a).OutE("likes").Sum("at").Result(ctx)
+	ok(t, err)
+	equals(t, 10.0, v)
+
+	rows, err := user(a).As("u").OutE("likes").As("e").OtherV().As("p").Select("u", "e", "p").Rows(ctx)
+	ok(t, err)
+	equals(t, 5, len(rows))
+	for _, row := range rows {
+		equals(t, a.Key(), row["u"].Key)
+		equals(t, row["e"].Edge().Target, row["p"].Key)
+	}
+
+	_, err = user(a).OutE("likes").Out("likes").All(ctx)
+	assert(t, err != nil, "expected an error following edges with a hop")
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(fmt.Sprintf(`{
+	  "type": "user",
+	  "id": %q,
+	  "limit": 1,
+	  "next": {
+	    "types": ["likes"],
+	    "direction": 0,
+	    "limit": 100,
+	    "edges": true,
+	    "target": {"limit": 100, "filters": ["at < 2"], "next": {"other": true, "target": {"limit": 100}}}
+	  }
+	}`, a.ID)), tr))
+
+	res, err = g.Run(ctx, tr)
+	ok(t, err)
+	equals(t, 2, len(res))
+	for _, o := range res {
+		assert(t, o.Key == posts[0].Key() || o.Key == posts[1].Key(), "expected posts 0 and 1")
+	}
+}
+
+func optionalSteps(t *testing.T, g *graph.Graph) {
+	// users 0 and 1 have a photo, user 1 and 2 an avatar and users 3 and 4 neither.
+	users := []*objects.Node{}
+	for i := 0; i < 5; i++ {
+		u, err := g.CreateNode(ctx, "user", map[string]interface{}{"n": i})
+		ok(t, err)
+		users = append(users, u)
+
+		for _, typ := range map[int][]string{0: {"photo"}, 1: {"photo", "avatar"}, 2: {"avatar"}}[i] {
+			img, err := g.CreateNode(ctx, "image", map[string]interface{}{"kind": typ})
+			ok(t, err)
+			_, err = g.CreateEdge(ctx, typ, u.Key(), img.Key(), nil)
+			ok(t, err)
+		}
+	}
+	ok(t, g.Flush(ctx))
+
+	res := all(t, g.Traversal().Is("user").Optional(graph.Sub().Out("photo")).Optional(graph.Sub().Out("avatar")))
+	equals(t, 5, len(res))
+	for _, o := range res {
+		n := int(o.Node().Body["n"].(float64))
+		equals(t, 2, len(o.Matches))
+		equals(t, map[bool]int{true: 1}[n < 2], len(o.Matches[0]))
+		equals(t, map[bool]int{true: 1}[n == 1 || n == 2], len(o.Matches[1]))
+		for _, m := range o.Matches[0] {
+			equals(t, "image", m.Node().Type)
+		}
+	}
+
+	// the first branch finding anything wins.
+	res = all(t, g.Traversal().Is("user").Coalesce(graph.Sub().Out("photo"), graph.Sub().Out("avatar")).WithBody())
+	equals(t, 3, len(res))
+	kinds := map[string]int{}
+	for _, o := range res {
+		kinds[o.Node().Body["kind"].(string)]++
+	}
+	equals(t, map[string]int{"photo": 2, "avatar": 1}, kinds)
+
+	// the matches of a labelled step are selected along with it.
+	rows, err := g.Traversal().Is("user").Has("id", users[0].ID).As("u").Optional(graph.Sub().Out("photo")).Select("u").Rows(ctx)
+	ok(t, err)
+	equals(t, 1, len(rows))
+	equals(t, 1, len(rows[0]["u"].Matches[0]))
+
+	tr := g.Traversal()
+	ok(t, json.Unmarshal([]byte(`{
+	  "type": "user",
+	  "limit": 100,
+	  "optional": [{"next": {"types": ["photo"], "direction": 0, "limit": 100, "target": {"limit": 100}}}],
+	  "next": {
+	    "coalesce": [
+	      {"next": {"types": ["avatar"], "direction": 0, "limit": 100, "target": {"limit": 100}}},
+	      {"next": {"types": ["photo"], "direction": 0, "limit": 100, "target": {"limit": 100}}}
+	    ],
+	    "limit": 100,
+	    "target": {"limit": 100}
+	  }
+	}`), tr))
+
+	steps, err := g.Explain(tr)
+	ok(t, err)
+	names := []string{}
+	for _, s := range steps {
+		names = append(names, s.Step)
+	}
+	equals(t, []string{"scan", "dedupe", "optional", "coalesce", "nodes", "dedupe"}, names)
+	equals(t, 2, len(steps[3].Body))
+
+	res, err = g.Run(ctx, tr)
+	ok(t, err)
+	equals(t, 3, len(res))
+
+	data, err := json.Marshal(all(t, g.Traversal().Is("user").Has("id", users[3].ID).Optional(graph.Sub().Out("photo"))))
+	ok(t, err)
+	assert(t, strings.Contains(string(data), `"matches":[[]]`), "expected empty matches in "+string(data))
+}
+
+func textQuery(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	query := func(src string) *graph.Traversal {
+		tr, err := g.Query(src)
+		ok(t, err)
+		return tr
+	}
+
+	// the same traversal as social-graph:post-serialized.
+	equals(t, 100, count(t, query(`user -follows-> user -posts-> post`)))
+	equals(t, 40, count(t, query(`user -follows-> user -posts-> post where n > 2`)))
+	equals(t, 20, count(t, query(`user -follows-> user -posts-> post where n > 2 limit 20`)))
+	equals(t, 5, count(t, query(`user where n == 15 -!dislike|likes-> post`)))
+	equals(t, 6, count(t, query(`user where n == 0 -posts-> post <-likes|posts- user`)))
+
+	res := all(t, query(`user(n: 3) -posts-> post order by n desc page 2`))
+	equals(t, 2, len(res))
+
+	v, err := query(`user -follows-> user -posts-> post return group(n)`).Result(ctx)
+	ok(t, err)
+	equals(t, 20, v.(map[string]interface{})["0"])
+
+	rows, err := query(`user(n: 3) as u -posts-> post as p select u, p`).Rows(ctx)
+	ok(t, err)
+	equals(t, 5, len(rows))
+
+	_, err = g.Query("user -follows->\n  user where n >")
+	_, isSyntax := err.(*graph.SyntaxError)
+	assert(t, isSyntax, "expected a syntax error got %v", err)
+}
+
+func storedQueries(t *testing.T, g *graph.Graph) {
+	if _, isSys := g.Store().(store.SystemStore); !isSys {
+		fmt.Println("---> store has no system store, skipping stored queries")
+		return
+	}
+
+	seedSocial(t, g)
+
+	q := &graph.StoredQuery{
+		Name:   "posts-of",
+		Query:  `user(n: $n) -posts-> post where n > $min limit $limit`,
+		Params: map[string]string{"n": "integer", "min": "number", "limit": "integer"},
+	}
+	ok(t, g.PutQuery(ctx, q))
+
+	tr, err := g.Stored(ctx, "posts-of", map[string]interface{}{"n": 3, "min": 1, "limit": 2})
+	ok(t, err)
+	equals(t, 2, count(t, tr))
+
+	// parameters decoded from json.
+	params := map[string]interface{}{}
+	ok(t, json.Unmarshal([]byte(`{"n": 3, "min": -1, "limit": 100}`), &params))
+	tr, err = g.Stored(ctx, "posts-of", params)
+	ok(t, err)
+	equals(t, 5, count(t, tr))
+
+	_, err = g.Stored(ctx, "posts-of", map[string]interface{}{"n": 3.5, "min": 1, "limit": 2})
+	perr, isParam := err.(*graph.ParamError)
+	assert(t, isParam, "expected a param error got %v", err)
+	equals(t, "n", perr.Param)
+
+	_, err = g.Stored(ctx, "posts-of", map[string]interface{}{"n": 3, "min": 1})
+	_, isParam = err.(*graph.ParamError)
+	assert(t, isParam, "expected a param error got %v", err)
+
+	// a query must parse with its parameters to be stored.
+	err = g.PutQuery(ctx, &graph.StoredQuery{Name: "bad", Query: `user(n: $n)`})
+	_, isSyntax := err.(*graph.SyntaxError)
+	assert(t, isSyntax, "expected a syntax error got %v", err)
+
+	err = g.PutQuery(ctx, &graph.StoredQuery{Name: "bad", Query: `user(n: $n)`, Params: map[string]string{"n": "date"}})
+	_, isParam = err.(*graph.ParamError)
+	assert(t, isParam, "expected a param error got %v", err)
+
+	// stored queries are kept apart from the graph.
+	equals(t, 21, count(t, g.Traversal().Is("user").Limit(100)))
+	equals(t, 0, count(t, g.Traversal().Is("query").Limit(100)))
+
+	list, err := g.Queries(ctx)
+	ok(t, err)
+	equals(t, 1, len(list))
+	equals(t, "posts-of", list[0].Name)
+	equals(t, "integer", list[0].Params["limit"])
+	assert(t, !list[0].Created.IsZero(), "expected the created time")
+
+	ok(t, g.DeleteQuery(ctx, "posts-of"))
+	tr, err = g.Stored(ctx, "posts-of", nil)
+	ok(t, err)
+	assert(t, tr == nil, "expected no query")
+}
+
+func stream(t *testing.T, g *graph.Graph) {
+	seedSocial(t, g)
+
+	tr := g.Traversal()
+	tr.Is("user").Out("follows").Out("posts")
+
+	posts := 0
+	stats, err := g.Stream(ctx, tr, func(o *objects.Object) error {
+		equals(t, "post", o.Node().Type)
+		posts++
+		return nil
+	})
+	ok(t, err)
+	equals(t, 100, posts)
+	equals(t, 100, stats.Results)
+
+	// returning an error stops the traversal.
+	stop := fmt.Errorf("stop")
+	seen := 0
+	_, err = g.Stream(ctx, tr, func(o *objects.Object) error {
+		seen++
+		if seen == 5 {
+			return stop
+		}
+		return nil
+	})
+	equals(t, stop, err)
+	equals(t, 5, seen)
+
+	paged := g.Traversal()
+	paged.Is("user").Out("follows").Out("posts").Page(30, "")
+	stats, err = g.Stream(ctx, paged, func(*objects.Object) error { return nil })
+	ok(t, err)
+	equals(t, 30, stats.Results)
+	assert(t, stats.Cursor != "", "expected a cursor")
+
+	counted := g.Traversal()
+	counted.Is("user").Out("follows").Out("posts").CountDistinct("")
+	stats, err = g.Stream(ctx, counted, func(*objects.Object) error { return nil })
+	ok(t, err)
+	equals(t, 0, stats.Results)
+	equals(t, 100, stats.Value)
+}
+
+func changes(t *testing.T, g *graph.Graph) {
+	ok(t, g.TrackChanges(ctx))
+
+	a, err := g.CreateNode(ctx, "user", map[string]interface{}{"n": 1})
+	ok(t, err)
+	b, err := g.CreateNode(ctx, "user", nil)
+	ok(t, err)
+
+	a.Body = map[string]interface{}{"n": 2}
+	ok(t, g.PutNode(ctx, a))
+
+	e, err := g.CreateEdge(ctx, "follows", a.Key(), b.Key(), map[string]interface{}{"at": 5})
+	ok(t, err)
+	_, err = g.CreateEdge(ctx, "follows", a.Key(), a.Key(), nil)
+	ok(t, err)
+
+	// deleting a node deletes its edges, an edge to itself once.
+	ok(t, g.DelNode(ctx, a))
+	ok(t, g.DelEdge(ctx, e))
+
+	list, err := g.Changes(ctx, 0, 100)
+	ok(t, err)
+
+	ops := []string{}
+	for i, c := range list {
+		equals(t, int64(i+1), c.Seq)
+		ops = append(ops, c.Op+" "+c.ResourceID)
+	}
+	equals(t, []string{
+		"create " + a.ResourceID(),
+		"create " + b.ResourceID(),
+		"update " + a.ResourceID(),
+		"create " + e.ResourceID(),
+		"create edge:follows." + a.Key() + "." + a.Key(),
+		"delete " + a.ResourceID(),
+	}, ops[:6])
+
+	// the edges of a node are deleted in the order they are stored.
+	deleted := ops[6:]
+	sort.Strings(deleted)
+	exp := []string{"delete " + e.ResourceID(), "delete edge:follows." + a.Key() + "." + a.Key()}
+	sort.Strings(exp)
+	equals(t, exp, deleted)
+
+	equals(t, "node", list[2].Type)
+	equals(t, float64(1), list[2].Old["n"])
+	equals(t, float64(2), list[2].New["n"])
+	equals(t, "edge", list[3].Type)
+	equals(t, float64(5), list[3].New["at"])
+	assert(t, list[5].New == nil, "expected no new body")
+	equals(t, float64(2), list[5].Old["n"])
+
+	list, err = g.Changes(ctx, 6, 100)
+	ok(t, err)
+	equals(t, 2, len(list))
+
+	// the changes are not part of the graph.
+	equals(t, 1, count(t, g.Traversal().Is("user").Limit(100)))
+
+	// the feed carries on after a restart.
+	restarted := graph.New(g.Store())
+	ok(t, restarted.TrackChanges(ctx))
+
+	sub, cancel := context.WithCancel(ctx)
+	res, errc := restarted.Subscribe(sub, 7)
+
+	c := <-res
+	equals(t, int64(8), c.Seq)
+
+	_, err = restarted.CreateNode(ctx, "user", nil)
+	ok(t, err)
+
+	c = <-res
+	equals(t, int64(9), c.Seq)
+	equals(t, "create", c.Op)
+
+	cancel()
+	for range res {
+	}
+	ok(t, <-errc)
+
+	timeout, done := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer done()
+	list, err = restarted.Poll(timeout, 9, 100)
+	ok(t, err)
+	equals(t, 0, len(list))
+
+	// the old body of each change is the new body of the change before it, however the writes interleave.
+	n, err := restarted.CreateNode(ctx, "counter", map[string]interface{}{"n": 0})
+	ok(t, err)
+
+	errs := make(chan error)
+	for w := 1; w <= 8; w++ {
+		go func(w int) {
+			for i := 0; i < 25; i++ {
+				err := restarted.PutNode(ctx, &objects.Node{Type: n.Type, ID: n.ID, Body: map[string]interface{}{"n": w*100 + i}})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		ok(t, <-errs)
+	}
+
+	list, err = restarted.Changes(ctx, 9, 1000)
+	ok(t, err)
+	equals(t, 201, len(list))
+	for i, c := range list[1:] {
+		equals(t, list[i].New["n"], c.Old["n"])
+	}
+}
+
+func watch(t *testing.T, g *graph.Graph) {
+	ok(t, g.TrackChanges(ctx))
+
+	a, err := g.CreateNode(ctx, "user", nil)
+	ok(t, err)
+	b, err := g.CreateNode(ctx, "user", nil)
+	ok(t, err)
+	c, err := g.CreateNode(ctx, "user", nil)
+	ok(t, err)
+	_, err = g.CreateEdge(ctx, "follows", a.Key(), b.Key(), nil)
+	ok(t, err)
+
+	post := func(u *objects.Node) *objects.Node {
+		p, err := g.CreateNode(ctx, "post", nil)
+		ok(t, err)
+		_, err = g.CreateEdge(ctx, "posts", u.Key(), p.Key(), nil)
+		ok(t, err)
+		return p
+	}
+	p1 := post(b)
+
+	sub, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// new posts from the users a follows.
+	tr := g.Traversal()
+	tr.Is("user").Has("id", a.ID).Out("follows").Out("posts")
+	res, errc, err := g.Watch(sub, tr)
+	ok(t, err)
+
+	next := func(op string, n *objects.Node) {
+		select {
+		case rc := <-res:
+			equals(t, op+" "+n.Key(), rc.Op+" "+rc.Object.Key)
+		case <-time.After(5 * time.Second):
+			assert(t, false, "expected %s %s", op, n.Key())
+		}
+	}
+
+	next("enter", p1)
+
+	p2 := post(b)
+	next("enter", p2)
+
+	// posts of users a does not follow only enter once a follows them.
+	p3 := post(c)
+	_, err = g.CreateEdge(ctx, "follows", a.Key(), c.Key(), nil)
+	ok(t, err)
+	next("enter", p3)
+
+	ok(t, g.DelNode(ctx, p1))
+	next("leave", p1)
+
+	cancel()
+	for range res {
+	}
+	ok(t, <-errc)
+
+	counted := g.Traversal()
+	counted.Is("user").Out("follows").CountDistinct("")
+	_, _, err = g.Watch(ctx, counted)
+	assert(t, err != nil, "expected an aggregation not to be watched")
+}
+
 func seedSocial(t testing.TB, g *graph.Graph) {
 
-	main, err := g.CreateNode("user", nil)
+	main, err := g.CreateNode(ctx, "user", nil)
 	main.ID = "main"
 	ok(t, err)
 
@@ -199,13 +1871,13 @@ func seedSocial(t testing.TB, g *graph.Graph) {
 	// create users
 	for i := 0; i < 20; i++ {
 
-		u, err := g.CreateNode("user", nil)
+		u, err := g.CreateNode(ctx, "user", map[string]interface{}{"n": i})
 		ok(t, err)
 
 		if i >= 15 {
 			// users 15 - 20 like all the others posts
 			for _, p := range posts {
-				_, err = g.CreateEdge("likes", u.Key(), p.Key(), nil)
+				_, err = g.CreateEdge(ctx, "likes", u.Key(), p.Key(), nil)
 				ok(t, err)
 			}
 		}
@@ -213,24 +1885,24 @@ func seedSocial(t testing.TB, g *graph.Graph) {
 		if i >= 10 {
 			// users 10 - 20 dislike all the others posts
 			for _, p := range posts {
-				_, err = g.CreateEdge("dislike", u.Key(), p.Key(), nil)
+				_, err = g.CreateEdge(ctx, "dislike", u.Key(), p.Key(), nil)
 				ok(t, err)
 			}
 		}
 
 		// main user follows all others
-		_, err = g.CreateEdge("follows", main.Key(), u.Key(), nil)
+		_, err = g.CreateEdge(ctx, "follows", main.Key(), u.Key(), map[string]interface{}{"n": i})
 		ok(t, err)
 
 		// every user has 5 posts
-		for i := 0; i < 5; i++ {
-			p, err := g.CreateNode("post", nil)
+		for j := 0; j < 5; j++ {
+			p, err := g.CreateNode(ctx, "post", map[string]interface{}{"n": j})
 			ok(t, err)
-			_, err = g.CreateEdge("posts", u.Key(), p.Key(), nil)
+			_, err = g.CreateEdge(ctx, "posts", u.Key(), p.Key(), nil)
 			ok(t, err)
 			posts = append(posts, p)
 		}
 	}
 
-	g.Flush()
+	ok(t, g.Flush(ctx))
 }